@@ -29,8 +29,17 @@ fi
 log "headscale-pf prepare: OK"
 
 # Apply policy
-if [ -n "${APPLY_POLICY:-}" ]; then
-  [ -n "${HEADSCALE_CLI_ADDRESS:-}" ] || fail "APPLY_POLICY=1 requires HEADSCALE_CLI_ADDRESS"
+if [ -n "${APPLY_POLICY:-}" ] && [ -n "${PF_HEADSCALE_ADDRESS:-}" ]; then
+  [ -n "${PF_HEADSCALE_API_KEY:-}" ] || fail "PF_HEADSCALE_ADDRESS requires PF_HEADSCALE_API_KEY"
+
+  log "Applying policy via Headscale API at ${PF_HEADSCALE_ADDRESS}"
+  if ! headscale-pf --output-policy "${OUTPUT_POLICY}" --retry-attempts "${RETRIES}" --retry-backoff "${RETRY_DELAY_SEC}s" apply; then
+    rc=$?
+    fail "headscale-pf apply failed with exit code ${rc}"
+  fi
+  log "Policy applied."
+elif [ -n "${APPLY_POLICY:-}" ]; then
+  [ -n "${HEADSCALE_CLI_ADDRESS:-}" ] || fail "APPLY_POLICY=1 requires PF_HEADSCALE_ADDRESS or HEADSCALE_CLI_ADDRESS"
   [ -n "${HEADSCALE_CLI_API_KEY:-}" ] || fail "APPLY_POLICY=1 requires HEADSCALE_CLI_API_KEY"
 
   log "Applying policy via headscale remote CLI to ${HEADSCALE_CLI_ADDRESS}"
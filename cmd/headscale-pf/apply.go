@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/headscale"
+	"github.com/yousysadmin/headscale-pf/internal/policy"
+)
+
+// headscaleConfig returns the Headscale API settings from the flags. Failed
+// calls are retried like source calls.
+func headscaleConfig() headscale.Config {
+	return headscale.Config{
+		Address:               headscaleAddress,
+		APIKey:                headscaleAPIKey,
+		CAFile:                headscaleCAFile,
+		InsecureSkipTLSVerify: headscaleInsecure,
+		Retry:                 retryPolicy(),
+	}
+}
+
+// applyPolicy pushes the policy file at path to Headscale, which checks and
+// loads it. The policy Headscale has loaded is fetched first: if it's the same
+// apart from comments, layout and member order, nothing is pushed, so
+// Headscale doesn't reload an unchanged policy. Otherwise an audit line
+// records what changed on the server.
+func applyPolicy(ctx context.Context, path string, logCh chan<- string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	client, err := headscale.NewClient(headscaleConfig())
+	if err != nil {
+		return err
+	}
+
+	changes := "unknown, the live policy couldn't be compared"
+	live, err := client.GetPolicy(ctx)
+	if err != nil {
+		logCh <- fmt.Sprintf("Can't read the live policy from %s, applying anyway: %v", headscaleAddress, err)
+	} else if cmp, err := policy.Compare([]byte(live.Policy), data); err != nil {
+		logCh <- fmt.Sprintf("Can't compare with the live policy, applying anyway: %v", err)
+	} else if cmp.Equal() {
+		logCh <- fmt.Sprintf("Live policy on %s is up to date (updated at %s), skip applying",
+			headscaleAddress, live.UpdatedAt.Local().Format(time.DateTime))
+		return nil
+	} else {
+		changes = cmp.String()
+	}
+
+	logCh <- fmt.Sprintf("Apply policy %s to: %s", path, headscaleAddress)
+	applied, err := client.SetPolicy(ctx, string(data))
+	if err != nil {
+		return fmt.Errorf("apply policy: %w", err)
+	}
+	logCh <- fmt.Sprintf("Policy applied, updated at %s", applied.UpdatedAt.Local().Format(time.DateTime))
+	logCh <- fmt.Sprintf("Audit: policy on %s changed at %s: %s",
+		headscaleAddress, applied.UpdatedAt.UTC().Format(time.RFC3339), changes)
+	return nil
+}
@@ -1,21 +1,52 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/yousysadmin/headscale-pf/internal/backup"
+	"github.com/yousysadmin/headscale-pf/internal/identity"
+	"github.com/yousysadmin/headscale-pf/internal/policy"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
 	"github.com/yousysadmin/headscale-pf/internal/sources"
 	"github.com/yousysadmin/headscale-pf/pkg"
 	term_color "github.com/yousysadmin/headscale-pf/pkg/term-color"
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
 
 	"github.com/pterm/pterm"
 	"github.com/spf13/cobra"
 )
 
+// exitChanges is the exit code of a --dry-run that found changes.
+const exitChanges = 2
+
 var (
 	inputPolicyFile        string
 	outputPolicyFile       string
 	outputFormat           string
+	mergeStrategy          string
+	groupMerges            []string
+	memberOrder            string
+	wrapMembers            int
+	dryRun                 bool
+	diffFile               string
+	maxRemoved             int
+	maxRemovedPercent      float64
+	force                  bool
+	backups                int
+	listBackups            bool
+	apply                  bool
+	headscaleAddress       string
+	headscaleAPIKey        string
+	headscaleCAFile        string
+	headscaleInsecure      bool
 	source                 string
 	endpoint               string
 	token                  string
@@ -24,11 +55,42 @@ var (
 	ldapBindDN             string
 	ldapBaseDN             string
 	ldapDefaultEmailDomain string
+	ldapFilterGroups       []string
 	keycloakRealm          string
+	keycloakClientID       string
+	keycloakClientSecret   string
+	keycloakAuthRealm      string
+	keycloakSubgroups      bool
+	keycloakMode           string
+	includeInactive        bool
+	timeout                time.Duration
+	concurrency            int
+	retryAttempts          int
+	retryBackoff           time.Duration
+	breakerThreshold       int
+	breakerCooldown        time.Duration
+	cacheFile              string
+	cacheTTL               time.Duration
+	cacheMaxStale          time.Duration
+	offline                bool
+	recordSnapshot         string
+	usernameTemplate       string
+	sourceUsernameTmpls    []string
+	aliasesFile            string
+	membersFile            string
+	jumpcloudRegion        string
+	jumpcloudRPS           float64
+	jumpcloudNested        bool
+	authentikChildren      bool
+	authentikPagedMembers  bool
 
 	logger  *pterm.Logger
 	noColor bool
 
+	// exitCode is the process exit code once the command returns; see
+	// exitChanges.
+	exitCode int
+
 	cliCmd = &cobra.Command{
 		Use:     "headscale-pf",
 		Short:   "headscale-pf - fills groups in policy",
@@ -42,12 +104,99 @@ func init() {
 	cliCmd.PersistentFlags().StringVar(&inputPolicyFile, "input-policy", "./policy.hjson", "Headscale policy file template")
 	cliCmd.PersistentFlags().StringVar(&outputPolicyFile, "output-policy", "./current.hjson", "Headscale prepared policy file")
 	cliCmd.PersistentFlags().StringVar(&outputFormat, "output-format", "auto", "Output policy format: auto (detect from input), hjson, or json")
+	cliCmd.PersistentFlags().StringVar(&mergeStrategy, "merge", "",
+		"How source members combine with template members: replace (default), union, or pinned (keep members marked // pin) (can use env var PF_MERGE)",
+	)
+	cliCmd.PersistentFlags().StringArrayVar(&groupMerges, "group-merge", nil,
+		"Merge strategy for one group, as group=strategy, e.g. 'admins=pinned'; overrides --merge (repeatable)",
+	)
+	cliCmd.PersistentFlags().StringVar(&memberOrder, "member-order", "alphabetical",
+		"Order of group members: alphabetical or source (can use env var PF_MEMBER_ORDER)",
+	)
+	cliCmd.PersistentFlags().IntVar(&wrapMembers, "wrap-members", 0,
+		"Write groups with more members than this one per line in HuJSON output, 0 keeps the template layout (can use env var PF_WRAP_MEMBERS)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false,
+		"Show how the groups would change against --output-policy without writing it; exits with code 2 if they would",
+	)
+	cliCmd.PersistentFlags().StringVar(&diffFile, "diff-file", "", "With --dry-run, also write the changes as JSON to this file")
+	cliCmd.PersistentFlags().IntVar(&maxRemoved, "max-removed", 0,
+		"Refuse to write if more members than this would be removed overall or from one group, 0 for no limit (can use env var PF_MAX_REMOVED)",
+	)
+	cliCmd.PersistentFlags().Float64Var(&maxRemovedPercent, "max-removed-percent", 50,
+		"Refuse to write if more than this percentage of members would be removed overall or from one group, 0 for no limit (can use env var PF_MAX_REMOVED_PERCENT)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&force, "force", false, "Write the policy even if the removal checks fail (can use env var PF_FORCE)")
+	cliCmd.PersistentFlags().IntVar(&backups, "backups", 0,
+		"Keep this many timestamped backups of --output-policy, taken before it is replaced; 0 for none (can use env var PF_BACKUPS)",
+	)
 	cliCmd.PersistentFlags().BoolVar(&noColor, "no-color", false, "Disable color output")
 
+	// Flags for the Headscale API
+	cliCmd.PersistentFlags().BoolVar(&apply, "apply", false,
+		"Push the prepared policy to Headscale through its API (can use env var PF_APPLY)",
+	)
+	cliCmd.PersistentFlags().StringVar(&headscaleAddress, "headscale-address", "",
+		"Headscale server URL for --apply and the apply command, e.g. https://headscale.example.com (can use env var PF_HEADSCALE_ADDRESS)",
+	)
+	cliCmd.PersistentFlags().StringVar(&headscaleAPIKey, "headscale-api-key", "", "Headscale API key (can use env var PF_HEADSCALE_API_KEY)")
+	cliCmd.PersistentFlags().StringVar(&headscaleCAFile, "headscale-ca-file", "",
+		"PEM file with additional CA certificates for the Headscale server (can use env var PF_HEADSCALE_CA_FILE)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&headscaleInsecure, "headscale-insecure-skip-tls-verify", false,
+		"Skip TLS certificate verification for the Headscale server (can use env var PF_HEADSCALE_INSECURE_SKIP_TLS_VERIFY)",
+	)
+
 	cliCmd.PersistentFlags().StringVar(&source, "source", "", "Source (can use env var PF_SOURCE)")
 	cliCmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "Source endpoint (can use env var PF_ENDPOINT)")
 	cliCmd.PersistentFlags().StringVar(&token, "token", "", "A provider API token (can use env var PF_TOKEN)")
 	cliCmd.PersistentFlags().BoolVar(&insecureSkipTLSVerify, "insecure-skip-tls-verify", false, "Skip TLS certificate verification for HTTPS/LDAPS/StartTLS (can use env var PF_INSECURE_SKIP_TLS_VERIFY)")
+	cliCmd.PersistentFlags().BoolVar(&includeInactive, "include-inactive", false,
+		"Keep suspended, locked and disabled users in groups (can use env var PF_INCLUDE_INACTIVE)",
+	)
+	cliCmd.PersistentFlags().IntVar(&concurrency, "concurrency", 4,
+		"Number of groups resolved in parallel (can use env var PF_CONCURRENCY)",
+	)
+	cliCmd.PersistentFlags().IntVar(&retryAttempts, "retry-attempts", 3,
+		"Attempts per source call on transient errors, 1 disables retries (can use env var PF_RETRY_ATTEMPTS)",
+	)
+	cliCmd.PersistentFlags().DurationVar(&retryBackoff, "retry-backoff", 500*time.Millisecond,
+		"Wait before the first retry, doubled after each attempt (can use env var PF_RETRY_BACKOFF)",
+	)
+	cliCmd.PersistentFlags().IntVar(&breakerThreshold, "breaker-threshold", 5,
+		"Consecutive transient failures after which source calls are stopped, 0 disables the circuit breaker (can use env var PF_BREAKER_THRESHOLD)",
+	)
+	cliCmd.PersistentFlags().DurationVar(&breakerCooldown, "breaker-cooldown", 30*time.Second,
+		"How long the circuit breaker stays open (can use env var PF_BREAKER_COOLDOWN)",
+	)
+	cliCmd.PersistentFlags().StringVar(&cacheFile, "cache-file", "", "Cache source results in this file (can use env var PF_CACHE_FILE)")
+	cliCmd.PersistentFlags().DurationVar(&cacheTTL, "cache-ttl", 0,
+		"Serve cached results younger than this without asking the source (can use env var PF_CACHE_TTL)",
+	)
+	cliCmd.PersistentFlags().DurationVar(&cacheMaxStale, "cache-max-stale", 24*time.Hour,
+		"Maximum age of cached results used when the source fails, 0 disables the fallback (can use env var PF_CACHE_MAX_STALE)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&offline, "offline", false,
+		"Use only cached results and don't contact the source, requires --cache-file (can use env var PF_OFFLINE)",
+	)
+	cliCmd.PersistentFlags().StringVar(&recordSnapshot, "record-snapshot", "",
+		"Record the source results of the run to this file, for replay with --source snapshot (can use env var PF_RECORD_SNAPSHOT)",
+	)
+	cliCmd.PersistentFlags().StringVar(&usernameTemplate, "username-template", "",
+		"Go template rendering a user as Headscale user, e.g. '{{.Email}}' or '{{lower .Username}}@corp'; default '"+identity.DefaultTemplate+"' (can use env var PF_USERNAME_TEMPLATE)",
+	)
+	cliCmd.PersistentFlags().StringArrayVar(&sourceUsernameTmpls, "source-username-template", nil,
+		"Username template for one source, as source=template, e.g. 'kk={{.Email}}'; overrides --username-template (repeatable, can use env var PF_SOURCE_USERNAME_TEMPLATE with one pair per line)",
+	)
+	cliCmd.PersistentFlags().StringVar(&aliasesFile, "aliases-file", "",
+		"HuJSON file with user aliases, rewrite rules, domain rewrites and case folding (can use env var PF_ALIASES_FILE)",
+	)
+	cliCmd.PersistentFlags().StringVar(&membersFile, "members-file", "",
+		"HuJSON file with global and per-group include/exclude lists (can use env var PF_MEMBERS_FILE)",
+	)
+	cliCmd.PersistentFlags().DurationVar(&timeout, "timeout", 10*time.Minute,
+		"Time limit for the whole run: source lookups, writing the policy and --apply, 0 for none (can use env var PF_TIMEOUT)",
+	)
 
 	// Specific flags for the LDAP source
 	cliCmd.PersistentFlags().StringVar(&ldapBaseDN, "ldap-base-dn", "", "Base DN to use for LDAP searches (can use env var PF_LDAP_BASE_DN)")
@@ -56,9 +205,44 @@ func init() {
 		"Default email domain to append when user entries lack a mail attribute (can use env var PF_LDAP_DEFAULT_EMAIL_DOMAIN)",
 	)
 	cliCmd.PersistentFlags().StringVar(&ldapBindPassword, "ldap-bind-password", "", "LDAP password (can use env var PF_LDAP_BIND_PASSWORD)")
+	cliCmd.PersistentFlags().StringArrayVar(&ldapFilterGroups, "ldap-filter-group", nil,
+		"Virtual group resolved from an LDAP filter, as name=filter, e.g. 'berlin-office=(&(objectClass=person)(l=Berlin))' (repeatable)",
+	)
+
+	// Specific flags for the JumpCloud source
+	cliCmd.PersistentFlags().StringVar(&jumpcloudRegion, "jumpcloud-region", "",
+		"JumpCloud region: us (default) or eu; --endpoint overrides it (can use env var PF_JUMPCLOUD_REGION)",
+	)
+	cliCmd.PersistentFlags().Float64Var(&jumpcloudRPS, "jumpcloud-rps", 10,
+		"Maximum JumpCloud API requests per second (can use env var PF_JUMPCLOUD_RPS)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&jumpcloudNested, "jumpcloud-nested-groups", false,
+		"Include users of user groups nested in a JumpCloud group (can use env var PF_JUMPCLOUD_NESTED_GROUPS)",
+	)
+
+	// Specific flags for the Authentik source
+	cliCmd.PersistentFlags().BoolVar(&authentikChildren, "authentik-include-children", false,
+		"Include members of all child groups of an Authentik group (can use env var PF_AUTHENTIK_INCLUDE_CHILDREN)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&authentikPagedMembers, "authentik-paged-members", false,
+		"List Authentik group members page by page, for very large groups (can use env var PF_AUTHENTIK_PAGED_MEMBERS)",
+	)
 
 	// Specifc flags for the Keycloak source
 	cliCmd.PersistentFlags().StringVar(&keycloakRealm, "keycloak-realm", "", "Keycloak Realm (can use env var PF_KEYCLOAK_REALM)")
+	cliCmd.PersistentFlags().StringVar(&keycloakClientID, "keycloak-client-id", "",
+		"Keycloak confidential client ID for client-credentials login instead of --token (can use env var PF_KEYCLOAK_CLIENT_ID)",
+	)
+	cliCmd.PersistentFlags().StringVar(&keycloakClientSecret, "keycloak-client-secret", "", "Keycloak client secret (can use env var PF_KEYCLOAK_CLIENT_SECRET)")
+	cliCmd.PersistentFlags().StringVar(&keycloakAuthRealm, "keycloak-auth-realm", "",
+		"Keycloak realm the client logs in to, defaults to --keycloak-realm (can use env var PF_KEYCLOAK_AUTH_REALM)",
+	)
+	cliCmd.PersistentFlags().StringVar(&keycloakMode, "keycloak-mode", "",
+		"Resolve template groups as Keycloak \"groups\" (default) or \"roles\" (realm role or clientId:role) (can use env var PF_KEYCLOAK_MODE)",
+	)
+	cliCmd.PersistentFlags().BoolVar(&keycloakSubgroups, "keycloak-include-subgroups", false,
+		"Include members of all descendant subgroups of a Keycloak group (can use env var PF_KEYCLOAK_INCLUDE_SUBGROUPS)",
+	)
 
 	// Configure logger
 	logger = pterm.DefaultLogger.
@@ -69,7 +253,7 @@ func init() {
 	// Apply env-var fallbacks for any flag the user did not pass on the
 	// command line. Order: explicit flag > env var > zero value. Also
 	// disable colors here (after flag parsing) so --no-color takes effect.
-	cliCmd.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+	cliCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		applyEnvDefault(cmd, "source", &source, "PF_SOURCE")
 		applyEnvDefault(cmd, "endpoint", &endpoint, "PF_ENDPOINT")
 		applyEnvDefault(cmd, "token", &token, "PF_TOKEN")
@@ -77,18 +261,87 @@ func init() {
 		applyEnvDefault(cmd, "ldap-bind-dn", &ldapBindDN, "PF_LDAP_BIND_DN")
 		applyEnvDefault(cmd, "ldap-bind-password", &ldapBindPassword, "PF_LDAP_BIND_PASSWORD")
 		applyEnvDefault(cmd, "ldap-default-email-domain", &ldapDefaultEmailDomain, "PF_LDAP_DEFAULT_EMAIL_DOMAIN")
+		applyEnvDefault(cmd, "jumpcloud-region", &jumpcloudRegion, "PF_JUMPCLOUD_REGION")
 		applyEnvDefault(cmd, "keycloak-realm", &keycloakRealm, "PF_KEYCLOAK_REALM")
+		applyEnvDefault(cmd, "keycloak-client-id", &keycloakClientID, "PF_KEYCLOAK_CLIENT_ID")
+		applyEnvDefault(cmd, "keycloak-client-secret", &keycloakClientSecret, "PF_KEYCLOAK_CLIENT_SECRET")
+		applyEnvDefault(cmd, "keycloak-auth-realm", &keycloakAuthRealm, "PF_KEYCLOAK_AUTH_REALM")
+		applyEnvDefault(cmd, "keycloak-mode", &keycloakMode, "PF_KEYCLOAK_MODE")
+		applyEnvDefault(cmd, "cache-file", &cacheFile, "PF_CACHE_FILE")
+		applyEnvDefault(cmd, "record-snapshot", &recordSnapshot, "PF_RECORD_SNAPSHOT")
+		applyEnvDefault(cmd, "username-template", &usernameTemplate, "PF_USERNAME_TEMPLATE")
+		applyEnvDefault(cmd, "aliases-file", &aliasesFile, "PF_ALIASES_FILE")
+		applyEnvDefault(cmd, "members-file", &membersFile, "PF_MEMBERS_FILE")
+		applyEnvDefault(cmd, "merge", &mergeStrategy, "PF_MERGE")
+		applyEnvDefault(cmd, "member-order", &memberOrder, "PF_MEMBER_ORDER")
+		applyEnvDefault(cmd, "headscale-address", &headscaleAddress, "PF_HEADSCALE_ADDRESS")
+		applyEnvDefault(cmd, "headscale-api-key", &headscaleAPIKey, "PF_HEADSCALE_API_KEY")
+		applyEnvDefault(cmd, "headscale-ca-file", &headscaleCAFile, "PF_HEADSCALE_CA_FILE")
+		for _, f := range []struct{ flag, env string }{
+			{"concurrency", "PF_CONCURRENCY"},
+			{"timeout", "PF_TIMEOUT"},
+			{"retry-attempts", "PF_RETRY_ATTEMPTS"},
+			{"retry-backoff", "PF_RETRY_BACKOFF"},
+			{"breaker-threshold", "PF_BREAKER_THRESHOLD"},
+			{"breaker-cooldown", "PF_BREAKER_COOLDOWN"},
+			{"cache-ttl", "PF_CACHE_TTL"},
+			{"cache-max-stale", "PF_CACHE_MAX_STALE"},
+			{"backups", "PF_BACKUPS"},
+			{"max-removed", "PF_MAX_REMOVED"},
+			{"max-removed-percent", "PF_MAX_REMOVED_PERCENT"},
+			{"wrap-members", "PF_WRAP_MEMBERS"},
+			{"jumpcloud-rps", "PF_JUMPCLOUD_RPS"},
+		} {
+			if err := applyEnvFlag(cmd, f.flag, f.env); err != nil {
+				return err
+			}
+		}
+		if !cmd.Flags().Changed("source-username-template") {
+			sourceUsernameTmpls = envLines("PF_SOURCE_USERNAME_TEMPLATE")
+		}
 		if !cmd.Flags().Changed("insecure-skip-tls-verify") {
 			insecureSkipTLSVerify = envBool("PF_INSECURE_SKIP_TLS_VERIFY")
 		}
+		if !cmd.Flags().Changed("force") {
+			force = envBool("PF_FORCE")
+		}
+		if !cmd.Flags().Changed("apply") {
+			apply = envBool("PF_APPLY")
+		}
+		if !cmd.Flags().Changed("headscale-insecure-skip-tls-verify") {
+			headscaleInsecure = envBool("PF_HEADSCALE_INSECURE_SKIP_TLS_VERIFY")
+		}
+		if !cmd.Flags().Changed("offline") {
+			offline = envBool("PF_OFFLINE")
+		}
+		if !cmd.Flags().Changed("include-inactive") {
+			includeInactive = envBool("PF_INCLUDE_INACTIVE")
+		}
+		if !cmd.Flags().Changed("jumpcloud-nested-groups") {
+			jumpcloudNested = envBool("PF_JUMPCLOUD_NESTED_GROUPS")
+		}
+		if !cmd.Flags().Changed("authentik-include-children") {
+			authentikChildren = envBool("PF_AUTHENTIK_INCLUDE_CHILDREN")
+		}
+		if !cmd.Flags().Changed("authentik-paged-members") {
+			authentikPagedMembers = envBool("PF_AUTHENTIK_PAGED_MEMBERS")
+		}
+		if !cmd.Flags().Changed("keycloak-include-subgroups") {
+			keycloakSubgroups = envBool("PF_KEYCLOAK_INCLUDE_SUBGROUPS")
+		}
 
 		if !term_color.CheckTerminalColorSupport() || noColor {
 			pterm.DisableColor()
 		}
+		return nil
 	}
 
+	rollback.Flags().BoolVar(&listBackups, "list", false, "List the backups of --output-policy, newest first")
+
 	// Add commands
 	cliCmd.AddCommand(prepare)
+	cliCmd.AddCommand(rollback)
+	cliCmd.AddCommand(applyCmd)
 }
 
 // applyEnvDefault sets *target to the value of envName when the user did not
@@ -103,6 +356,115 @@ func applyEnvDefault(cmd *cobra.Command, flagName string, target *string, envNam
 	}
 }
 
+// applyEnvFlag sets --flagName from envName when the user did not pass it,
+// parsing the value like the flag itself, so a malformed value is an error
+// just like a malformed flag.
+func applyEnvFlag(cmd *cobra.Command, flagName, envName string) error {
+	if cmd.Flags().Changed(flagName) {
+		return nil
+	}
+	v := os.Getenv(envName)
+	if v == "" {
+		return nil
+	}
+	if err := cmd.Flags().Set(flagName, v); err != nil {
+		return fmt.Errorf("invalid value %q for env var %s (--%s): %w", v, envName, flagName, err)
+	}
+	return nil
+}
+
+// parseKeyValues splits repeatable "key=value" flag values into a map. Only
+// the first "=" separates key and value, so values (e.g. LDAP filters) may
+// contain "=" themselves.
+func parseKeyValues(flagName string, values []string) (map[string]string, error) {
+	out := make(map[string]string, len(values))
+	for _, kv := range values {
+		k, v, ok := strings.Cut(kv, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" || v == "" {
+			return nil, fmt.Errorf("--%s: expected key=value, got %q", flagName, kv)
+		}
+		if _, dup := out[k]; dup {
+			return nil, fmt.Errorf("--%s: duplicate key %q", flagName, k)
+		}
+		out[k] = v
+	}
+	return out, nil
+}
+
+// sourceUsernameTemplate returns the username template for the named source:
+// its entry in the source=template overrides, if any, else fallback. Override
+// keys may use any source alias.
+func sourceUsernameTemplate(source, fallback string, overrides []string) (string, error) {
+	tmpls, err := parseKeyValues("source-username-template", overrides)
+	if err != nil {
+		return "", err
+	}
+	for name, tmpl := range tmpls {
+		canonical := sources.CanonicalSourceName(name)
+		if canonical == "" {
+			return "", fmt.Errorf("--source-username-template: unknown source %q", name)
+		}
+		if canonical == sources.CanonicalSourceName(source) {
+			fallback = tmpl
+		}
+	}
+	return fallback, nil
+}
+
+// retryPolicy returns the retry policy from the flags.
+func retryPolicy() retry.Policy {
+	p := retry.Default()
+	p.MaxAttempts = retryAttempts
+	p.BaseDelay = retryBackoff
+	return p
+}
+
+// sourceOptions returns the retry, circuit breaker and cache options from the
+// flags.
+func sourceOptions() []sources.Option {
+	opts := []sources.Option{
+		sources.WithRetry(retryPolicy()),
+		sources.WithCircuitBreaker(breakerThreshold, breakerCooldown),
+	}
+	if cacheFile != "" {
+		opts = append(opts, sources.WithCache(sources.CacheConfig{
+			Path:     cacheFile,
+			TTL:      cacheTTL,
+			MaxStale: cacheMaxStale,
+			Offline:  offline,
+			Warn:     func(msg string) { logger.Warn(msg) },
+		}))
+	}
+	return opts
+}
+
+// runContext returns the context for a run: it is cancelled on SIGINT or
+// SIGTERM and, unless --timeout is 0, when the timeout expires.
+func runContext() (context.Context, context.CancelFunc) {
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	if timeout <= 0 {
+		return ctx, stopSignals
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stopSignals()
+	}
+}
+
+// envLines returns the non-empty lines of the named env var, for repeatable
+// flags. Empty/unset returns nil.
+func envLines(name string) []string {
+	var out []string
+	for _, line := range strings.Split(os.Getenv(name), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
 // envBool parses a bool from the named env var. Empty/unset returns false.
 func envBool(name string) bool {
 	v := os.Getenv(name)
@@ -137,18 +499,64 @@ var prepare = &cobra.Command{
 			<-done
 		}()
 
+		filterGroups, err := parseKeyValues("ldap-filter-group", ldapFilterGroups)
+		if err == nil && concurrency < 1 {
+			err = fmt.Errorf("--concurrency must be at least 1, got %d", concurrency)
+		}
+		if err == nil && (maxRemoved < 0 || maxRemovedPercent < 0) {
+			err = errors.New("--max-removed and --max-removed-percent must not be negative")
+		}
+		if err == nil && apply && dryRun {
+			err = errors.New("--apply and --dry-run exclude each other")
+		}
+		if err == nil && apply {
+			err = checkHeadscaleFlags()
+		}
+		if err == nil && diffFile != "" && !dryRun {
+			err = errors.New("--diff-file requires --dry-run")
+		}
+		if err == nil && offline && cacheFile == "" {
+			err = errors.New("--offline requires --cache-file")
+		}
+		if err == nil {
+			usernameTemplate, err = sourceUsernameTemplate(source, usernameTemplate, sourceUsernameTmpls)
+		}
+		if err == nil && ldapDefaultEmailDomain != "" {
+			err = identity.ValidateDomain(ldapDefaultEmailDomain)
+			if err != nil {
+				err = fmt.Errorf("--ldap-default-email-domain: %w", err)
+			}
+		}
+		if err != nil {
+			errorInfo := map[string]any{
+				"Error": err.Error(),
+			}
+			logger.Fatal("Flag error:", logger.ArgsFromMap(errorInfo))
+		}
+
 		// Make a new client
 		client, err := sources.NewSource(sources.SourceConfig{
-			Name:                   source,
-			Token:                  token,
-			Endpoint:               endpoint,
-			InsecureSkipTLSVerify:  insecureSkipTLSVerify,
-			LDAPBindPassword:       ldapBindPassword,
-			LDAPBindDN:             ldapBindDN,
-			LDAPBaseDN:             ldapBaseDN,
-			LDAPDefaultEmailDomain: ldapDefaultEmailDomain,
-			KeycloakRealm:          keycloakRealm,
-		})
+			Name:                     source,
+			Token:                    token,
+			Endpoint:                 endpoint,
+			InsecureSkipTLSVerify:    insecureSkipTLSVerify,
+			LDAPBindPassword:         ldapBindPassword,
+			LDAPBindDN:               ldapBindDN,
+			LDAPBaseDN:               ldapBaseDN,
+			LDAPDefaultEmailDomain:   ldapDefaultEmailDomain,
+			LDAPFilterGroups:         filterGroups,
+			JumpcloudRegion:          jumpcloudRegion,
+			JumpcloudRPS:             jumpcloudRPS,
+			JumpcloudNestedGroups:    jumpcloudNested,
+			AuthentikIncludeChildren: authentikChildren,
+			AuthentikPagedMembers:    authentikPagedMembers,
+			KeycloakRealm:            keycloakRealm,
+			KeycloakClientID:         keycloakClientID,
+			KeycloakClientSecret:     keycloakClientSecret,
+			KeycloakAuthRealm:        keycloakAuthRealm,
+			KeycloakIncludeSubgroups: keycloakSubgroups,
+			KeycloakMode:             keycloakMode,
+		}, sourceOptions()...)
 		if err != nil {
 			errorInfo := map[string]any{
 				"Error": err.Error(),
@@ -156,12 +564,154 @@ var prepare = &cobra.Command{
 			logger.Fatal("Source error:", logger.ArgsFromMap(errorInfo))
 		}
 
+		cached := client
+		var recorder *sources.Recorder
+		if recordSnapshot != "" {
+			recorder = sources.NewRecorder(client, source)
+			client = recorder
+		}
+
+		// Ctrl-C/SIGTERM and --timeout cancel requests in flight
+		ctx, stop := runContext()
+		defer stop()
+
 		// Obtain users from a remote source and fill policy
-		if err := preparePolicy(client, logCh); err != nil {
+		err = preparePolicy(ctx, client, logCh)
+		// Save what was fetched to the cache, also when the run failed.
+		if err := sources.Flush(cached); err != nil {
+			logger.Warn(err.Error())
+		}
+		if errors.Is(err, errPolicyChanged) {
+			exitCode = exitChanges
+			err = nil
+		}
+		if err != nil {
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("%w (--timeout %s)", err, timeout)
+			}
 			errorInfo := map[string]any{
 				"Error": err.Error(),
 			}
 			logger.Fatal("Prepare error:", logger.ArgsFromMap(errorInfo))
 		}
+
+		if recorder != nil {
+			if err := recorder.Snapshot().WriteFile(recordSnapshot); errors.Is(err, tools.ErrNotAtomic) {
+				logger.Warn(err.Error())
+			} else if err != nil {
+				errorInfo := map[string]any{
+					"Error": err.Error(),
+				}
+				logger.Fatal("Snapshot error:", logger.ArgsFromMap(errorInfo))
+			}
+			logCh <- fmt.Sprintf("Write snapshot to: %s", recordSnapshot)
+		}
+	},
+}
+
+// checkHeadscaleFlags reports missing Headscale API settings.
+func checkHeadscaleFlags() error {
+	if headscaleAddress == "" || headscaleAPIKey == "" {
+		return errors.New("applying the policy requires --headscale-address and --headscale-api-key")
+	}
+	return nil
+}
+
+// Apply
+var applyCmd = &cobra.Command{
+	Use:   "apply",
+	Short: "Push --output-policy to Headscale",
+	Long: `Push the policy in --output-policy to Headscale through its API, as prepare --apply does
+after writing it. Headscale checks the policy before loading it; if it rejects it, the reason is reported.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		logCh := make(chan string, 100)
+		done := make(chan struct{})
+		go func() {
+			for ls := range logCh {
+				logger.Info(ls)
+			}
+			close(done)
+		}()
+		defer func() {
+			close(logCh)
+			<-done
+		}()
+
+		if err := checkHeadscaleFlags(); err != nil {
+			errorInfo := map[string]any{
+				"Error": err.Error(),
+			}
+			logger.Fatal("Flag error:", logger.ArgsFromMap(errorInfo))
+		}
+
+		ctx, stop := runContext()
+		defer stop()
+
+		if err := applyPolicy(ctx, outputPolicyFile, logCh); err != nil {
+			errorInfo := map[string]any{
+				"Error": err.Error(),
+			}
+			logger.Fatal("Apply error:", logger.ArgsFromMap(errorInfo))
+		}
+	},
+}
+
+// Rollback
+var rollback = &cobra.Command{
+	Use:   "rollback [backup]",
+	Short: "Restore the output policy from a backup",
+	Long: `Restore --output-policy from the newest backup, or from the given backup file.
+The replaced policy is backed up first when --backups is set, so a rollback can be undone.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		list, err := backup.List(outputPolicyFile)
+		if err != nil {
+			errorInfo := map[string]any{
+				"Error": err.Error(),
+			}
+			logger.Fatal("Backup error:", logger.ArgsFromMap(errorInfo))
+		}
+
+		if listBackups {
+			for _, b := range list {
+				logger.Info(fmt.Sprintf("%s  %s", b.Time.Local().Format(time.DateTime), b.Path))
+			}
+			if len(list) == 0 {
+				logger.Info(fmt.Sprintf("No backups of %s", outputPolicyFile))
+			}
+			return
+		}
+
+		var from string
+		switch {
+		case len(args) == 1:
+			from = args[0]
+		case len(list) > 0:
+			from = list[0].Path
+		default:
+			errorInfo := map[string]any{
+				"Error": fmt.Sprintf("no backups of %s", outputPolicyFile),
+			}
+			logger.Fatal("Rollback error:", logger.ArgsFromMap(errorInfo))
+		}
+
+		// Don't put a file in place that Headscale can't load.
+		var p policy.Policy
+		if err := p.ReadPolicyFromFile(from); err != nil {
+			errorInfo := map[string]any{
+				"Error": fmt.Sprintf("%s is not a valid policy: %v", from, err),
+			}
+			logger.Fatal("Rollback error:", logger.ArgsFromMap(errorInfo))
+		}
+		if err := backup.Restore(outputPolicyFile, from, backups, time.Now()); errors.Is(err, tools.ErrNotAtomic) {
+			logger.Warn(fmt.Sprintf("%v; Headscale may have read a partial policy meanwhile", err))
+		} else if err != nil {
+			errorInfo := map[string]any{
+				"Error": err.Error(),
+			}
+			logger.Fatal("Rollback error:", logger.ArgsFromMap(errorInfo))
+		}
+		logger.Info(fmt.Sprintf("Restore %s from: %s", outputPolicyFile, from))
 	},
 }
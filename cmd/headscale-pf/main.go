@@ -1,5 +1,7 @@
 package main
 
+import "os"
+
 func main() {
 	if err := cliCmd.Execute(); err != nil {
 		errorInfo := map[string]any{
@@ -8,4 +10,7 @@ func main() {
 		}
 		logger.Fatal("Root error:", logger.ArgsFromMap(errorInfo))
 	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 }
@@ -1,24 +1,64 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/yousysadmin/headscale-pf/internal/backup"
+	"github.com/yousysadmin/headscale-pf/internal/identity"
+	"github.com/yousysadmin/headscale-pf/internal/membership"
 	"github.com/yousysadmin/headscale-pf/internal/models"
 	"github.com/yousysadmin/headscale-pf/internal/policy"
 	"github.com/yousysadmin/headscale-pf/internal/sources"
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
+
+	"github.com/pterm/pterm"
 )
 
-func preparePolicy(client sources.Source, logCh chan<- string) error {
+func preparePolicy(ctx context.Context, client sources.Source, logCh chan<- string) error {
 	hsPolicy := policy.Policy{}
 
-	// Reject an unknown output format before contacting the source.
+	// Reject an unknown output format or a broken username template before
+	// contacting the source.
 	if !policy.IsValidFormat(outputFormat) {
 		return fmt.Errorf("invalid output format %q: must be %q, %q, or %q", outputFormat, policy.FormatAuto, policy.FormatHJSON, policy.FormatJSON)
 	}
+	if err := setMergeStrategies(&hsPolicy); err != nil {
+		return err
+	}
+	if err := hsPolicy.SetMemberOrder(memberOrder); err != nil {
+		return err
+	}
+	hsPolicy.SetWrap(wrapMembers)
+	renderer, err := identity.NewRenderer(usernameTemplate)
+	if err != nil {
+		return err
+	}
+	var rewriter *identity.Rewriter
+	if aliasesFile != "" {
+		if rewriter, err = identity.LoadRewriter(aliasesFile); err != nil {
+			return err
+		}
+	}
+	var filter *membership.Filter
+	if membersFile != "" {
+		if filter, err = membership.Load(membersFile); err != nil {
+			return err
+		}
+	}
 
 	// Read policy template
 	logCh <- fmt.Sprintf("Read policy template from: %s", inputPolicyFile)
-	err := hsPolicy.ReadPolicyFromFile(inputPolicyFile)
+	err = hsPolicy.ReadPolicyFromFile(inputPolicyFile)
 	if err != nil {
 		return err
 	}
@@ -30,40 +70,46 @@ func preparePolicy(client sources.Source, logCh chan<- string) error {
 	}
 
 	// Get groups and group members
-	var groupsInfo []*models.Group
-	for _, g := range groups {
-		// Get group info
-		// If group doesn't find, returns nil
-		group, err := client.GetGroupByName(g)
-		if err != nil {
-			return err
-		}
-
-		// If a group is found in source, try to get a members
-		if group != nil {
-			// Sources may populate Users during GetGroupByName (one round-trip).
-			// A non-nil Users slice — even if empty — means "already loaded".
-			if group.Users == nil {
-				users, err := client.GetGroupMembers(group.ID)
-				if err != nil {
-					return err
-				}
-				group.Users = users
-			}
-			groupsInfo = append(groupsInfo, group)
-
-			logCh <- fmt.Sprintf("Collect %d members for group: %s", len(group.Users), g)
-		} else {
-			logCh <- fmt.Sprintf("Group '%s' not found", g)
-		}
+	groupsInfo, err := resolveGroups(ctx, client, groups, logCh)
+	if err != nil {
+		return err
 	}
 
 	// filling user groups
 	hsGroups := map[string][]string{}
 	for _, g := range groupsInfo {
-		var upg []string
+		var members []membership.Member
 		for _, u := range g.Users {
-			upg = append(upg, u.Username)
+			name, err := renderer.Render(u)
+			if rewriter != nil {
+				// An alias also covers users the template fails for.
+				if alias, ok := rewriter.Alias(u); ok {
+					name, err = alias, nil
+				} else if err == nil {
+					name, err = rewriter.Apply(u, name)
+				}
+			}
+			if err != nil {
+				logCh <- fmt.Sprintf("Skip user %s (%s) of group %s: %v", u.Username, u.ID, g.Name, err)
+				continue
+			}
+			members = append(members, membership.Member{User: u, Name: name})
+		}
+
+		var upg []string
+		if filter != nil {
+			var excluded, included []string
+			upg, excluded, included = filter.Apply(g.Name, members)
+			if len(excluded) > 0 {
+				logCh <- fmt.Sprintf("Exclude %d members of group %s: %s", len(excluded), g.Name, strings.Join(excluded, ", "))
+			}
+			if len(included) > 0 {
+				logCh <- fmt.Sprintf("Include %d users in group %s: %s", len(included), g.Name, strings.Join(included, ", "))
+			}
+		} else {
+			for _, m := range members {
+				upg = append(upg, m.Name)
+			}
 		}
 
 		// Add the prefix 'group' to a group name
@@ -71,18 +117,332 @@ func preparePolicy(client sources.Source, logCh chan<- string) error {
 
 		hsGroups[groupName] = upg
 	}
+	if filter != nil {
+		includeMissingGroups(&hsPolicy, filter, groups, hsGroups, logCh)
+	}
+	if rewriter != nil {
+		for _, hit := range rewriter.Report() {
+			logCh <- fmt.Sprintf("Rule %s changed %d users", hit.Rule, hit.Users)
+		}
+	}
 	hsPolicy.AppendGroups(hsGroups)
 
+	// Compare with the current output: a dry run shows the changes, a real
+	// run refuses to strip members en masse unless forced.
+	current, err := readCurrentGroups(logCh)
+	if dryRun {
+		if err != nil {
+			return err
+		}
+		return dryRunDiff(current, hsPolicy.Groups(), logCh)
+	}
+	// A current policy that can't be read is a reason for caution, not for
+	// skipping the checks.
+	switch {
+	case err != nil && force:
+		logCh <- fmt.Sprintf("Skip removal checks (--force): %v", err)
+	case err != nil:
+		return fmt.Errorf("%w; removal checks need it, pass --force to write anyway", err)
+	default:
+		if err := guardRemovals(current, hsPolicy.Groups(), logCh); err != nil {
+			return err
+		}
+	}
+
 	// Write a prepared policy on a file. Resolve auto → concrete now so the log
 	// reflects the format actually written.
 	format := hsPolicy.ResolveFormat(outputFormat)
-	logCh <- fmt.Sprintf("Write policy (%s) to: %s", format, outputPolicyFile)
-	err = hsPolicy.WritePolicyToFile(outputPolicyFile, format)
+	data, err := hsPolicy.Render(format)
 	if err != nil {
 		return err
 	}
+	// An identical file needs neither a backup nor a write; backups of
+	// unchanged runs would only push the useful ones out.
+	if old, err := os.ReadFile(outputPolicyFile); err == nil && bytes.Equal(old, data) {
+		logCh <- fmt.Sprintf("Policy unchanged, keep: %s", outputPolicyFile)
+	} else {
+		if name, err := backup.Create(outputPolicyFile, backups, time.Now()); err != nil {
+			return err
+		} else if name != "" {
+			logCh <- fmt.Sprintf("Back up current policy to: %s", name)
+		}
+		logCh <- fmt.Sprintf("Write policy (%s) to: %s", format, outputPolicyFile)
+		err = hsPolicy.WritePolicyToFile(outputPolicyFile, format)
+		if errors.Is(err, tools.ErrNotAtomic) {
+			logCh <- fmt.Sprintf("Warning: %v; Headscale may have read a partial policy meanwhile", err)
+		} else if err != nil {
+			return err
+		}
+	}
+
+	if apply {
+		if err := applyPolicy(ctx, outputPolicyFile, logCh); err != nil {
+			return err
+		}
+	}
 
 	logCh <- "Done"
 
 	return nil
 }
+
+// includeMissingGroups adds the include lists to the template groups the
+// source didn't return, so break-glass users are present whatever the source
+// says. Such a group keeps its template members.
+func includeMissingGroups(p *policy.Policy, filter *membership.Filter, names []string, hsGroups map[string][]string, logCh chan<- string) {
+	template := p.Groups()
+	for _, name := range names {
+		groupName := fmt.Sprintf("group:%s", name)
+		if _, ok := hsGroups[groupName]; ok {
+			continue
+		}
+		members := slices.Clone(template[groupName])
+		var included []string
+		_, _, include := filter.Apply(name, nil)
+		for _, u := range include {
+			if !slices.Contains(members, u) {
+				members = append(members, u)
+				included = append(included, u)
+			}
+		}
+		if len(included) == 0 {
+			continue
+		}
+		logCh <- fmt.Sprintf("Include %d users in group %s: %s", len(included), name, strings.Join(included, ", "))
+		hsGroups[groupName] = members
+	}
+}
+
+// errPolicyChanged is returned by a dry run that found changes.
+var errPolicyChanged = errors.New("policy would change")
+
+// dryRunDiff logs how the groups to write differ from the current ones, and
+// writes the changes to --diff-file, if set. It returns errPolicyChanged if
+// any group would change.
+func dryRunDiff(current, next map[string][]string, logCh chan<- string) error {
+	diffs := policy.DiffGroups(current, next)
+	logDiff(diffs, logCh)
+	if current != nil {
+		if err := policy.CheckRemovals(current, next, removalLimits()); err != nil {
+			logCh <- fmt.Sprintf("Without --force the policy would not be written: %v", err)
+		}
+	}
+
+	if diffFile != "" {
+		raw, err := json.MarshalIndent(struct {
+			Changed bool               `json:"changed"`
+			Groups  []policy.GroupDiff `json:"groups"`
+		}{len(diffs) > 0, diffs}, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(diffFile, append(raw, '\n'), 0o600); err != nil {
+			return fmt.Errorf("diff file: %w", err)
+		}
+		logCh <- fmt.Sprintf("Write diff to: %s", diffFile)
+	}
+
+	logCh <- fmt.Sprintf("Dry run: policy not written to %s", outputPolicyFile)
+	if len(diffs) > 0 {
+		return errPolicyChanged
+	}
+	return nil
+}
+
+// readCurrentGroups returns the groups of the current output policy, or nil
+// if there is none yet.
+func readCurrentGroups(logCh chan<- string) (map[string][]string, error) {
+	current, err := policy.ReadGroupsFromFile(outputPolicyFile)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		logCh <- fmt.Sprintf("No current policy at %s, all members are new", outputPolicyFile)
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("read current policy: %w", err)
+	}
+	return current, nil
+}
+
+// removalLimits returns the removal limits from the flags.
+func removalLimits() policy.RemovalLimits {
+	return policy.RemovalLimits{MaxRemoved: maxRemoved, MaxRemovedPercent: maxRemovedPercent}
+}
+
+// guardRemovals refuses a policy that removes more members than the flags
+// allow, unless --force is set. Without a current policy there is nothing to
+// compare against.
+func guardRemovals(current, next map[string][]string, logCh chan<- string) error {
+	if current == nil {
+		return nil
+	}
+	err := policy.CheckRemovals(current, next, removalLimits())
+	switch {
+	case err == nil:
+		return nil
+	case force:
+		logCh <- fmt.Sprintf("Write anyway (--force): %v", err)
+		return nil
+	}
+	return fmt.Errorf("%w; check the source, or pass --force to write anyway", err)
+}
+
+// logDiff logs the member changes of each group, added members in green and
+// removed ones in red.
+func logDiff(diffs []policy.GroupDiff, logCh chan<- string) {
+	if len(diffs) == 0 {
+		logCh <- "No changes"
+		return
+	}
+	for _, d := range diffs {
+		logCh <- fmt.Sprintf("%s: %d → %d members (+%d -%d)", d.Group, d.Before, d.After, len(d.Added), len(d.Removed))
+		for _, m := range d.Added {
+			logCh <- pterm.Green("  + " + m)
+		}
+		for _, m := range d.Removed {
+			logCh <- pterm.Red("  - " + m)
+		}
+	}
+}
+
+// setMergeStrategies applies --merge and --group-merge to p. Group names may
+// be given with or without the "group:" prefix.
+func setMergeStrategies(p *policy.Policy) error {
+	perGroup, err := parseKeyValues("group-merge", groupMerges)
+	if err != nil {
+		return err
+	}
+	full := make(map[string]string, len(perGroup))
+	for name, strategy := range perGroup {
+		full["group:"+strings.TrimPrefix(name, "group:")] = strategy
+	}
+	return p.SetMerge(mergeStrategy, full)
+}
+
+// groupResult is the outcome of resolving one template group.
+type groupResult struct {
+	index int
+	group *models.Group // nil if the group isn't in the source
+	logs  []string
+	err   error
+}
+
+// resolveGroups looks up the named groups and their members with up to
+// --concurrency requests in flight. Results and log lines come out in template
+// order regardless of which lookup finishes first. A failing group doesn't
+// stop the others; all failures are returned together.
+func resolveGroups(ctx context.Context, client sources.Source, names []string, logCh chan<- string) ([]*models.Group, error) {
+	jobs := make(chan int)
+	results := make(chan groupResult)
+
+	var wg sync.WaitGroup
+	for range min(max(concurrency, 1), len(names)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				res := resolveGroup(ctx, client, names[i])
+				res.index = i
+				results <- res
+			}
+		}()
+	}
+	go func() {
+		defer close(results)
+	feed:
+		for i := range names {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(jobs)
+		wg.Wait()
+	}()
+
+	// Hold back results that finish early until all previous groups are in.
+	pending := make([]*groupResult, len(names))
+	var groupsInfo []*models.Group
+	var errs []error
+	next := 0
+	for res := range results {
+		pending[res.index] = &res
+		for ; next < len(pending) && pending[next] != nil; next++ {
+			r := pending[next]
+			for _, l := range r.logs {
+				logCh <- l
+			}
+			switch {
+			case r.err != nil:
+				errs = append(errs, fmt.Errorf("group %s: %w", names[next], r.err))
+			case r.group != nil:
+				groupsInfo = append(groupsInfo, r.group)
+			}
+		}
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return groupsInfo, nil
+}
+
+// resolveGroup fetches a single group and its active members.
+func resolveGroup(ctx context.Context, client sources.Source, name string) groupResult {
+	var res groupResult
+	if err := ctx.Err(); err != nil {
+		res.err = err
+		return res
+	}
+
+	// Get group info
+	// If group doesn't find, returns nil
+	group, err := client.GetGroupByName(ctx, name)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	if group == nil {
+		res.logs = append(res.logs, fmt.Sprintf("Group '%s' not found", name))
+		return res
+	}
+
+	// Sources may populate Users during GetGroupByName (one round-trip).
+	// A non-nil Users slice — even if empty — means "already loaded".
+	if group.Users == nil {
+		users, err := client.GetGroupMembers(ctx, group.ID)
+		if err != nil {
+			res.err = err
+			return res
+		}
+		group.Users = users
+	}
+
+	// Suspended, locked or disabled accounts get no access unless
+	// explicitly requested.
+	if !includeInactive {
+		var skipped int
+		group.Users, skipped = activeUsers(group.Users)
+		if skipped > 0 {
+			res.logs = append(res.logs, fmt.Sprintf("Skip %d inactive members of group: %s", skipped, name))
+		}
+	}
+	res.group = group
+	res.logs = append(res.logs, fmt.Sprintf("Collect %d members for group: %s", len(group.Users), name))
+	return res
+}
+
+// activeUsers returns the active users and how many were dropped. The result
+// is never nil, so an empty group still serializes as [].
+func activeUsers(users []models.User) ([]models.User, int) {
+	active := make([]models.User, 0, len(users))
+	for _, u := range users {
+		if u.Active() {
+			active = append(active, u)
+		}
+	}
+	return active, len(users) - len(active)
+}
@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/tailscale/hujson"
+	"github.com/yousysadmin/headscale-pf/internal/backup"
 	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/policy"
 	"github.com/yousysadmin/headscale-pf/internal/sources"
+
+	"github.com/spf13/cobra"
 )
 
 // standardizeJSON strips comments/trailing commas from HuJSON output so it can
@@ -34,14 +47,14 @@ type stubSource struct {
 	groups map[string]*models.Group
 }
 
-func (s *stubSource) GetGroupByName(name string) (*models.Group, error) {
+func (s *stubSource) GetGroupByName(_ context.Context, name string) (*models.Group, error) {
 	if g, ok := s.groups[name]; ok {
 		return g, nil
 	}
 	return nil, nil
 }
 
-func (s *stubSource) GetGroupMembers(groupID string) ([]models.User, error) {
+func (s *stubSource) GetGroupMembers(_ context.Context, groupID string) ([]models.User, error) {
 	for _, g := range s.groups {
 		if g != nil && g.ID == groupID {
 			return g.Users, nil
@@ -140,7 +153,7 @@ func TestPreparePolicy_EndToEnd(t *testing.T) {
 		close(done)
 	}()
 
-	if err := preparePolicy(stub, logCh); err != nil {
+	if err := preparePolicy(t.Context(), stub, logCh); err != nil {
 		t.Fatalf("preparePolicy: %v", err)
 	}
 	close(logCh)
@@ -241,8 +254,22 @@ func TestFlagDefaultsDoNotLeakEnvSecrets(t *testing.T) {
 		"ldap-base-dn",
 		"endpoint",
 		"source",
+		"jumpcloud-region",
 		"keycloak-realm",
+		"keycloak-client-id",
+		"keycloak-client-secret",
+		"keycloak-auth-realm",
+		"keycloak-mode",
 		"ldap-default-email-domain",
+		"cache-file",
+		"record-snapshot",
+		"username-template",
+		"aliases-file",
+		"members-file",
+		"merge",
+		"headscale-address",
+		"headscale-api-key",
+		"headscale-ca-file",
 	} {
 		f := cliCmd.PersistentFlags().Lookup(name)
 		if f == nil {
@@ -256,6 +283,33 @@ func TestFlagDefaultsDoNotLeakEnvSecrets(t *testing.T) {
 	}
 }
 
+func TestApplyEnvFlag(t *testing.T) {
+	var d time.Duration
+	cmd := &cobra.Command{}
+	cmd.Flags().DurationVar(&d, "timeout", time.Minute, "")
+
+	t.Setenv("PF_TIMEOUT", "90s")
+	if err := applyEnvFlag(cmd, "timeout", "PF_TIMEOUT"); err != nil || d != 90*time.Second {
+		t.Errorf("PF_TIMEOUT=90s: timeout = %v, err = %v", d, err)
+	}
+
+	cmd = &cobra.Command{}
+	cmd.Flags().DurationVar(&d, "timeout", time.Minute, "")
+	t.Setenv("PF_TIMEOUT", "10 minutes")
+	if err := applyEnvFlag(cmd, "timeout", "PF_TIMEOUT"); err == nil || !strings.Contains(err.Error(), "PF_TIMEOUT") {
+		t.Errorf("a malformed PF_TIMEOUT must be an error, got %v", err)
+	}
+
+	cmd = &cobra.Command{}
+	cmd.Flags().DurationVar(&d, "timeout", time.Minute, "")
+	if err := cmd.Flags().Parse([]string{"--timeout=5s"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyEnvFlag(cmd, "timeout", "PF_TIMEOUT"); err != nil || d != 5*time.Second {
+		t.Errorf("the flag must win over the env var: timeout = %v, err = %v", d, err)
+	}
+}
+
 // TestPreparePolicy_NoGroupsInTemplate guards the early-out path: if the
 // HJSON template defines no group: prefixed keys, preparePolicy must error
 // rather than silently writing an empty policy.
@@ -278,8 +332,760 @@ func TestPreparePolicy_NoGroupsInTemplate(t *testing.T) {
 	}()
 	defer close(logCh)
 
-	err := preparePolicy(&stubSource{}, logCh)
+	err := preparePolicy(t.Context(), &stubSource{}, logCh)
 	if err == nil {
 		t.Fatalf("expected error when template has no groups")
 	}
 }
+
+// A cancelled context stops the run before the source is queried and before
+// anything is written.
+func TestPreparePolicy_Cancelled(t *testing.T) {
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "out.hjson")
+	if err := os.WriteFile(in, []byte(`{"groups": {"group:eng": []}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	prevIn, prevOut := inputPolicyFile, outputPolicyFile
+	inputPolicyFile, outputPolicyFile = in, out
+	t.Cleanup(func() { inputPolicyFile, outputPolicyFile = prevIn, prevOut })
+
+	logCh := make(chan string, 4)
+	go func() {
+		for range logCh {
+		}
+	}()
+	defer close(logCh)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	stub := &stubSource{groups: map[string]*models.Group{"eng": {ID: "1", Name: "eng"}}}
+	err := preparePolicy(ctx, stub, logCh)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output policy must not be written after cancellation")
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	got, err := parseKeyValues("ldap-filter-group", []string{
+		"berlin-office=(&(objectClass=person)(l=Berlin))",
+		" sre =(memberOf=cn=sre,ou=groups,dc=example,dc=com)",
+	})
+	if err != nil {
+		t.Fatalf("parseKeyValues: %v", err)
+	}
+	if got["berlin-office"] != "(&(objectClass=person)(l=Berlin))" {
+		t.Errorf("value must keep everything after the first '=': %q", got["berlin-office"])
+	}
+	if got["sre"] != "(memberOf=cn=sre,ou=groups,dc=example,dc=com)" {
+		t.Errorf("key must be trimmed: %v", got)
+	}
+
+	for _, bad := range [][]string{{"no-separator"}, {"=value"}, {"key="}, {"a=1", "a=2"}} {
+		if _, err := parseKeyValues("x", bad); err == nil {
+			t.Errorf("expected an error for %q", bad)
+		}
+	}
+}
+
+// runPreparePolicy runs preparePolicy against src with an HJSON template and
+// returns the written groups and the log lines.
+func runPreparePolicy(t *testing.T, template string, src sources.Source) (map[string][]string, []string) {
+	t.Helper()
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "current.hjson")
+	if err := os.WriteFile(in, []byte(template), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+
+	prevIn, prevOut, prevFmt := inputPolicyFile, outputPolicyFile, outputFormat
+	inputPolicyFile, outputPolicyFile, outputFormat = in, out, "hjson"
+	t.Cleanup(func() { inputPolicyFile, outputPolicyFile, outputFormat = prevIn, prevOut, prevFmt })
+
+	logCh := make(chan string, 16)
+	var logs []string
+	done := make(chan struct{})
+	go func() {
+		for l := range logCh {
+			logs = append(logs, l)
+		}
+		close(done)
+	}()
+
+	err := preparePolicy(t.Context(), src, logCh)
+	close(logCh)
+	<-done
+	if err != nil {
+		t.Fatalf("preparePolicy: %v", err)
+	}
+
+	raw, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	var got struct {
+		Groups map[string][]string `json:"groups"`
+	}
+	if err := json.Unmarshal(standardizeJSON(t, raw), &got); err != nil {
+		t.Fatalf("unmarshal output: %v", err)
+	}
+	return got.Groups, logs
+}
+
+func TestPreparePolicy_SkipsInactiveUsers(t *testing.T) {
+	// preparePolicy updates the returned groups in place, so each run gets
+	// a fresh source.
+	newStub := func() *stubSource {
+		return &stubSource{groups: map[string]*models.Group{
+			"vpn": {ID: "g1", Name: "vpn", Users: []models.User{
+				{ID: "u1", Username: "alice@", Status: models.UserStatusActive},
+				{ID: "u2", Username: "bob@", Status: models.UserStatusSuspended},
+				{ID: "u3", Username: "carol@"}, // status unknown counts as active
+				{ID: "u4", Username: "dave@", Status: models.UserStatusDisabled},
+			}},
+			"gone": {ID: "g2", Name: "gone", Users: []models.User{
+				{ID: "u5", Username: "erin@", Status: models.UserStatusLocked},
+			}},
+		}}
+	}
+	template := `{"groups": {"group:vpn": [], "group:gone": ["stale@"]}}`
+
+	groups, logs := runPreparePolicy(t, template, newStub())
+	if got := strings.Join(groups["group:vpn"], ","); got != "alice@,carol@" {
+		t.Errorf("group:vpn = %s, want only active users", got)
+	}
+	if v, ok := groups["group:gone"]; !ok || v == nil || len(v) != 0 {
+		t.Errorf("group with only inactive users must be [], got %#v", v)
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "Skip 2 inactive members of group: vpn") {
+		t.Errorf("skipped members must be logged, got %v", logs)
+	}
+
+	prev := includeInactive
+	includeInactive = true
+	t.Cleanup(func() { includeInactive = prev })
+	groups, _ = runPreparePolicy(t, template, newStub())
+	if len(groups["group:vpn"]) != 4 || len(groups["group:gone"]) != 1 {
+		t.Errorf("--include-inactive must keep everyone, got %v", groups)
+	}
+}
+
+// slowSource answers after a per-group delay and records how many lookups
+// ran at the same time.
+type slowSource struct {
+	delay map[string]time.Duration
+	fail  map[string]bool
+
+	mu        sync.Mutex
+	inFlight  int
+	maxFlight int
+	looked    []string
+}
+
+func (s *slowSource) GetGroupByName(ctx context.Context, name string) (*models.Group, error) {
+	s.mu.Lock()
+	s.inFlight++
+	s.maxFlight = max(s.maxFlight, s.inFlight)
+	s.looked = append(s.looked, name)
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	select {
+	case <-time.After(s.delay[name]):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if s.fail[name] {
+		return nil, fmt.Errorf("lookup of %s failed", name)
+	}
+	if name == "missing" {
+		return nil, nil
+	}
+	return &models.Group{ID: name, Name: name, Users: []models.User{{ID: name, Username: name + "@"}}}, nil
+}
+
+func (s *slowSource) GetGroupMembers(_ context.Context, _ string) ([]models.User, error) {
+	return []models.User{}, nil
+}
+
+func TestPreparePolicy_ConcurrentKeepsTemplateOrder(t *testing.T) {
+	prev := concurrency
+	concurrency = 3
+	t.Cleanup(func() { concurrency = prev })
+
+	// The first groups are the slowest, so they finish last.
+	src := &slowSource{delay: map[string]time.Duration{
+		"a": 60 * time.Millisecond,
+		"b": 40 * time.Millisecond,
+		"c": 20 * time.Millisecond,
+	}}
+	template := `{"groups": {"group:a": [], "group:b": [], "group:c": [], "group:missing": [], "group:d": [], "group:e": []}}`
+
+	groups, logs := runPreparePolicy(t, template, src)
+	for _, g := range []string{"a", "b", "c", "d", "e"} {
+		if got := strings.Join(groups["group:"+g], ","); got != g+"@" {
+			t.Errorf("group:%s = %q, want %s@", g, got, g)
+		}
+	}
+	if src.maxFlight < 2 || src.maxFlight > 3 {
+		t.Errorf("expected 2..3 lookups in flight, got %d", src.maxFlight)
+	}
+
+	var groupLogs []string
+	for _, l := range logs {
+		if strings.HasPrefix(l, "Collect") || strings.HasPrefix(l, "Group ") {
+			groupLogs = append(groupLogs, l)
+		}
+	}
+	want := []string{
+		"Collect 1 members for group: a",
+		"Collect 1 members for group: b",
+		"Collect 1 members for group: c",
+		"Group 'missing' not found",
+		"Collect 1 members for group: d",
+		"Collect 1 members for group: e",
+	}
+	if strings.Join(groupLogs, "\n") != strings.Join(want, "\n") {
+		t.Errorf("log lines must follow template order:\ngot  %q\nwant %q", groupLogs, want)
+	}
+}
+
+func TestPreparePolicy_AggregatesGroupErrors(t *testing.T) {
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "out.hjson")
+	template := `{"groups": {"group:a": [], "group:b": [], "group:c": [], "group:d": []}}`
+	if err := os.WriteFile(in, []byte(template), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	prevIn, prevOut, prevConc := inputPolicyFile, outputPolicyFile, concurrency
+	inputPolicyFile, outputPolicyFile, concurrency = in, out, 2
+	t.Cleanup(func() { inputPolicyFile, outputPolicyFile, concurrency = prevIn, prevOut, prevConc })
+
+	logCh := make(chan string, 16)
+	go func() {
+		for range logCh {
+		}
+	}()
+	defer close(logCh)
+
+	src := &slowSource{fail: map[string]bool{"a": true, "c": true}}
+	err := preparePolicy(t.Context(), src, logCh)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	for _, want := range []string{"group a: lookup of a failed", "group c: lookup of c failed"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error must contain %q, got %q", want, err)
+		}
+	}
+	if len(src.looked) != 4 {
+		t.Errorf("a failing group must not stop the others, looked up %v", src.looked)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Errorf("output policy must not be written when a group fails")
+	}
+}
+
+// A snapshot recorded during a run replays to the same policy.
+func TestPreparePolicy_SnapshotReplay(t *testing.T) {
+	template := `{"groups": {"group:eng": [], "group:ghost": ["keep@"]}}`
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{
+			{ID: "u1", Username: "alice@"},
+			{ID: "u2", Username: "bob@", Status: models.UserStatusSuspended},
+		}},
+	}}
+
+	rec := sources.NewRecorder(stub, "kk")
+	recorded, _ := runPreparePolicy(t, template, rec)
+
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := rec.Snapshot().WriteFile(path); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	replay, err := sources.NewSource(sources.SourceConfig{Name: "snapshot", Endpoint: path})
+	if err != nil {
+		t.Fatalf("NewSource: %v", err)
+	}
+	replayed, _ := runPreparePolicy(t, template, replay)
+
+	if !reflect.DeepEqual(recorded, replayed) {
+		t.Errorf("replay differs from the recorded run:\nrecorded %v\nreplayed %v", recorded, replayed)
+	}
+	if got := strings.Join(replayed["group:eng"], ","); got != "alice@" {
+		t.Errorf("group:eng = %s, want alice@ (inactive users still filtered on replay)", got)
+	}
+}
+
+func TestPreparePolicy_UsernameTemplate(t *testing.T) {
+	prev := usernameTemplate
+	usernameTemplate = "{{.Email}}"
+	t.Cleanup(func() { usernameTemplate = prev })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{
+			{ID: "u1", Username: "alice", Email: "alice@example.com"},
+			{ID: "u2", Username: "bob"}, // no email: not a valid Headscale user
+		}},
+	}}
+	groups, logs := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if got := strings.Join(groups["group:eng"], ","); got != "alice@example.com" {
+		t.Errorf("group:eng = %s, want alice@example.com", got)
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "Skip user bob (u2) of group eng") {
+		t.Errorf("users rendering to an invalid name must be logged, got %v", logs)
+	}
+}
+
+func TestSourceUsernameTemplate(t *testing.T) {
+	overrides := []string{"kk={{.Email}}", "jumpcloud={{lower .Username}}@"}
+
+	got, err := sourceUsernameTemplate("keycloak", "{{.Username}}@", overrides)
+	if err != nil || got != "{{.Email}}" {
+		t.Errorf("keycloak template = %q, %v; want the kk override", got, err)
+	}
+	got, err = sourceUsernameTemplate("jc", "", overrides)
+	if err != nil || got != "{{lower .Username}}@" {
+		t.Errorf("jc template = %q, %v; want the jumpcloud override", got, err)
+	}
+	got, err = sourceUsernameTemplate("ldap", "{{.Username}}@", overrides)
+	if err != nil || got != "{{.Username}}@" {
+		t.Errorf("ldap template = %q, %v; want the fallback", got, err)
+	}
+	if _, err := sourceUsernameTemplate("ldap", "", []string{"okta={{.Email}}"}); err == nil {
+		t.Errorf("an override for an unknown source must be rejected")
+	}
+}
+
+func TestEnvLines(t *testing.T) {
+	t.Setenv("PF_SOURCE_USERNAME_TEMPLATE", "kk={{.Email}}\n\n  ldap={{.Username}}@  \n")
+	got := envLines("PF_SOURCE_USERNAME_TEMPLATE")
+	if want := []string{"kk={{.Email}}", "ldap={{.Username}}@"}; !slices.Equal(got, want) {
+		t.Errorf("envLines = %q, want %q", got, want)
+	}
+	t.Setenv("PF_SOURCE_USERNAME_TEMPLATE", "")
+	if got := envLines("PF_SOURCE_USERNAME_TEMPLATE"); got != nil {
+		t.Errorf("unset env var must give nil, got %q", got)
+	}
+}
+
+func TestPreparePolicy_AliasesFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.hujson")
+	if err := os.WriteFile(path, []byte(`{"aliases": {"u2": "robert@"}, "lowercase": true}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	prev := aliasesFile
+	aliasesFile = path
+	t.Cleanup(func() { aliasesFile = prev })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{
+			{ID: "u1", Username: "Alice"},
+			{ID: "u2", Username: "bob"},
+		}},
+	}}
+	groups, logs := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if got := strings.Join(groups["group:eng"], ","); got != "alice@,robert@" {
+		t.Errorf("group:eng = %s, want alice@,robert@", got)
+	}
+	all := strings.Join(logs, "\n")
+	for _, want := range []string{"Rule alias u2 → robert@ changed 1 users", "Rule lowercase changed 1 users"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("missing report line %q in %v", want, logs)
+		}
+	}
+}
+
+func TestPreparePolicy_AliasForUnrenderableUser(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aliases.hujson")
+	if err := os.WriteFile(path, []byte(`{"aliases": {"u2": "bob@example.com"}}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	prevAliases, prevTmpl := aliasesFile, usernameTemplate
+	aliasesFile, usernameTemplate = path, "{{.Email}}"
+	t.Cleanup(func() { aliasesFile, usernameTemplate = prevAliases, prevTmpl })
+
+	// Neither user has an email, so the template fails for both; only bob
+	// has an alias.
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{
+			{ID: "u1", Username: "alice"},
+			{ID: "u2", Username: "bob"},
+		}},
+	}}
+	groups, logs := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if got := strings.Join(groups["group:eng"], ","); got != "bob@example.com" {
+		t.Errorf("group:eng = %s, want bob@example.com", got)
+	}
+	all := strings.Join(logs, "\n")
+	if !strings.Contains(all, "Skip user alice (u1)") || strings.Contains(all, "Skip user bob") {
+		t.Errorf("want only alice skipped, logs %v", logs)
+	}
+}
+
+func TestPreparePolicy_MembersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.hujson")
+	content := `{"exclude": ["svc-*"], "groups": {"eng": {"include": ["oncall@"]}}}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	prev := membersFile
+	membersFile = path
+	t.Cleanup(func() { membersFile = prev })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{
+			{ID: "u1", Username: "alice"},
+			{ID: "u2", Username: "svc-ci"},
+		}},
+	}}
+	groups, logs := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if got := strings.Join(groups["group:eng"], ","); got != "alice@,oncall@" {
+		t.Errorf("group:eng = %s, want alice@,oncall@", got)
+	}
+	all := strings.Join(logs, "\n")
+	for _, want := range []string{"Exclude 1 members of group eng: svc-ci@", "Include 1 users in group eng: oncall@"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("missing log line %q in %v", want, logs)
+		}
+	}
+}
+
+func TestPreparePolicy_MembersFileGroupNotInSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "members.hujson")
+	content := `{"groups": {"admins": {"include": ["breakglass@"]}}}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	prev := membersFile
+	membersFile = path
+	t.Cleanup(func() { membersFile = prev })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}}},
+	}}
+	groups, logs := runPreparePolicy(t, `{"groups": {"group:eng": [], "group:admins": ["root@"], "group:ops": ["ops@"]}}`, stub)
+	if got := strings.Join(groups["group:admins"], ","); got != "breakglass@,root@" {
+		t.Errorf("group:admins = %s, want breakglass@,root@", got)
+	}
+	if got := strings.Join(groups["group:ops"], ","); got != "ops@" {
+		t.Errorf("group:ops = %s, want the template members", got)
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "Include 1 users in group admins: breakglass@") {
+		t.Errorf("missing include log line in %v", logs)
+	}
+}
+
+func TestPreparePolicy_GroupMerge(t *testing.T) {
+	prevMerge, prevGroups := mergeStrategy, groupMerges
+	mergeStrategy, groupMerges = policy.MergeUnion, []string{"admins=pinned"}
+	t.Cleanup(func() { mergeStrategy, groupMerges = prevMerge, prevGroups })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng":    {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}}},
+		"admins": {ID: "g2", Name: "admins", Users: []models.User{{ID: "u2", Username: "bob"}}},
+	}}
+	groups, _ := runPreparePolicy(t, `{"groups": {
+		"group:eng": ["contractor@"],
+		"group:admins": [
+			"root@", // pin
+			"former@",
+		],
+	}}`, stub)
+	if got := strings.Join(groups["group:eng"], ","); got != "contractor@,alice@" {
+		t.Errorf("group:eng = %s, want contractor@,alice@", got)
+	}
+	if got := strings.Join(groups["group:admins"], ","); got != "root@,bob@" {
+		t.Errorf("group:admins = %s, want root@,bob@", got)
+	}
+}
+
+func TestPreparePolicy_MemberOrder(t *testing.T) {
+	prev := memberOrder
+	memberOrder = "alphabetical"
+	t.Cleanup(func() { memberOrder = prev })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{
+			{ID: "u3", Username: "carol"},
+			{ID: "u1", Username: "alice"},
+			{ID: "u3", Username: "carol"}, // reached through two subgroups
+			{ID: "u2", Username: "Bob"},
+		}},
+	}}
+	groups, _ := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if got := strings.Join(groups["group:eng"], ","); got != "alice@,Bob@,carol@" {
+		t.Errorf("group:eng = %s, want alice@,Bob@,carol@", got)
+	}
+}
+
+func TestPreparePolicy_DryRun(t *testing.T) {
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "current.hjson")
+	diff := filepath.Join(tmp, "diff.json")
+	current := `{"groups": {"group:eng": ["alice@", "bob@"]}}`
+	if err := os.WriteFile(in, []byte(`{"groups": {"group:eng": []}}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if err := os.WriteFile(out, []byte(current), 0o600); err != nil {
+		t.Fatalf("write output: %v", err)
+	}
+	prevIn, prevOut, prevDry, prevDiff := inputPolicyFile, outputPolicyFile, dryRun, diffFile
+	inputPolicyFile, outputPolicyFile, dryRun, diffFile = in, out, true, diff
+	t.Cleanup(func() { inputPolicyFile, outputPolicyFile, dryRun, diffFile = prevIn, prevOut, prevDry, prevDiff })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}, {ID: "u3", Username: "carol"}}},
+	}}
+	logCh := make(chan string, 32)
+	err := preparePolicy(t.Context(), stub, logCh)
+	close(logCh)
+	if !errors.Is(err, errPolicyChanged) {
+		t.Fatalf("err = %v, want errPolicyChanged", err)
+	}
+
+	var logs []string
+	for l := range logCh {
+		logs = append(logs, l)
+	}
+	all := strings.Join(logs, "\n")
+	for _, want := range []string{"group:eng: 2 → 2 members (+1 -1)", "+ carol@", "- bob@"} {
+		if !strings.Contains(all, want) {
+			t.Errorf("missing diff line %q in %v", want, logs)
+		}
+	}
+	if raw, _ := os.ReadFile(out); string(raw) != current {
+		t.Errorf("dry run must not write the output policy, got %s", raw)
+	}
+
+	raw, err := os.ReadFile(diff)
+	if err != nil {
+		t.Fatalf("read diff file: %v", err)
+	}
+	var got struct {
+		Changed bool `json:"changed"`
+		Groups  []struct {
+			Group   string   `json:"group"`
+			Added   []string `json:"added"`
+			Removed []string `json:"removed"`
+		} `json:"groups"`
+	}
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatalf("unmarshal diff: %v", err)
+	}
+	if !got.Changed || len(got.Groups) != 1 || got.Groups[0].Added[0] != "carol@" || got.Groups[0].Removed[0] != "bob@" {
+		t.Errorf("diff file = %s", raw)
+	}
+}
+
+func TestPreparePolicy_RemovalGuard(t *testing.T) {
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "current.hjson")
+	current := `{"groups": {"group:eng": ["alice@", "bob@", "carol@"]}}`
+	if err := os.WriteFile(in, []byte(`{"groups": {"group:eng": []}}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if err := os.WriteFile(out, []byte(current), 0o600); err != nil {
+		t.Fatalf("write output: %v", err)
+	}
+	prevIn, prevOut, prevPct, prevForce := inputPolicyFile, outputPolicyFile, maxRemovedPercent, force
+	inputPolicyFile, outputPolicyFile, maxRemovedPercent = in, out, 50
+	t.Cleanup(func() {
+		inputPolicyFile, outputPolicyFile, maxRemovedPercent, force = prevIn, prevOut, prevPct, prevForce
+	})
+
+	// A source returning only one of three members looks like an outage.
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}}},
+	}}
+	logCh := make(chan string, 32)
+	err := preparePolicy(t.Context(), stub, logCh)
+	if !errors.Is(err, policy.ErrUnsafeRemoval) {
+		t.Fatalf("err = %v, want policy.ErrUnsafeRemoval", err)
+	}
+	if raw, _ := os.ReadFile(out); string(raw) != current {
+		t.Errorf("a refused policy must not be written, got %s", raw)
+	}
+
+	force = true
+	if err := preparePolicy(t.Context(), stub, logCh); err != nil {
+		t.Fatalf("with --force: %v", err)
+	}
+	close(logCh)
+	var forced bool
+	for l := range logCh {
+		forced = forced || strings.Contains(l, "Write anyway (--force)")
+	}
+	if !forced {
+		t.Errorf("a forced write must be logged")
+	}
+	if raw, _ := os.ReadFile(out); string(raw) == current {
+		t.Errorf("with --force the policy must be written")
+	}
+}
+
+func TestPreparePolicy_Backups(t *testing.T) {
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "current.hjson")
+	if err := os.WriteFile(in, []byte(`{"groups": {"group:eng": []}}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if err := os.WriteFile(out, []byte(`{"groups": {"group:eng": ["alice@"]}}`), 0o600); err != nil {
+		t.Fatalf("write output: %v", err)
+	}
+	prevIn, prevOut, prevBackups := inputPolicyFile, outputPolicyFile, backups
+	inputPolicyFile, outputPolicyFile, backups = in, out, 3
+	t.Cleanup(func() { inputPolicyFile, outputPolicyFile, backups = prevIn, prevOut, prevBackups })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}, {ID: "u2", Username: "bob"}}},
+	}}
+	logCh := make(chan string, 32)
+	if err := preparePolicy(t.Context(), stub, logCh); err != nil {
+		t.Fatalf("preparePolicy: %v", err)
+	}
+	close(logCh)
+
+	list, err := backup.List(out)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("backups = %v, %v; want one", list, err)
+	}
+	if raw, _ := os.ReadFile(list[0].Path); string(raw) != `{"groups": {"group:eng": ["alice@"]}}` {
+		t.Errorf("backup holds %s, want the previous policy", raw)
+	}
+
+	// An unchanged policy is neither backed up nor rewritten.
+	logCh = make(chan string, 32)
+	if err := preparePolicy(t.Context(), stub, logCh); err != nil {
+		t.Fatalf("second preparePolicy: %v", err)
+	}
+	close(logCh)
+	var logs []string
+	for l := range logCh {
+		logs = append(logs, l)
+	}
+	if list, _ := backup.List(out); len(list) != 1 {
+		t.Errorf("an unchanged run must not add a backup, got %d", len(list))
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "Policy unchanged") {
+		t.Errorf("missing unchanged log line in %v", logs)
+	}
+}
+
+func TestPreparePolicy_UnreadableCurrentPolicy(t *testing.T) {
+	tmp := t.TempDir()
+	in := filepath.Join(tmp, "policy.hjson")
+	out := filepath.Join(tmp, "current.hjson")
+	if err := os.WriteFile(in, []byte(`{"groups": {"group:eng": []}}`), 0o600); err != nil {
+		t.Fatalf("write template: %v", err)
+	}
+	if err := os.WriteFile(out, []byte(`{"groups": {"group:eng": [`), 0o600); err != nil {
+		t.Fatalf("write output: %v", err)
+	}
+	prevIn, prevOut, prevForce := inputPolicyFile, outputPolicyFile, force
+	inputPolicyFile, outputPolicyFile = in, out
+	t.Cleanup(func() { inputPolicyFile, outputPolicyFile, force = prevIn, prevOut, prevForce })
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}}},
+	}}
+	run := func() error {
+		logCh := make(chan string, 32)
+		defer close(logCh)
+		return preparePolicy(t.Context(), stub, logCh)
+	}
+
+	force = false
+	if err := run(); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("a corrupt current policy must stop the write, got %v", err)
+	}
+	if raw, _ := os.ReadFile(out); string(raw) != `{"groups": {"group:eng": [` {
+		t.Errorf("the current policy must be left alone, got %s", raw)
+	}
+
+	force = true
+	if err := run(); err != nil {
+		t.Fatalf("with --force: %v", err)
+	}
+	if raw, _ := os.ReadFile(out); !strings.Contains(string(raw), "alice@") {
+		t.Errorf("with --force the policy must be written, got %s", raw)
+	}
+}
+
+// fakeHeadscale starts a Headscale API server holding the live policy and
+// points the --apply flags at it. It returns the pushed policies.
+func fakeHeadscale(t *testing.T, live string) *[]string {
+	t.Helper()
+	var pushed []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/policy" || r.Header.Get("Authorization") != "Bearer key" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut {
+			var body struct {
+				Policy string `json:"policy"`
+			}
+			_ = json.NewDecoder(r.Body).Decode(&body)
+			live = body.Policy
+			pushed = append(pushed, body.Policy)
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"policy": live, "updatedAt": "2026-10-19T12:00:00Z"})
+	}))
+	t.Cleanup(srv.Close)
+
+	prevApply, prevAddr, prevKey := apply, headscaleAddress, headscaleAPIKey
+	apply, headscaleAddress, headscaleAPIKey = true, srv.URL, "key"
+	t.Cleanup(func() { apply, headscaleAddress, headscaleAPIKey = prevApply, prevAddr, prevKey })
+	return &pushed
+}
+
+func TestPreparePolicy_Apply(t *testing.T) {
+	pushed := fakeHeadscale(t, `{"groups": {"group:eng": ["bob@"]}}`)
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}}},
+	}}
+	groups, logs := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if len(*pushed) != 1 || !strings.Contains((*pushed)[0], `"alice@"`) || len(groups["group:eng"]) != 1 {
+		t.Fatalf("pushed policies = %q, want the prepared one", *pushed)
+	}
+	joined := strings.Join(logs, "\n")
+	if !strings.Contains(joined, "Policy applied") || !strings.Contains(joined, "group:eng +alice@ -bob@") {
+		t.Errorf("missing apply or audit log line in %v", logs)
+	}
+}
+
+func TestPreparePolicy_ApplySkipsUnchangedPolicy(t *testing.T) {
+	pushed := fakeHeadscale(t, `{
+  // loaded earlier
+  "groups": {"group:eng": ["alice@"]},
+}`)
+
+	stub := &stubSource{groups: map[string]*models.Group{
+		"eng": {ID: "g1", Name: "eng", Users: []models.User{{ID: "u1", Username: "alice"}}},
+	}}
+	_, logs := runPreparePolicy(t, `{"groups": {"group:eng": []}}`, stub)
+	if len(*pushed) != 0 {
+		t.Errorf("an unchanged policy must not be pushed, got %q", *pushed)
+	}
+	if !strings.Contains(strings.Join(logs, "\n"), "up to date") {
+		t.Errorf("missing skip log line in %v", logs)
+	}
+}
@@ -0,0 +1,125 @@
+// Package backup keeps timestamped copies of the output policy and restores
+// them.
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
+)
+
+// timeFormat is the timestamp in backup file names: UTC, sortable, and
+// without characters that are awkward in file names.
+const timeFormat = "20060102T150405.000Z"
+
+// Backup is a backup file of a policy.
+type Backup struct {
+	Path string
+	Time time.Time // when the backup was taken
+}
+
+// Name returns the backup file name for a copy of path taken at t:
+// "<path>.<timestamp>.bak", next to path.
+func Name(path string, t time.Time) string {
+	return fmt.Sprintf("%s.%s.bak", path, t.UTC().Format(timeFormat))
+}
+
+// Create copies the file at path to a new backup taken at now and removes the
+// oldest backups beyond keep. It returns the backup path, or "" if there is
+// no file at path or keep is below 1.
+func Create(path string, keep int, now time.Time) (string, error) {
+	if keep < 1 {
+		return "", nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("backup: %w", err)
+	}
+
+	name := Name(path, now)
+	if err := tools.WriteFileAtomic(name, data, 0o600); err != nil {
+		return "", fmt.Errorf("backup: %w", err)
+	}
+	if err := Prune(path, keep); err != nil {
+		return name, err
+	}
+	return name, nil
+}
+
+// List returns the backups of path, newest first.
+func List(path string) ([]Backup, error) {
+	matches, err := filepath.Glob(escapeGlob(path) + ".*.bak")
+	if err != nil {
+		return nil, fmt.Errorf("backup: %w", err)
+	}
+	var backups []Backup
+	for _, m := range matches {
+		stamp := strings.TrimSuffix(strings.TrimPrefix(m, path+"."), ".bak")
+		t, err := time.Parse(timeFormat, stamp)
+		if err != nil {
+			continue // not one of ours
+		}
+		backups = append(backups, Backup{Path: m, Time: t})
+	}
+	slices.SortFunc(backups, func(a, b Backup) int { return b.Time.Compare(a.Time) })
+	return backups, nil
+}
+
+// Prune removes the oldest backups of path beyond keep.
+func Prune(path string, keep int) error {
+	backups, err := List(path)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, b := range backups[min(max(keep, 0), len(backups)):] {
+		if err := os.Remove(b.Path); err != nil {
+			errs = append(errs, fmt.Errorf("backup: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Restore atomically replaces the file at path with the content of the
+// backup file from. The replaced file is backed up first, as by Create, so a
+// rollback can itself be undone; from is read before older backups are
+// pruned. An existing file at path keeps its mode.
+func Restore(path, from string, keep int, now time.Time) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	if _, err := Create(path, keep, now); err != nil {
+		return err
+	}
+	perm := os.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	if err := tools.WriteFileAtomic(path, data, perm); err != nil {
+		return fmt.Errorf("restore: %w", err)
+	}
+	return nil
+}
+
+// escapeGlob escapes the glob metacharacters in a literal path.
+func escapeGlob(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if strings.ContainsRune(`*?[\`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
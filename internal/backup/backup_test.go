@@ -0,0 +1,62 @@
+package backup
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateRotatesAndRestores(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current.hjson")
+	start := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+
+	if name, err := Create(path, 2, start); err != nil || name != "" {
+		t.Fatalf("Create without a policy = %q, %v; want no backup", name, err)
+	}
+	for i, content := range []string{"v1", "v2", "v3"} {
+		if err := os.WriteFile(path, []byte(content), 0o640); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+		if _, err := Create(path, 2, start.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatalf("Create %s: %v", content, err)
+		}
+	}
+
+	backups, err := List(path)
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("got %d backups, want the newest 2: %v", len(backups), backups)
+	}
+	if want := Name(path, start.Add(2*time.Minute)); backups[0].Path != want {
+		t.Errorf("newest backup = %s, want %s", backups[0].Path, want)
+	}
+
+	// Roll back to v2, the oldest backup left; backing up v3 first must
+	// not prune it before it's read.
+	if err := Restore(path, backups[1].Path, 2, start.Add(time.Hour)); err != nil {
+		t.Fatalf("Restore: %v", err)
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != "v2" {
+		t.Errorf("restored content = %q, want v2", raw)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o640 {
+		t.Errorf("restored file mode = %v, %v; want 0640", fi.Mode().Perm(), err)
+	}
+	backups, _ = List(path)
+	if len(backups) != 2 || !backups[0].Time.Equal(start.Add(time.Hour)) {
+		t.Errorf("the replaced policy must be backed up, got %v", backups)
+	}
+}
+
+func TestCreateDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "current.hjson")
+	if err := os.WriteFile(path, []byte("v1"), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if name, err := Create(path, 0, time.Now()); err != nil || name != "" {
+		t.Errorf("Create with keep 0 = %q, %v; want no backup", name, err)
+	}
+}
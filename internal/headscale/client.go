@@ -0,0 +1,236 @@
+// Package headscale talks to the REST API of a Headscale server (the gRPC
+// gateway under /api/v1), authenticating with an API key.
+package headscale
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/retry"
+)
+
+// Config configures a Client.
+type Config struct {
+	// Address is the Headscale server URL, e.g. https://headscale.example.com.
+	// Without a scheme https is assumed.
+	Address string
+	APIKey  string
+	// CAFile is a PEM file with CA certificates to trust in addition to the
+	// system ones, for servers with a private CA.
+	CAFile                string
+	InsecureSkipTLSVerify bool
+	// Retry retries transient failures: network errors, 408, 429 and the
+	// 502, 503 and 504 of proxies and a restarting server. Headscale
+	// rejecting the request is never retried.
+	Retry retry.Policy
+	// Timeout limits each request; 0 means 30s.
+	Timeout time.Duration
+}
+
+// Client is a Headscale API client.
+type Client struct {
+	base   *url.URL
+	apiKey string
+	http   *http.Client
+	retry  retry.Policy
+}
+
+// Policy is the policy stored in Headscale.
+type Policy struct {
+	Policy    string    `json:"policy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// APIError is an error response of the Headscale API. Message carries
+// Headscale's explanation, e.g. why a policy failed to parse.
+type APIError struct {
+	StatusCode int    // HTTP status
+	Code       int    // gRPC status code, 0 if the body didn't have one
+	Message    string // error message from Headscale, or the response body
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("headscale: HTTP %d", e.StatusCode)
+	}
+	return fmt.Sprintf("headscale: HTTP %d: %s", e.StatusCode, e.Message)
+}
+
+// gRPC status codes worth another attempt.
+const (
+	codeDeadlineExceeded  = 4
+	codeResourceExhausted = 8
+	codeAborted           = 10
+	codeUnavailable       = 14
+)
+
+// NewClient checks c and returns a client for it.
+func NewClient(c Config) (*Client, error) {
+	if c.Address == "" {
+		return nil, errors.New("headscale: address is required")
+	}
+	if c.APIKey == "" {
+		return nil, errors.New("headscale: API key is required")
+	}
+	address := c.Address
+	if !strings.Contains(address, "://") {
+		address = "https://" + address
+	}
+	base, err := url.Parse(address)
+	if err != nil {
+		return nil, fmt.Errorf("headscale: address: %w", err)
+	}
+	if base.Scheme != "https" && base.Scheme != "http" || base.Host == "" {
+		return nil, fmt.Errorf("headscale: address %q: must be an http(s) URL", c.Address)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipTLSVerify,
+	}
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("headscale: CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("headscale: CA file %s: no certificates found", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	policy := c.Retry
+	if policy.Retryable == nil {
+		policy.Retryable = IsRetryable
+	}
+	return &Client{
+		base:   base,
+		apiKey: c.APIKey,
+		http:   &http.Client{Transport: transport, Timeout: timeout},
+		retry:  policy,
+	}, nil
+}
+
+// GetPolicy returns the policy Headscale has loaded.
+func (c *Client) GetPolicy(ctx context.Context) (*Policy, error) {
+	var out Policy
+	if err := c.do(ctx, http.MethodGet, "/api/v1/policy", nil, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// SetPolicy replaces the policy in Headscale. Headscale checks the policy
+// first; if it rejects it, the returned *APIError says why.
+func (c *Client) SetPolicy(ctx context.Context, policy string) (*Policy, error) {
+	var out Policy
+	if err := c.do(ctx, http.MethodPut, "/api/v1/policy", Policy{Policy: policy}, &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// do sends a JSON request to path, with retries, and decodes the response
+// into out.
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("headscale: %w", err)
+		}
+	}
+	target := c.base.JoinPath(path).String()
+
+	return c.retry.Do(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, method, target, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("headscale: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			return fmt.Errorf("headscale: %w", err)
+		}
+		defer resp.Body.Close()
+		raw, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+		if err != nil {
+			return fmt.Errorf("headscale: read response: %w", err)
+		}
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return apiError(resp.StatusCode, raw)
+		}
+		if out == nil {
+			return nil
+		}
+		if err := json.Unmarshal(raw, out); err != nil {
+			return fmt.Errorf("headscale: decode response: %w", err)
+		}
+		return nil
+	})
+}
+
+// apiError builds an APIError from an error response. The gRPC gateway sends
+// {"code": 3, "message": "..."}; anything else is kept as the message.
+func apiError(status int, body []byte) *APIError {
+	e := &APIError{StatusCode: status}
+	var gw struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &gw) == nil && gw.Message != "" {
+		e.Code, e.Message = gw.Code, gw.Message
+		return e
+	}
+	e.Message = strings.TrimSpace(string(body))
+	if e.Message == "" {
+		e.Message = http.StatusText(status)
+	}
+	return e
+}
+
+// IsRetryable reports whether a Client error looks transient. Headscale
+// reports a rejected policy as a 500, so of the server errors only those
+// of proxies or a server that isn't ready (502, 503, 504) are retried.
+func IsRetryable(err error) bool {
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		return retry.IsRetryable(err)
+	}
+	switch apiErr.Code {
+	case codeDeadlineExceeded, codeResourceExhausted, codeAborted, codeUnavailable:
+		return true
+	}
+	switch apiErr.StatusCode {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests,
+		http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package headscale
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/retry"
+)
+
+// fakeHeadscale serves GET and PUT /api/v1/policy like Headscale's gRPC
+// gateway. A policy containing "invalid" is rejected like a parse error.
+type fakeHeadscale struct {
+	policy   string
+	failures int32 // 503 responses before the server is up
+	calls    atomic.Int32
+	puts     atomic.Int32
+}
+
+func (f *fakeHeadscale) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.calls.Add(1)
+	if r.Header.Get("Authorization") != "Bearer key" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(`{"code": 16, "message": "invalid API key"}`))
+		return
+	}
+	if f.failures > 0 {
+		f.failures--
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if r.URL.Path != "/api/v1/policy" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodGet {
+		_ = json.NewEncoder(w).Encode(Policy{Policy: f.policy, UpdatedAt: time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC)})
+		return
+	}
+	if r.Method != http.MethodPut {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	f.puts.Add(1)
+	var in Policy
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if strings.Contains(in.Policy, "invalid") {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(`{"code": 2, "message": "setting policy: parsing policy: unknown group \"group:invalid\"", "details": []}`))
+		return
+	}
+	f.policy = in.Policy
+	_ = json.NewEncoder(w).Encode(Policy{Policy: in.Policy, UpdatedAt: time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)})
+}
+
+func newTestClient(t *testing.T, fake *fakeHeadscale, key string) *Client {
+	t.Helper()
+	srv := httptest.NewTLSServer(fake)
+	t.Cleanup(srv.Close)
+	c, err := NewClient(Config{
+		Address:               srv.URL,
+		APIKey:                key,
+		InsecureSkipTLSVerify: true,
+		Retry:                 retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	return c
+}
+
+func TestSetPolicy_RetriesUnavailableServer(t *testing.T) {
+	fake := &fakeHeadscale{failures: 2}
+	c := newTestClient(t, fake, "key")
+	got, err := c.SetPolicy(t.Context(), `{"groups": {}}`)
+	if err != nil {
+		t.Fatalf("SetPolicy: %v", err)
+	}
+	if fake.policy != `{"groups": {}}` || got.UpdatedAt.IsZero() {
+		t.Errorf("stored policy = %q, updated at %v", fake.policy, got.UpdatedAt)
+	}
+	if n := fake.calls.Load(); n != 3 {
+		t.Errorf("calls = %d, want 3", n)
+	}
+}
+
+func TestSetPolicy_ReportsRejectedPolicy(t *testing.T) {
+	fake := &fakeHeadscale{}
+	c := newTestClient(t, fake, "key")
+	_, err := c.SetPolicy(t.Context(), `{"acls": [{"src": ["group:invalid"]}]}`)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("err = %v, want *APIError", err)
+	}
+	if apiErr.StatusCode != http.StatusInternalServerError || !strings.Contains(apiErr.Message, `unknown group "group:invalid"`) {
+		t.Errorf("err = %+v", apiErr)
+	}
+	if n := fake.calls.Load(); n != 1 {
+		t.Errorf("a rejected policy must not be retried, calls = %d", n)
+	}
+}
+
+func TestSetPolicy_BadAPIKey(t *testing.T) {
+	fake := &fakeHeadscale{}
+	c := newTestClient(t, fake, "wrong")
+	_, err := c.SetPolicy(t.Context(), `{}`)
+	if err == nil || !strings.Contains(err.Error(), "HTTP 401: invalid API key") {
+		t.Errorf("err = %v, want the 401 message", err)
+	}
+}
+
+func TestGetPolicy(t *testing.T) {
+	fake := &fakeHeadscale{policy: `{"groups": {"group:eng": ["alice@"]}}`, failures: 1}
+	c := newTestClient(t, fake, "key")
+	got, err := c.GetPolicy(t.Context())
+	if err != nil {
+		t.Fatalf("GetPolicy: %v", err)
+	}
+	if got.Policy != fake.policy || got.UpdatedAt.IsZero() {
+		t.Errorf("GetPolicy = %+v", got)
+	}
+	if n := fake.puts.Load(); n != 0 {
+		t.Errorf("GetPolicy must not write, puts = %d", n)
+	}
+}
+
+func TestNewClient_Config(t *testing.T) {
+	for name, c := range map[string]Config{
+		"no address": {APIKey: "key"},
+		"no key":     {Address: "headscale.example.com"},
+		"bad scheme": {Address: "grpc://headscale.example.com:50443", APIKey: "key"},
+		"no CA file": {Address: "headscale.example.com", APIKey: "key", CAFile: "/nonexistent/ca.pem"},
+	} {
+		if _, err := NewClient(c); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	c, err := NewClient(Config{Address: "headscale.example.com", APIKey: "key"})
+	if err != nil || c.base.String() != "https://headscale.example.com" {
+		t.Errorf("address without scheme: %v, %v", c, err)
+	}
+}
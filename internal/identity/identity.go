@@ -0,0 +1,112 @@
+// Package identity renders source users as Headscale policy user references.
+package identity
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+// DefaultTemplate keeps the source username and appends "@" unless it
+// already contains one: "alice" → "alice@", "alice@example.com" as is.
+const DefaultTemplate = "{{withAt .Username}}"
+
+// funcs are available in username templates in addition to the text/template
+// builtins.
+var funcs = template.FuncMap{
+	"lower":      strings.ToLower,
+	"upper":      strings.ToUpper,
+	"trim":       strings.TrimSpace,
+	"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+	"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+	"replace":    func(old, new, s string) string { return strings.ReplaceAll(s, old, new) },
+	"localPart":  func(s string) string { local, _, _ := strings.Cut(s, "@"); return local },
+	"domain":     func(s string) string { _, domain, _ := strings.Cut(s, "@"); return domain },
+	"withAt": func(s string) string {
+		if s == "" || strings.Contains(s, "@") {
+			return s
+		}
+		return s + "@"
+	},
+}
+
+// domainPattern matches the part after "@": empty ("alice@") or a host name.
+// Labels may hold underscores and non-ASCII letters (IDN domains), as
+// directories and IdPs have them.
+var domainPattern = regexp.MustCompile(`^(` + domainLabel + `(\.` + domainLabel + `)*)?$`)
+
+const domainLabel = `[\p{L}\p{M}\p{N}_]([\p{L}\p{M}\p{N}_-]*[\p{L}\p{M}\p{N}_])?`
+
+// Renderer turns users into Headscale user references with a template.
+type Renderer struct {
+	tmpl *template.Template
+}
+
+// NewRenderer parses a username template; "" means DefaultTemplate. The
+// template sees the models.User fields (.ID, .Username, .Email, .Status).
+func NewRenderer(text string) (*Renderer, error) {
+	if text == "" {
+		text = DefaultTemplate
+	}
+	tmpl, err := template.New("username").Funcs(funcs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("username template: %w", err)
+	}
+	// Catch references to unknown fields now rather than per user.
+	if err := tmpl.Execute(&bytes.Buffer{}, models.User{}); err != nil {
+		return nil, fmt.Errorf("username template: %w", err)
+	}
+	return &Renderer{tmpl: tmpl}, nil
+}
+
+// Render returns the Headscale user reference for u, or an error if the
+// template output isn't one.
+func (r *Renderer) Render(u models.User) (string, error) {
+	var b strings.Builder
+	if err := r.tmpl.Execute(&b, u); err != nil {
+		return "", fmt.Errorf("username template: %w", err)
+	}
+	name := b.String()
+	if err := Validate(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Validate checks that name can be used as a user in a Headscale policy:
+// "name@" or an email-like "name@domain", without whitespace or further
+// "@" signs.
+func Validate(name string) error {
+	local, domain, ok := strings.Cut(name, "@")
+	switch {
+	case name == "":
+		return fmt.Errorf("invalid Headscale user: empty")
+	case !ok:
+		return fmt.Errorf("invalid Headscale user %q: must contain \"@\"", name)
+	case local == "":
+		return fmt.Errorf("invalid Headscale user %q: nothing before \"@\"", name)
+	case strings.ContainsAny(local, "@\"'`,:") || strings.IndexFunc(local, isSpaceOrControl) >= 0:
+		return fmt.Errorf("invalid Headscale user %q: invalid character before \"@\"", name)
+	case !domainPattern.MatchString(domain):
+		return fmt.Errorf("invalid Headscale user %q: invalid domain", name)
+	}
+	return nil
+}
+
+// ValidateDomain checks a domain given in the configuration, e.g. the one
+// appended to users without an email, so a bad one fails the run up front
+// instead of dropping every user it ends up in.
+func ValidateDomain(domain string) error {
+	if domain == "" || !domainPattern.MatchString(domain) {
+		return fmt.Errorf("invalid domain %q", domain)
+	}
+	return nil
+}
+
+func isSpaceOrControl(r rune) bool {
+	return r <= ' ' || r == 0x7f
+}
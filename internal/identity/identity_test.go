@@ -0,0 +1,84 @@
+package identity
+
+import (
+	"testing"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+func TestRenderer_Render(t *testing.T) {
+	alice := models.User{ID: "u1", Username: "Alice", Email: "alice@example.com"}
+	cases := []struct {
+		tmpl string
+		user models.User
+		want string
+	}{
+		{"", alice, "Alice@"},
+		{"", models.User{Username: "bob@example.com"}, "bob@example.com"},
+		{"{{.Email}}", alice, "alice@example.com"},
+		{"{{.Username}}@", alice, "Alice@"},
+		{"{{lower .Username}}@corp", alice, "alice@corp"},
+		{"{{localPart .Email}}@", alice, "alice@"},
+		{`{{.Email | trimSuffix "@example.com"}}@`, alice, "alice@"},
+		{`{{replace "." "-" (localPart "j.doe@x.org")}}@`, alice, "j-doe@"},
+	}
+	for _, tc := range cases {
+		r, err := NewRenderer(tc.tmpl)
+		if err != nil {
+			t.Fatalf("NewRenderer(%q): %v", tc.tmpl, err)
+		}
+		got, err := r.Render(tc.user)
+		if err != nil {
+			t.Errorf("Render(%q): %v", tc.tmpl, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("Render(%q) = %q, want %q", tc.tmpl, got, tc.want)
+		}
+	}
+}
+
+func TestRenderer_InvalidResult(t *testing.T) {
+	r, err := NewRenderer("{{.Email}}")
+	if err != nil {
+		t.Fatalf("NewRenderer: %v", err)
+	}
+	// No email: the result isn't a Headscale user.
+	if _, err := r.Render(models.User{Username: "carol"}); err == nil {
+		t.Errorf("expected an error for an empty result")
+	}
+}
+
+func TestNewRenderer_RejectsBadTemplates(t *testing.T) {
+	for _, tmpl := range []string{"{{.Username", "{{.Mail}}", "{{nope .Username}}"} {
+		if _, err := NewRenderer(tmpl); err == nil {
+			t.Errorf("NewRenderer(%q): expected an error", tmpl)
+		}
+	}
+}
+
+func TestValidateDomain(t *testing.T) {
+	for _, ok := range []string{"example.com", "dev_lab.corp", "bücher.example"} {
+		if err := ValidateDomain(ok); err != nil {
+			t.Errorf("ValidateDomain(%q): %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", "exa mple.com", "-corp", "corp.", "a@b"} {
+		if err := ValidateDomain(bad); err == nil {
+			t.Errorf("ValidateDomain(%q): expected an error", bad)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	for _, ok := range []string{"alice@", "alice@example.com", "j.doe+vpn@corp", "svc_bot@sub.example.org", "bob@dev_lab.corp", "jürgen@münchen.de", "ana@例え.jp"} {
+		if err := Validate(ok); err != nil {
+			t.Errorf("Validate(%q): %v", ok, err)
+		}
+	}
+	for _, bad := range []string{"", "alice", "@example.com", "a@b@c", "al ice@", "alice@exa mple.com", "alice@-corp", "alice@corp.", "al:ice@", "alice\n@"} {
+		if err := Validate(bad); err == nil {
+			t.Errorf("Validate(%q): expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package identity
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+// RewriteFile is the layout of the aliases file (HuJSON):
+//
+//	{
+//	  // source user ID, username or email → Headscale user
+//	  "aliases": {"jdoe": "john.doe@"},
+//	  // applied in order to the rendered name
+//	  "rewrites": [{"match": "^svc-(.*)@$", "replace": "${1}-bot@"}],
+//	  // domain after "@" → new domain
+//	  "domains": {"old.example.com": "example.com"},
+//	  "lowercase": true,
+//	}
+type RewriteFile struct {
+	Aliases   map[string]string `json:"aliases"`
+	Rewrites  []RewriteRule     `json:"rewrites"`
+	Domains   map[string]string `json:"domains"`
+	Lowercase bool              `json:"lowercase"`
+}
+
+// RewriteRule replaces matches of the regular expression Match with Replace,
+// which may refer to capture groups ($1, ${name}).
+type RewriteRule struct {
+	Match   string `json:"match"`
+	Replace string `json:"replace"`
+}
+
+// RuleHit reports how many users a rule changed.
+type RuleHit struct {
+	Rule  string
+	Users int
+}
+
+// Rewriter maps rendered usernames to Headscale users. An alias for the
+// user's source ID, username or email wins outright; otherwise the regex
+// rewrites, the domain map and case folding apply in this order. It counts
+// the users each rule changed. It is not safe for concurrent use.
+type Rewriter struct {
+	aliases   map[string]string
+	rewrites  []compiledRule
+	domains   map[string]string // lower-cased source domain → new domain
+	lowercase bool
+
+	order []string                       // rules in report order
+	hits  map[string]map[string]struct{} // rule → users it changed
+}
+
+type compiledRule struct {
+	desc    string
+	re      *regexp.Regexp
+	replace string
+}
+
+// LoadRewriter reads and checks an aliases file.
+func LoadRewriter(path string) (*Rewriter, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("aliases file: %w", err)
+	}
+	std, err := hujson.Standardize(raw)
+	if err != nil {
+		return nil, fmt.Errorf("aliases file %s: %w", path, err)
+	}
+	var f RewriteFile
+	dec := json.NewDecoder(bytes.NewReader(std))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("aliases file %s: %w", path, err)
+	}
+	r, err := NewRewriter(f)
+	if err != nil {
+		return nil, fmt.Errorf("aliases file %s: %w", path, err)
+	}
+	return r, nil
+}
+
+// NewRewriter compiles the rules of f. Alias targets must be valid Headscale
+// users.
+func NewRewriter(f RewriteFile) (*Rewriter, error) {
+	r := &Rewriter{
+		aliases:   make(map[string]string, len(f.Aliases)),
+		domains:   make(map[string]string, len(f.Domains)),
+		lowercase: f.Lowercase,
+		hits:      map[string]map[string]struct{}{},
+	}
+
+	keys := make([]string, 0, len(f.Aliases))
+	for from, to := range f.Aliases {
+		if err := Validate(to); err != nil {
+			return nil, fmt.Errorf("alias %q: %w", from, err)
+		}
+		r.aliases[from] = to
+		keys = append(keys, from)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.order = append(r.order, aliasRule(k, r.aliases[k]))
+	}
+
+	for i, rule := range f.Rewrites {
+		re, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite #%d: %w", i+1, err)
+		}
+		desc := fmt.Sprintf("rewrite #%d %s → %s", i+1, rule.Match, rule.Replace)
+		r.rewrites = append(r.rewrites, compiledRule{desc: desc, re: re, replace: rule.Replace})
+		r.order = append(r.order, desc)
+	}
+
+	keys = keys[:0]
+	for from, to := range f.Domains {
+		if to == "" || !domainPattern.MatchString(to) {
+			return nil, fmt.Errorf("domain %q: invalid new domain %q", from, to)
+		}
+		r.domains[strings.ToLower(from)] = to
+		keys = append(keys, strings.ToLower(from))
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		r.order = append(r.order, domainRule(k, r.domains[k]))
+	}
+
+	if r.lowercase {
+		r.order = append(r.order, "lowercase")
+	}
+	return r, nil
+}
+
+func aliasRule(from, to string) string  { return fmt.Sprintf("alias %s → %s", from, to) }
+func domainRule(from, to string) string { return fmt.Sprintf("domain %s → %s", from, to) }
+
+// Alias returns the alias for u's source ID, username or email, if there is
+// one. It doesn't need a rendered name, so it also fixes users the username
+// template fails for.
+func (r *Rewriter) Alias(u models.User) (string, bool) {
+	for _, key := range []string{u.ID, u.Username, u.Email} {
+		if to, ok := r.aliases[key]; ok && key != "" {
+			r.hit(aliasRule(key, to), u)
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// Apply returns the Headscale user for u, whose name was rendered from the
+// username template, or an error if the result isn't a valid user.
+func (r *Rewriter) Apply(u models.User, name string) (string, error) {
+	if to, ok := r.Alias(u); ok {
+		return to, nil
+	}
+
+	for _, rule := range r.rewrites {
+		if out := rule.re.ReplaceAllString(name, rule.replace); out != name {
+			name = out
+			r.hit(rule.desc, u)
+		}
+	}
+	if local, domain, ok := strings.Cut(name, "@"); ok {
+		from := strings.ToLower(domain)
+		if to, ok := r.domains[from]; ok && to != domain {
+			name = local + "@" + to
+			r.hit(domainRule(from, to), u)
+		}
+	}
+	if r.lowercase {
+		if lower := strings.ToLower(name); lower != name {
+			name = lower
+			r.hit("lowercase", u)
+		}
+	}
+
+	if err := Validate(name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (r *Rewriter) hit(rule string, u models.User) {
+	users, ok := r.hits[rule]
+	if !ok {
+		users = map[string]struct{}{}
+		r.hits[rule] = users
+	}
+	users[u.ID+"\x00"+u.Username] = struct{}{}
+}
+
+// Report lists the rules that changed at least one user: aliases, rewrites,
+// domains, then lowercase. Rewrites keep file order, aliases and domains are
+// sorted.
+func (r *Rewriter) Report() []RuleHit {
+	var out []RuleHit
+	for _, rule := range r.order {
+		if n := len(r.hits[rule]); n > 0 {
+			out = append(out, RuleHit{Rule: rule, Users: n})
+		}
+	}
+	return out
+}
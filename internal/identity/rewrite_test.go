@@ -0,0 +1,93 @@
+package identity
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+func writeAliases(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "aliases.hujson")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func TestRewriter_Apply(t *testing.T) {
+	path := writeAliases(t, `{
+		// renamed in the IdP, kept in Headscale
+		"aliases": {
+			"u-42": "legacy@",
+			"jdoe": "john.doe@example.com",
+		},
+		"rewrites": [
+			{"match": "^svc-(.*)@", "replace": "${1}-bot@"},
+		],
+		"domains": {"Old.Example.com": "example.com"},
+		"lowercase": true,
+	}`)
+	r, err := LoadRewriter(path)
+	if err != nil {
+		t.Fatalf("LoadRewriter: %v", err)
+	}
+
+	cases := []struct {
+		user     models.User
+		rendered string
+		want     string
+	}{
+		{models.User{ID: "u-42", Username: "newname"}, "newname@", "legacy@"},
+		{models.User{ID: "u-1", Username: "jdoe"}, "jdoe@", "john.doe@example.com"},
+		{models.User{ID: "u-2", Username: "svc-ci"}, "svc-ci@", "ci-bot@"},
+		{models.User{ID: "u-3", Username: "Ann"}, "Ann@old.example.com", "ann@example.com"},
+		{models.User{ID: "u-4", Username: "bob"}, "bob@", "bob@"},
+	}
+	for _, tc := range cases {
+		got, err := r.Apply(tc.user, tc.rendered)
+		if err != nil || got != tc.want {
+			t.Errorf("Apply(%s, %q) = %q, %v; want %q", tc.user.ID, tc.rendered, got, err, tc.want)
+		}
+	}
+	// The same user again doesn't count twice.
+	_, _ = r.Apply(models.User{ID: "u-3", Username: "Ann"}, "Ann@old.example.com")
+
+	want := []RuleHit{
+		{Rule: "alias jdoe → john.doe@example.com", Users: 1},
+		{Rule: "alias u-42 → legacy@", Users: 1},
+		{Rule: "rewrite #1 ^svc-(.*)@ → ${1}-bot@", Users: 1},
+		{Rule: "domain old.example.com → example.com", Users: 1},
+		{Rule: "lowercase", Users: 1},
+	}
+	if got := r.Report(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Report() =\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestRewriter_InvalidResult(t *testing.T) {
+	r, err := NewRewriter(RewriteFile{Rewrites: []RewriteRule{{Match: "@$", Replace: ""}}})
+	if err != nil {
+		t.Fatalf("NewRewriter: %v", err)
+	}
+	if _, err := r.Apply(models.User{Username: "alice"}, "alice@"); err == nil {
+		t.Errorf("a rewrite producing an invalid user must fail")
+	}
+}
+
+func TestLoadRewriter_Errors(t *testing.T) {
+	for name, content := range map[string]string{
+		"bad regex":      `{"rewrites": [{"match": "(", "replace": ""}]}`,
+		"invalid alias":  `{"aliases": {"jdoe": "not a user"}}`,
+		"invalid domain": `{"domains": {"old.com": "bad domain"}}`,
+		"unknown key":    `{"alias": {"jdoe": "jdoe@"}}`,
+		"syntax":         `{"aliases": `,
+	} {
+		if _, err := LoadRewriter(writeAliases(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+// Package membership applies include and exclude lists to the members
+// resolved for policy groups.
+package membership
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/tailscale/hujson"
+	"github.com/yousysadmin/headscale-pf/internal/identity"
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+// File is the layout of the members file (HuJSON):
+//
+//	{
+//	  // for every group
+//	  "exclude": ["svc-*", "*@bots.example.com"],
+//	  "include": [],
+//	  // per group, by template name with or without the "group:" prefix
+//	  "groups": {
+//	    "admins": {"include": ["breakglass@"]},
+//	  },
+//	}
+type File struct {
+	Lists
+	Groups map[string]Lists `json:"groups"`
+}
+
+// Lists holds include and exclude entries. Exclude entries are usernames,
+// emails or glob patterns (path.Match syntax) matched case-insensitively
+// against the Headscale user and the source username and email. Include
+// entries are Headscale users added to the group.
+type Lists struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// Member is a source user with the Headscale user it was rendered to.
+type Member struct {
+	User models.User
+	Name string
+}
+
+// Filter applies the lists of a File.
+type Filter struct {
+	global Lists
+	groups map[string]Lists
+}
+
+// Load reads and checks a members file.
+func Load(file string) (*Filter, error) {
+	raw, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("members file: %w", err)
+	}
+	std, err := hujson.Standardize(raw)
+	if err != nil {
+		return nil, fmt.Errorf("members file %s: %w", file, err)
+	}
+	var f File
+	dec := json.NewDecoder(bytes.NewReader(std))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("members file %s: %w", file, err)
+	}
+	flt, err := New(f)
+	if err != nil {
+		return nil, fmt.Errorf("members file %s: %w", file, err)
+	}
+	return flt, nil
+}
+
+// New checks the lists of f: patterns must be valid globs and include
+// entries valid Headscale users.
+func New(f File) (*Filter, error) {
+	if err := checkLists("", f.Lists); err != nil {
+		return nil, err
+	}
+	groups := make(map[string]Lists, len(f.Groups))
+	for name, l := range f.Groups {
+		if err := checkLists(name, l); err != nil {
+			return nil, err
+		}
+		groups[strings.TrimPrefix(name, "group:")] = l
+	}
+	return &Filter{global: f.Lists, groups: groups}, nil
+}
+
+func checkLists(group string, l Lists) error {
+	where := "global"
+	if group != "" {
+		where = "group " + group
+	}
+	for _, p := range l.Exclude {
+		if _, err := path.Match(p, ""); err != nil || p == "" {
+			return fmt.Errorf("%s exclude: invalid pattern %q", where, p)
+		}
+	}
+	for _, name := range l.Include {
+		if strings.ContainsAny(name, "*?[") {
+			return fmt.Errorf("%s include: %q: patterns are not allowed, list Headscale users", where, name)
+		}
+		if err := identity.Validate(name); err != nil {
+			return fmt.Errorf("%s include: %w", where, err)
+		}
+	}
+	return nil
+}
+
+// Apply returns the Headscale users of group after dropping excluded members
+// and adding included users, along with what was excluded and included.
+// Include entries win over exclude patterns.
+func (f *Filter) Apply(group string, members []Member) (names, excluded, included []string) {
+	groupLists := f.groups[group]
+	exclude := append(append([]string(nil), f.global.Exclude...), groupLists.Exclude...)
+	include := append(append([]string(nil), f.global.Include...), groupLists.Include...)
+
+	keep := make(map[string]bool, len(include))
+	for _, name := range include {
+		keep[strings.ToLower(name)] = true
+	}
+
+	present := map[string]bool{}
+	for _, m := range members {
+		if !keep[strings.ToLower(m.Name)] && matchesAny(exclude, m) {
+			excluded = append(excluded, m.Name)
+			continue
+		}
+		names = append(names, m.Name)
+		present[strings.ToLower(m.Name)] = true
+	}
+	for _, name := range include {
+		if !present[strings.ToLower(name)] {
+			names = append(names, name)
+			included = append(included, name)
+			present[strings.ToLower(name)] = true
+		}
+	}
+	return names, excluded, included
+}
+
+func matchesAny(patterns []string, m Member) bool {
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		for _, v := range []string{m.Name, m.User.Username, m.User.Email} {
+			if v == "" {
+				continue
+			}
+			if ok, _ := path.Match(p, strings.ToLower(v)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
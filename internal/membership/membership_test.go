@@ -0,0 +1,80 @@
+package membership
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+func writeMembers(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "members.hujson")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	return path
+}
+
+func member(username, email string) Member {
+	return Member{User: models.User{ID: username, Username: username, Email: email}, Name: username + "@"}
+}
+
+func TestFilter_Apply(t *testing.T) {
+	f, err := Load(writeMembers(t, `{
+		// service accounts never get access
+		"exclude": ["svc-*", "*@bots.example.com"],
+		"groups": {
+			"group:admins": {"include": ["breakglass@", "svc-backup@"]},
+			"eng": {"exclude": ["Carol@"]},
+		},
+	}`))
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	members := []Member{
+		member("alice", "alice@example.com"),
+		member("svc-backup", ""),
+		member("bob", "bob@bots.example.com"),
+		member("carol", ""),
+	}
+
+	names, excluded, included := f.Apply("admins", members)
+	if want := []string{"alice@", "svc-backup@", "carol@", "breakglass@"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("admins names = %v, want %v", names, want)
+	}
+	if want := []string{"bob@"}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("admins excluded = %v, want %v", excluded, want)
+	}
+	if want := []string{"breakglass@"}; !reflect.DeepEqual(included, want) {
+		t.Errorf("admins included = %v, want %v", included, want)
+	}
+
+	names, excluded, included = f.Apply("eng", members)
+	if want := []string{"alice@"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("eng names = %v, want %v", names, want)
+	}
+	if want := []string{"svc-backup@", "bob@", "carol@"}; !reflect.DeepEqual(excluded, want) {
+		t.Errorf("eng excluded = %v, want %v", excluded, want)
+	}
+	if len(included) != 0 {
+		t.Errorf("eng included = %v, want none", included)
+	}
+}
+
+func TestLoad_Errors(t *testing.T) {
+	for name, content := range map[string]string{
+		"bad pattern":     `{"exclude": ["[a-"]}`,
+		"empty pattern":   `{"groups": {"eng": {"exclude": [""]}}}`,
+		"invalid include": `{"include": ["not a user"]}`,
+		"include pattern": `{"include": ["admin-*@"]}`,
+		"unknown key":     `{"excludes": ["svc-*"]}`,
+		"syntax":          `{"exclude": `,
+	} {
+		if _, err := Load(writeMembers(t, content)); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
@@ -2,7 +2,7 @@ package models
 
 // Group info
 type Group struct {
-	ID    string
-	Name  string
-	Users []User
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Users []User `json:"users"`
 }
@@ -1,8 +1,29 @@
 package models
 
+// UserStatus is the account state reported by the source.
+type UserStatus string
+
+// User statuses. Sources that don't report a state leave it unknown, which
+// counts as active.
+const (
+	UserStatusUnknown   UserStatus = ""
+	UserStatusActive    UserStatus = "active"
+	UserStatusDisabled  UserStatus = "disabled"  // disabled or deactivated
+	UserStatusPending   UserStatus = "pending"   // invited, activation not finished yet
+	UserStatusSuspended UserStatus = "suspended" // suspended by an administrator
+	UserStatusLocked    UserStatus = "locked"    // locked, e.g. after failed logins
+)
+
 // User info
 type User struct {
-	ID       string
-	Email    string
-	Username string
+	ID       string     `json:"id"`
+	Email    string     `json:"email"`
+	Username string     `json:"username"`
+	Status   UserStatus `json:"status,omitempty"`
+}
+
+// Active reports whether the user may be granted access.
+// Pending users keep access: an invitation shouldn't be lost on the next run.
+func (u User) Active() bool {
+	return u.Status == UserStatusUnknown || u.Status == UserStatusActive || u.Status == UserStatusPending
 }
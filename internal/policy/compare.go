@@ -0,0 +1,124 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Comparison is the semantic difference between two policies: comments,
+// whitespace, key order and the order of group members don't count.
+type Comparison struct {
+	AddedGroups   []string    // groups only in the new policy, sorted
+	RemovedGroups []string    // groups only in the old policy, sorted
+	Groups        []GroupDiff // groups whose members differ
+	Sections      []string    // other top-level sections that differ, sorted
+}
+
+// Equal reports whether the policies are the same.
+func (c Comparison) Equal() bool {
+	return len(c.AddedGroups) == 0 && len(c.RemovedGroups) == 0 &&
+		len(c.Groups) == 0 && len(c.Sections) == 0
+}
+
+// String summarizes the differences, e.g.
+// "groups: +group:ops -group:old; group:eng +carol@ -bob@; sections: acls".
+func (c Comparison) String() string {
+	if c.Equal() {
+		return "no changes"
+	}
+	var parts []string
+	if len(c.AddedGroups) > 0 || len(c.RemovedGroups) > 0 {
+		changes := []string{"groups:"}
+		for _, g := range c.AddedGroups {
+			changes = append(changes, "+"+g)
+		}
+		for _, g := range c.RemovedGroups {
+			changes = append(changes, "-"+g)
+		}
+		parts = append(parts, strings.Join(changes, " "))
+	}
+	for _, d := range c.Groups {
+		changes := []string{d.Group}
+		for _, m := range d.Added {
+			changes = append(changes, "+"+m)
+		}
+		for _, m := range d.Removed {
+			changes = append(changes, "-"+m)
+		}
+		parts = append(parts, strings.Join(changes, " "))
+	}
+	if len(c.Sections) > 0 {
+		parts = append(parts, "sections: "+strings.Join(c.Sections, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Compare parses two policies (HuJSON or JSON) and returns how newData
+// differs from oldData. Empty data counts as an empty policy. Adding or
+// removing a group counts as a change even when the group has no members.
+func Compare(oldData, newData []byte) (Comparison, error) {
+	oldGroups, oldSections, err := parseSections(oldData)
+	if err != nil {
+		return Comparison{}, fmt.Errorf("old policy: %w", err)
+	}
+	newGroups, newSections, err := parseSections(newData)
+	if err != nil {
+		return Comparison{}, fmt.Errorf("new policy: %w", err)
+	}
+
+	c := Comparison{Groups: DiffGroups(oldGroups, newGroups)}
+	for name := range oldGroups {
+		if _, ok := newGroups[name]; !ok {
+			c.RemovedGroups = append(c.RemovedGroups, name)
+		}
+	}
+	for name := range newGroups {
+		if _, ok := oldGroups[name]; !ok {
+			c.AddedGroups = append(c.AddedGroups, name)
+		}
+	}
+	slices.Sort(c.AddedGroups)
+	slices.Sort(c.RemovedGroups)
+	for name, v := range oldSections {
+		if nv, ok := newSections[name]; !ok || !reflect.DeepEqual(v, nv) {
+			c.Sections = append(c.Sections, name)
+		}
+	}
+	for name := range newSections {
+		if _, ok := oldSections[name]; !ok {
+			c.Sections = append(c.Sections, name)
+		}
+	}
+	slices.Sort(c.Sections)
+	return c, nil
+}
+
+// parseSections returns the groups of a policy and its other top-level
+// sections, decoded.
+func parseSections(data []byte) (map[string][]string, map[string]any, error) {
+	if len(strings.TrimSpace(string(data))) == 0 {
+		return map[string][]string{}, map[string]any{}, nil
+	}
+	var p Policy
+	// hujson aliases the input and Standardize rewrites it, so work on a copy.
+	if err := p.parse(append([]byte(nil), data...)); err != nil {
+		return nil, nil, err
+	}
+	groups := p.Groups()
+
+	p.ast.Standardize()
+	var top map[string]any
+	if err := json.Unmarshal(p.ast.Pack(), &top); err != nil {
+		return nil, nil, err
+	}
+	sections := make(map[string]any, len(top))
+	for name, v := range top {
+		if !strings.EqualFold(name, "groups") {
+			sections[name] = v
+		}
+	}
+	return groups, sections, nil
+}
@@ -0,0 +1,77 @@
+package policy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCompare(t *testing.T) {
+	live := []byte(`{"groups": {"group:eng": ["bob@", "alice@"]}, "acls": [{"action": "accept", "src": ["group:eng"], "dst": ["*:*"]}]}`)
+	same := []byte(`{
+  // engineering
+  "acls": [
+    {"action": "accept", "src": ["group:eng"], "dst": ["*:*"]},
+  ],
+  "groups": {
+    "group:eng": ["alice@", "bob@"],
+  },
+}`)
+	c, err := Compare(live, same)
+	if err != nil {
+		t.Fatalf("Compare: %v", err)
+	}
+	if !c.Equal() {
+		t.Errorf("comments, layout and member order must not count: %s", c)
+	}
+
+	changed := []byte(`{
+  "groups": {"group:eng": ["alice@", "carol@"]},
+  "acls": [{"action": "accept", "src": ["group:eng"], "dst": ["*:22"]}],
+  "tagOwners": {"tag:ci": ["group:eng"]},
+}`)
+	c, err = Compare(live, changed)
+	if err != nil {
+		t.Fatalf("Compare: %v", err)
+	}
+	want := Comparison{
+		Groups:   []GroupDiff{{Group: "group:eng", Before: 2, After: 2, Added: []string{"carol@"}, Removed: []string{"bob@"}}},
+		Sections: []string{"acls", "tagOwners"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Compare =\n%+v\nwant\n%+v", c, want)
+	}
+	if got := c.String(); got != "group:eng +carol@ -bob@; sections: acls, tagOwners" {
+		t.Errorf("String = %q", got)
+	}
+}
+
+func TestCompare_EmptyLivePolicy(t *testing.T) {
+	c, err := Compare(nil, []byte(`{"groups": {"group:eng": ["alice@"]}}`))
+	if err != nil {
+		t.Fatalf("Compare: %v", err)
+	}
+	if c.Equal() || len(c.Groups) != 1 || len(c.Sections) != 0 {
+		t.Errorf("Compare = %+v", c)
+	}
+	if _, err := Compare([]byte(`{"groups":`), nil); err == nil {
+		t.Error("expected an error for a malformed policy")
+	}
+}
+
+func TestCompare_GroupKeys(t *testing.T) {
+	live := []byte(`{"groups": {"group:eng": ["alice@"], "group:empty": []}}`)
+	c, err := Compare(live, []byte(`{"groups": {"group:eng": ["alice@"], "group:new": []}}`))
+	if err != nil {
+		t.Fatalf("Compare: %v", err)
+	}
+	if c.Equal() {
+		t.Fatal("adding or dropping an empty group must count as a change")
+	}
+	want := Comparison{AddedGroups: []string{"group:new"}, RemovedGroups: []string{"group:empty"}}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("Compare =\n%+v\nwant\n%+v", c, want)
+	}
+	if got := c.String(); got != "groups: +group:new -group:empty" {
+		t.Errorf("String = %q", got)
+	}
+}
@@ -0,0 +1,134 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// GroupDiff is the change to the members of one group between two policies.
+type GroupDiff struct {
+	Group   string   `json:"group"`
+	Before  int      `json:"before"` // members in the old policy
+	After   int      `json:"after"`  // members in the new policy
+	Added   []string `json:"added,omitempty"`
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ReadGroupsFromFile returns the groups of the policy file at path (see
+// Policy.Groups), e.g. the output of an earlier run.
+func ReadGroupsFromFile(path string) (map[string][]string, error) {
+	var p Policy
+	if err := p.ReadPolicyFromFile(path); err != nil {
+		return nil, err
+	}
+	return p.Groups(), nil
+}
+
+// DiffGroups compares the members of the groups in oldGroups and newGroups,
+// ignoring member order. It returns the groups whose members differ, sorted
+// by name; a group missing on one side counts as empty there. Added members
+// are listed in newGroups order, removed ones in oldGroups order.
+func DiffGroups(oldGroups, newGroups map[string][]string) []GroupDiff {
+	names := make([]string, 0, len(oldGroups)+len(newGroups))
+	for name := range oldGroups {
+		names = append(names, name)
+	}
+	for name := range newGroups {
+		if _, ok := oldGroups[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+
+	var diffs []GroupDiff
+	for _, name := range names {
+		before, after := uniqueSet(oldGroups[name]), uniqueSet(newGroups[name])
+		d := GroupDiff{Group: name, Before: len(before), After: len(after)}
+		d.Added = missingFrom(newGroups[name], before)
+		d.Removed = missingFrom(oldGroups[name], after)
+		if len(d.Added) > 0 || len(d.Removed) > 0 {
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs
+}
+
+func uniqueSet(members []string) map[string]bool {
+	set := make(map[string]bool, len(members))
+	for _, m := range members {
+		set[m] = true
+	}
+	return set
+}
+
+// missingFrom returns the members not in set, without duplicates.
+func missingFrom(members []string, set map[string]bool) []string {
+	var out []string
+	seen := map[string]bool{}
+	for _, m := range members {
+		if !set[m] && !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// ErrUnsafeRemoval is returned by CheckRemovals when the new policy would
+// remove more members than allowed.
+var ErrUnsafeRemoval = errors.New("unsafe member removal")
+
+// RemovalLimits bounds how many members a new policy may remove, both over
+// all groups and in any single group. Zero disables a limit.
+type RemovalLimits struct {
+	MaxRemoved        int     // members
+	MaxRemovedPercent float64 // of the members before
+}
+
+// CheckRemovals guards against stripping access because the source returned
+// too few members, e.g. during a partial outage. It compares the groups of
+// newGroups with the same groups in oldGroups and reports an error wrapping
+// ErrUnsafeRemoval if the removals exceed limits, or if a group that had
+// members would have none. Groups no longer in newGroups (removed from the
+// template) aren't checked.
+func CheckRemovals(oldGroups, newGroups map[string][]string, limits RemovalLimits) error {
+	var problems []string
+	var totalBefore, totalRemoved int
+	for _, d := range DiffGroups(oldGroups, newGroups) {
+		if _, ok := newGroups[d.Group]; !ok {
+			continue
+		}
+		removed := len(d.Removed)
+		totalRemoved += removed
+		switch {
+		case d.Before > 0 && d.After == 0:
+			problems = append(problems, fmt.Sprintf("%s would become empty (%d members now)", d.Group, d.Before))
+		case exceeds(removed, d.Before, limits):
+			problems = append(problems, fmt.Sprintf("%s would lose %d of %d members", d.Group, removed, d.Before))
+		}
+	}
+	for name := range newGroups {
+		totalBefore += len(uniqueSet(oldGroups[name]))
+	}
+	if exceeds(totalRemoved, totalBefore, limits) {
+		problems = append(problems, fmt.Sprintf("%d of %d members would be removed in total", totalRemoved, totalBefore))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: %s", ErrUnsafeRemoval, strings.Join(problems, "; "))
+}
+
+// exceeds reports whether removing removed of before members breaks limits.
+func exceeds(removed, before int, limits RemovalLimits) bool {
+	if removed == 0 {
+		return false
+	}
+	if limits.MaxRemoved > 0 && removed > limits.MaxRemoved {
+		return true
+	}
+	return limits.MaxRemovedPercent > 0 && before > 0 &&
+		float64(removed)*100/float64(before) > limits.MaxRemovedPercent
+}
@@ -0,0 +1,83 @@
+package policy
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiffGroups(t *testing.T) {
+	oldGroups := map[string][]string{
+		"group:eng":  {"alice@", "bob@"},
+		"group:ops":  {"ops@"},
+		"group:gone": {"carol@"},
+	}
+	newGroups := map[string][]string{
+		"group:eng": {"dave@", "alice@"},
+		"group:ops": {"ops@"},
+		"group:new": {"erin@"},
+	}
+	want := []GroupDiff{
+		{Group: "group:eng", Before: 2, After: 2, Added: []string{"dave@"}, Removed: []string{"bob@"}},
+		{Group: "group:gone", Before: 1, After: 0, Removed: []string{"carol@"}},
+		{Group: "group:new", Before: 0, After: 1, Added: []string{"erin@"}},
+	}
+	if got := DiffGroups(oldGroups, newGroups); !reflect.DeepEqual(got, want) {
+		t.Errorf("DiffGroups =\n%+v\nwant\n%+v", got, want)
+	}
+	if got := DiffGroups(newGroups, newGroups); len(got) != 0 {
+		t.Errorf("identical groups must not differ, got %+v", got)
+	}
+}
+
+func TestGroups_AppliesStagedMembers(t *testing.T) {
+	p := Policy{}
+	if err := p.ReadPolicyFromFile(writeTemp(t, "in.hjson", sampleHJSON)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	p.AppendGroups(map[string][]string{"group:devs": {"alice@"}})
+	want := map[string][]string{"group:admins": {}, "group:devs": {"alice@"}}
+	if got := p.Groups(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Groups() = %v, want %v", got, want)
+	}
+}
+
+func TestReadGroupsFromFile_Missing(t *testing.T) {
+	_, err := ReadGroupsFromFile(filepath.Join(t.TempDir(), "none.hjson"))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("err = %v, want fs.ErrNotExist", err)
+	}
+}
+
+func TestCheckRemovals(t *testing.T) {
+	oldGroups := map[string][]string{
+		"group:eng":     {"a@", "b@", "c@", "d@"},
+		"group:ops":     {"o@"},
+		"group:retired": {"r@"},
+	}
+	cases := []struct {
+		name      string
+		newGroups map[string][]string
+		limits    RemovalLimits
+		wantErr   bool
+	}{
+		{"no removals", map[string][]string{"group:eng": {"a@", "b@", "c@", "d@", "e@"}, "group:ops": {"o@"}}, RemovalLimits{MaxRemoved: 1}, false},
+		{"within limits", map[string][]string{"group:eng": {"a@", "b@", "c@"}, "group:ops": {"o@"}}, RemovalLimits{MaxRemoved: 1, MaxRemovedPercent: 25}, false},
+		{"count per group", map[string][]string{"group:eng": {"a@", "b@"}, "group:ops": {"o@"}}, RemovalLimits{MaxRemoved: 1}, true},
+		{"percent per group", map[string][]string{"group:eng": {"a@", "b@"}, "group:ops": {"o@"}}, RemovalLimits{MaxRemovedPercent: 40}, true},
+		{"percent overall", map[string][]string{"group:eng": {"a@", "b@", "c@"}, "group:ops": {"o@"}}, RemovalLimits{MaxRemovedPercent: 10}, true},
+		{"group becomes empty", map[string][]string{"group:eng": {"a@", "b@", "c@", "d@"}, "group:ops": {}}, RemovalLimits{}, true},
+		{"group removed from template", map[string][]string{"group:eng": {"a@", "b@", "c@", "d@"}, "group:ops": {"o@"}}, RemovalLimits{MaxRemoved: 1}, false},
+	}
+	for _, tc := range cases {
+		err := CheckRemovals(oldGroups, tc.newGroups, tc.limits)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tc.name, err, tc.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrUnsafeRemoval) {
+			t.Errorf("%s: err = %v, want ErrUnsafeRemoval", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/tailscale/hujson"
+)
+
+// Member orders for staged groups, see SetMemberOrder.
+const (
+	// OrderSource keeps the order the members came in.
+	OrderSource = "source"
+	// OrderAlphabetical sorts members case-insensitively, so the output
+	// doesn't change with the order the source returns them in.
+	OrderAlphabetical = "alphabetical"
+)
+
+// IsValidOrder reports whether order is one of the member orders.
+func IsValidOrder(order string) bool {
+	return order == OrderSource || order == OrderAlphabetical
+}
+
+// SetMemberOrder sets the order of the members staged by later AppendGroups
+// calls. "" means OrderSource.
+func (p *Policy) SetMemberOrder(order string) error {
+	if order != "" && !IsValidOrder(order) {
+		return fmt.Errorf("invalid member order %q: must be %q or %q", order, OrderAlphabetical, OrderSource)
+	}
+	p.order = order
+	return nil
+}
+
+// SetWrap makes WritePolicyToFile write group arrays with more than n members
+// one member per line, indented below the group key. It only changes arrays
+// laid out on a single line; 0 (the default) never wraps. JSON output always
+// has one member per line.
+func (p *Policy) SetWrap(n int) {
+	p.wrap = max(n, 0)
+}
+
+// orderMembers returns members without duplicates, in order. The first
+// occurrence of a duplicate wins. The result is never nil.
+func orderMembers(members []string, order string) []string {
+	out := make([]string, 0, len(members))
+	seen := make(map[string]bool, len(members))
+	for _, m := range members {
+		if !seen[m] {
+			seen[m] = true
+			out = append(out, m)
+		}
+	}
+	if order == OrderAlphabetical {
+		slices.SortFunc(out, func(a, b string) int {
+			if c := strings.Compare(strings.ToLower(a), strings.ToLower(b)); c != 0 {
+				return c
+			}
+			return strings.Compare(a, b)
+		})
+	}
+	return out
+}
+
+// lineIndent returns the whitespace starting the last line of extra, the
+// indentation of the value that follows it.
+func lineIndent(extra hujson.Extra) string {
+	i := bytes.LastIndexByte(extra, '\n')
+	if i < 0 {
+		return ""
+	}
+	line := extra[i+1:]
+	return string(line[:len(line)-len(bytes.TrimLeft(line, " \t"))])
+}
+
+// wrapArray puts each element of a single-line array on its own line, one
+// level deeper than indent, with a trailing comma and the closing bracket on
+// a line at indent. Block comments move along with their elements. Arrays
+// already spanning several lines are left alone.
+func wrapArray(arr *hujson.Array, indent string) {
+	if bytes.IndexByte(arr.AfterExtra, '\n') >= 0 {
+		return
+	}
+	for _, el := range arr.Elements {
+		if bytes.IndexByte(el.BeforeExtra, '\n') >= 0 || bytes.IndexByte(el.AfterExtra, '\n') >= 0 {
+			return
+		}
+	}
+
+	unit := "  "
+	if strings.Contains(indent, "\t") {
+		unit = "\t"
+	}
+	for i := range arr.Elements {
+		el := &arr.Elements[i]
+		el.BeforeExtra = hujson.Extra("\n" + indent + unit + withSpace(el.BeforeExtra, false))
+		el.AfterExtra = hujson.Extra(withSpace(el.AfterExtra, true))
+	}
+	arr.AfterExtra = hujson.Extra(withSpace(arr.AfterExtra, true) + "\n" + indent)
+}
+
+// withSpace returns the comments in a single-line extra, separated from the
+// element by a space before (leading) or after them; "" if there are none.
+func withSpace(extra hujson.Extra, leading bool) string {
+	comment := string(bytes.TrimSpace(extra))
+	switch {
+	case comment == "":
+		return ""
+	case leading:
+		return " " + comment
+	}
+	return comment + " "
+}
@@ -0,0 +1,104 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestOrderMembers(t *testing.T) {
+	in := []string{"bob@", "Alice@", "carol@", "bob@", "alice@"}
+	if got, want := orderMembers(in, OrderSource), []string{"bob@", "Alice@", "carol@", "alice@"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("source order = %v, want %v", got, want)
+	}
+	if got, want := orderMembers(in, OrderAlphabetical), []string{"Alice@", "alice@", "bob@", "carol@"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("alphabetical order = %v, want %v", got, want)
+	}
+	if got := orderMembers(nil, OrderAlphabetical); got == nil {
+		t.Errorf("an empty group must stay a non-nil slice")
+	}
+}
+
+// layoutWrite writes template with staged groups, sorted alphabetically and
+// wrapped above wrap members, and returns the HuJSON output.
+func layoutWrite(t *testing.T, template string, staged map[string][]string, wrap int) string {
+	t.Helper()
+	p := Policy{}
+	if err := p.ReadPolicyFromFile(writeTemp(t, "in.hjson", template)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := p.SetMemberOrder(OrderAlphabetical); err != nil {
+		t.Fatalf("SetMemberOrder: %v", err)
+	}
+	p.SetWrap(wrap)
+	p.AppendGroups(staged)
+	out := filepath.Join(t.TempDir(), "out.hjson")
+	if err := p.WritePolicyToFile(out, FormatHJSON); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	raw, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	return string(raw)
+}
+
+func TestWrap_LongArraysOnePerLine(t *testing.T) {
+	tmpl := `{
+  "groups": {
+    "group:eng": [], // from the source
+    "group:ops": [],
+  },
+}`
+	got := layoutWrite(t, tmpl, map[string][]string{
+		"group:eng": {"dave@", "bob@", "carol@", "alice@", "bob@"},
+		"group:ops": {"oscar@", "olga@"},
+	}, 3)
+	want := `{
+  "groups": {
+    "group:eng": [
+      "alice@",
+      "bob@",
+      "carol@",
+      "dave@",
+    ], // from the source
+    "group:ops": ["olga@","oscar@"],
+  },
+}`
+	if got != want {
+		t.Errorf("wrapped output:\n--- want ---\n%s\n--- got ---\n%s", want, got)
+	}
+}
+
+func TestWrap_KeepsBlockComments(t *testing.T) {
+	p := Policy{}
+	if err := p.ReadPolicyFromFile(writeTemp(t, "in.hjson", `{"groups": {"group:ops": [/* pin */ "root@", "a@"]}}`)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := p.SetMerge(MergeUnion, nil); err != nil {
+		t.Fatalf("SetMerge: %v", err)
+	}
+	p.SetWrap(2)
+	p.AppendGroups(map[string][]string{"group:ops": {"b@"}})
+	out := filepath.Join(t.TempDir(), "out.hjson")
+	if err := p.WritePolicyToFile(out, FormatHJSON); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	raw, _ := os.ReadFile(out)
+	want := `{"groups": {"group:ops": [
+  /* pin */ "root@",
+  "a@",
+  "b@",
+]}}`
+	if string(raw) != want {
+		t.Errorf("wrapped output:\n--- want ---\n%s\n--- got ---\n%s", want, raw)
+	}
+}
+
+func TestSetMemberOrder_Invalid(t *testing.T) {
+	p := Policy{}
+	if err := p.SetMemberOrder("random"); err == nil {
+		t.Errorf("an unknown member order must be rejected")
+	}
+}
@@ -0,0 +1,225 @@
+package policy
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/tailscale/hujson"
+)
+
+// Merge strategies decide how source members combine with the members a
+// group already has in the template.
+const (
+	// MergeReplace writes only the source members (the default).
+	MergeReplace = "replace"
+	// MergeUnion keeps all template members and adds the source members.
+	MergeUnion = "union"
+	// MergePinned keeps the template members marked with a "pin" comment
+	// (e.g. "alice@", // pin) and adds the source members.
+	MergePinned = "pinned"
+)
+
+// IsValidMerge reports whether strategy is one of the merge strategies.
+func IsValidMerge(strategy string) bool {
+	return strategy == MergeReplace || strategy == MergeUnion || strategy == MergePinned
+}
+
+// pinComment matches a "// pin" or "/* pin */" comment.
+var pinComment = regexp.MustCompile(`(//|/\*)\s*pin\b`)
+
+// SetMerge sets the merge strategy for staged groups: strategy for all of
+// them, except the full group names in perGroup. "" means MergeReplace.
+func (p *Policy) SetMerge(strategy string, perGroup map[string]string) error {
+	if strategy != "" && !IsValidMerge(strategy) {
+		return fmt.Errorf("invalid merge strategy %q: must be %q, %q, or %q", strategy, MergeReplace, MergeUnion, MergePinned)
+	}
+	for group, s := range perGroup {
+		if !IsValidMerge(s) {
+			return fmt.Errorf("group %s: invalid merge strategy %q: must be %q, %q, or %q", group, s, MergeReplace, MergeUnion, MergePinned)
+		}
+	}
+	p.merge = strategy
+	p.groupMerge = perGroup
+	return nil
+}
+
+// mergeStrategy returns the strategy for the full group name.
+func (p *Policy) mergeStrategy(group string) string {
+	if s, ok := p.groupMerge[group]; ok {
+		return s
+	}
+	if p.merge == "" {
+		return MergeReplace
+	}
+	return p.merge
+}
+
+// arrayItem is a template array element together with the comments that
+// belong to it, so elements can be dropped or added without moving a comment
+// onto a neighbour.
+type arrayItem struct {
+	value hujson.ValueTrimmed
+	lead  hujson.Extra // whitespace and comments before the element
+	after hujson.Extra // between the element and its comma
+	trail hujson.Extra // after the comma, up to the end of the line
+}
+
+// name returns the element's string value, or "" for other kinds.
+func (it arrayItem) name() string {
+	if lit, ok := it.value.(hujson.Literal); ok && lit.Kind() == '"' {
+		return lit.String()
+	}
+	return ""
+}
+
+// pinned reports whether a comment on the element's line marks it as pinned.
+func (it arrayItem) pinned() bool {
+	line := it.lead
+	if i := bytes.LastIndexByte(line, '\n'); i >= 0 {
+		line = line[i+1:]
+	}
+	return pinComment.Match(line) || pinComment.Match(it.after) || pinComment.Match(it.trail)
+}
+
+// splitArray breaks arr into items, plus the extra before the closing bracket
+// that follows the last item's line, and whether arr has a trailing comma.
+func splitArray(arr *hujson.Array) (items []arrayItem, tail hujson.Extra, trailingComma bool) {
+	n := len(arr.Elements)
+	trailingComma = n > 0 && arr.Elements[n-1].AfterExtra != nil
+	for i, el := range arr.Elements {
+		it := arrayItem{value: el.Value, lead: el.BeforeExtra, after: el.AfterExtra}
+		if i > 0 {
+			items[i-1].trail, it.lead = cutLine(el.BeforeExtra)
+		}
+		items = append(items, it)
+	}
+	tail = arr.AfterExtra
+	if n > 0 {
+		items[n-1].trail, tail = cutLine(arr.AfterExtra)
+	}
+	return items, tail, trailingComma
+}
+
+// cutLine splits extra at its first newline into the comment ending the
+// current line and everything after it. Without a comment, all of extra is
+// left as rest.
+func cutLine(extra hujson.Extra) (line, rest hujson.Extra) {
+	line, rest = extra, nil
+	if i := bytes.IndexByte(extra, '\n'); i >= 0 {
+		line, rest = extra[:i], extra[i:]
+	}
+	if len(bytes.TrimSpace(line)) == 0 {
+		return nil, extra
+	}
+	return line, rest
+}
+
+// joinArray builds an array from items, the inverse of splitArray.
+func joinArray(items []arrayItem, tail hujson.Extra, trailingComma bool) *hujson.Array {
+	arr := &hujson.Array{Elements: make([]hujson.Value, 0, len(items))}
+	var trail hujson.Extra
+	for _, it := range items {
+		arr.Elements = append(arr.Elements, hujson.Value{
+			BeforeExtra: concatExtra(trail, it.lead),
+			Value:       it.value,
+			AfterExtra:  it.after,
+		})
+		trail = it.trail
+	}
+	if n := len(arr.Elements); n > 0 {
+		last := &arr.Elements[n-1]
+		switch {
+		case trailingComma && last.AfterExtra == nil:
+			last.AfterExtra = hujson.Extra{}
+		case !trailingComma:
+			tail = concatExtra(last.AfterExtra, concatExtra(trail, tail))
+			trail = nil
+			last.AfterExtra = nil
+		}
+	}
+	arr.AfterExtra = concatExtra(trail, tail)
+	return arr
+}
+
+func concatExtra(a, b hujson.Extra) hujson.Extra {
+	if len(a) == 0 {
+		return b
+	}
+	return append(append(hujson.Extra{}, a...), b...)
+}
+
+// mergeArray merges source members into the template array tmpl following
+// strategy. Template elements that are kept stay with their comments and
+// layout; new members follow them in source order, laid out like the existing
+// elements. A member already in the kept template elements isn't added again.
+func mergeArray(tmpl hujson.ValueTrimmed, members []string, strategy string) *hujson.Array {
+	arr, ok := tmpl.(*hujson.Array)
+	if !ok || strategy == MergeReplace || strategy == "" {
+		return buildArray(members)
+	}
+
+	items, tail, trailingComma := splitArray(arr)
+	sep := elementSeparator(items)
+
+	kept := items[:0:0]
+	seen := map[string]bool{}
+	for _, it := range items {
+		if strategy == MergePinned && !it.pinned() {
+			continue
+		}
+		kept = append(kept, it)
+		seen[it.name()] = true
+	}
+	for _, m := range members {
+		if seen[m] {
+			continue
+		}
+		seen[m] = true
+		lead := sep
+		if len(kept) == 0 {
+			lead = firstLead(items)
+		}
+		kept = append(kept, arrayItem{value: hujson.String(m), lead: lead})
+	}
+	return joinArray(kept, tail, trailingComma)
+}
+
+// elementSeparator returns the whitespace to put before an added element: the
+// indentation of the existing elements for a multi-line array, else the
+// spacing between the first elements.
+func elementSeparator(items []arrayItem) hujson.Extra {
+	switch {
+	case len(items) == 0:
+		return nil
+	case bytes.IndexByte(items[len(items)-1].lead, '\n') >= 0:
+		return indentation(items[len(items)-1].lead)
+	case len(items) > 1 && len(bytes.TrimSpace(items[1].lead)) == 0:
+		return bytes.Clone(items[1].lead)
+	}
+	return nil
+}
+
+// firstLead returns the whitespace before the first element of the template,
+// without comments, for a new first element.
+func firstLead(items []arrayItem) hujson.Extra {
+	if len(items) == 0 {
+		return nil
+	}
+	return indentation(items[0].lead)
+}
+
+// indentation returns a newline and the whitespace that starts the last line
+// of lead, or nil if lead has a single line.
+func indentation(lead hujson.Extra) hujson.Extra {
+	i := bytes.LastIndexByte(lead, '\n')
+	if i < 0 {
+		return nil
+	}
+	line := lead[i:]
+	n := 1
+	for n < len(line) && (line[n] == ' ' || line[n] == '\t') {
+		n++
+	}
+	return bytes.Clone(line[:n])
+}
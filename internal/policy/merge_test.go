@@ -0,0 +1,111 @@
+package policy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mergeWrite reads template, stages groups with the given merge strategies and
+// returns the HuJSON output.
+func mergeWrite(t *testing.T, template string, staged map[string][]string, strategy string, perGroup map[string]string) string {
+	t.Helper()
+	p := Policy{}
+	if err := p.ReadPolicyFromFile(writeTemp(t, "in.hjson", template)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := p.SetMerge(strategy, perGroup); err != nil {
+		t.Fatalf("SetMerge: %v", err)
+	}
+	p.AppendGroups(staged)
+	out := filepath.Join(t.TempDir(), "out.hjson")
+	if err := p.WritePolicyToFile(out, FormatHJSON); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	raw, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatalf("read output: %v", err)
+	}
+	return string(raw)
+}
+
+const mergeTemplate = `{
+  "groups": {
+    // admins
+    "group:admins": [
+      "root@", // pin
+      "old@",
+      /* pin */ "breakglass@",
+    ],
+    "group:ops": ["ops@", "bob@"],
+  },
+}`
+
+func TestMerge_Pinned(t *testing.T) {
+	got := mergeWrite(t, mergeTemplate, map[string][]string{
+		"group:admins": {"alice@", "breakglass@"},
+	}, MergePinned, nil)
+	want := `{
+  "groups": {
+    // admins
+    "group:admins": [
+      "root@", // pin
+      /* pin */ "breakglass@",
+      "alice@",
+    ],
+    "group:ops": ["ops@", "bob@"],
+  },
+}`
+	if got != want {
+		t.Errorf("pinned merge:\n--- want ---\n%s\n--- got ---\n%s", want, got)
+	}
+}
+
+func TestMerge_UnionAndPerGroup(t *testing.T) {
+	got := mergeWrite(t, mergeTemplate, map[string][]string{
+		"group:admins": {"alice@"},
+		"group:ops":    {"bob@", "carol@"},
+	}, MergeReplace, map[string]string{"group:ops": MergeUnion})
+	want := `{
+  "groups": {
+    // admins
+    "group:admins": ["alice@"],
+    "group:ops": ["ops@", "bob@", "carol@"],
+  },
+}`
+	if got != want {
+		t.Errorf("union merge:\n--- want ---\n%s\n--- got ---\n%s", want, got)
+	}
+}
+
+func TestMerge_UnionKeepsLastLineComment(t *testing.T) {
+	tmpl := `{"groups": {"group:admins": [
+  "root@" // break-glass account
+]}}`
+	got := mergeWrite(t, tmpl, map[string][]string{"group:admins": {"alice@"}}, MergeUnion, nil)
+	want := `{"groups": {"group:admins": [
+  "root@", // break-glass account
+  "alice@"
+]}}`
+	if got != want {
+		t.Errorf("union merge:\n--- want ---\n%s\n--- got ---\n%s", want, got)
+	}
+}
+
+func TestMerge_PinnedWithoutPins(t *testing.T) {
+	got := mergeWrite(t, `{"groups": {"group:ops": ["ops@"]}}`,
+		map[string][]string{"group:ops": {"alice@", "bob@"}}, MergePinned, nil)
+	if want := `{"groups": {"group:ops": ["alice@","bob@"]}}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestSetMerge_Invalid(t *testing.T) {
+	p := Policy{}
+	if err := p.SetMerge("merge", nil); err == nil {
+		t.Errorf("an unknown default strategy must be rejected")
+	}
+	if err := p.SetMerge("", map[string]string{"group:ops": "keep"}); err == nil {
+		t.Errorf("an unknown group strategy must be rejected")
+	}
+}
@@ -3,11 +3,13 @@ package policy
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 
 	"github.com/tailscale/hujson"
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
 )
 
 // Supported output formats. FormatAuto picks hjson or json by inspecting the
@@ -44,6 +46,17 @@ type Policy struct {
 	// (e.g. "group:ops"). AppendGroups fills it; WritePolicyToFile applies it.
 	staged map[string][]string
 
+	// merge is the default merge strategy for staged groups and groupMerge
+	// the per-group ones, by full group name (see SetMerge).
+	merge      string
+	groupMerge map[string]string
+
+	// order is the member order applied by AppendGroups (see SetMemberOrder)
+	// and wrap the member count above which HuJSON arrays are written one
+	// member per line, 0 for never (see SetWrap).
+	order string
+	wrap  int
+
 	// inputStrictJSON records whether the raw template parsed as strict
 	// RFC-8259 JSON (no comments or trailing commas). FormatAuto uses it to
 	// decide the output format.
@@ -57,10 +70,18 @@ func (p *Policy) ReadPolicyFromFile(path string) error {
 	if err != nil {
 		return err
 	}
+	return p.parse(data)
+}
+
+// parse parses a policy template from data.
+func (p *Policy) parse(data []byte) error {
 	ast, err := hujson.Parse(data)
 	if err != nil {
 		return err
 	}
+	if _, ok := ast.Value.(*hujson.Object); !ok {
+		return errors.New("policy must be a JSON object")
+	}
 	p.ast = ast
 	// json.Valid is the precise hjson-vs-json discriminator: it rejects the
 	// comments and trailing commas that only HuJSON allows.
@@ -102,8 +123,9 @@ func (p *Policy) groupsObject() *hujson.Object {
 }
 
 // GetGroupNames returns the bare group names declared in the template (the
-// "group:" prefix stripped), used to query the identity source. Names without
-// a prefix are skipped.
+// "group:" prefix stripped), used to query the identity source. Only the first
+// colon separates the prefix, so "group:app:admin" yields "app:admin". Names
+// without a prefix are skipped.
 func (p *Policy) GetGroupNames() []string {
 	obj := p.groupsObject()
 	if obj == nil {
@@ -115,67 +137,111 @@ func (p *Policy) GetGroupNames() []string {
 		if !ok {
 			continue
 		}
-		parts := strings.Split(lit.String(), ":")
-		if len(parts) >= 2 {
-			groups = append(groups, parts[1])
+		if _, name, ok := strings.Cut(lit.String(), ":"); ok {
+			groups = append(groups, name)
 		}
 	}
 	return groups
 }
 
 // AppendGroups stages group members to be written. Keys are full group names
-// (e.g. "group:ops"), matching the template's group keys.
+// (e.g. "group:ops"), matching the template's group keys. Duplicate members
+// are dropped and the rest ordered as set by SetMemberOrder.
 func (p *Policy) AppendGroups(groups map[string][]string) {
 	if p.staged == nil {
 		p.staged = make(map[string][]string)
 	}
 	for g, u := range groups {
-		p.staged[g] = u
+		p.staged[g] = orderMembers(u, p.order)
 	}
 }
 
-// WritePolicyToFile applies the staged group members to the AST — replacing
-// only those groups' value arrays — and writes the result to disk in the given
-// format (FormatHJSON, FormatJSON, or FormatAuto). Groups not staged (e.g. not
-// found in the source) keep their template value, comments, and formatting
-// untouched.
+// WritePolicyToFile applies the staged group members to the AST — merging
+// them into only those groups' value arrays with the group's merge strategy —
+// and writes the result to disk in the given format (FormatHJSON, FormatJSON,
+// or FormatAuto). Groups not staged (e.g. not found in the source) keep their
+// template value, comments, and formatting untouched. The file is replaced
+// atomically.
 func (p *Policy) WritePolicyToFile(path, format string) error {
-	format = p.ResolveFormat(format)
-	if format != FormatHJSON && format != FormatJSON {
-		return fmt.Errorf("invalid output format %q: must be %q, %q, or %q", format, FormatAuto, FormatHJSON, FormatJSON)
+	data, err := p.Render(format)
+	if err != nil {
+		return err
 	}
 
-	if obj := p.groupsObject(); obj != nil && len(p.staged) > 0 {
-		for i := range obj.Members {
-			lit, ok := obj.Members[i].Name.Value.(hujson.Literal)
-			if !ok {
-				continue
-			}
-			members, staged := p.staged[lit.String()]
-			if !staged {
-				continue
-			}
-			// Replace only the value; the node's BeforeExtra/AfterExtra
-			// (surrounding spacing and inline comments) are left intact.
-			obj.Members[i].Value.Value = buildArray(members)
-		}
+	// Write atomically: Headscale may load the file at any time and must
+	// never see a truncated policy. An existing file keeps its mode.
+	perm := os.FileMode(0o600)
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
 	}
+	return tools.WriteFileAtomic(path, data, perm)
+}
 
-	data, err := p.serialize(format)
-	if err != nil {
-		return err
+// Render applies the staged group members like WritePolicyToFile and returns
+// the policy it would write.
+func (p *Policy) Render(format string) ([]byte, error) {
+	format = p.ResolveFormat(format)
+	if format != FormatHJSON && format != FormatJSON {
+		return nil, fmt.Errorf("invalid output format %q: must be %q, %q, or %q", format, FormatAuto, FormatHJSON, FormatJSON)
 	}
+	p.applyStaged()
+	return p.serialize(format)
+}
 
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
-	if err != nil {
-		return err
+// applyStaged merges the staged members into the group arrays of the AST.
+// Merging is idempotent, so applying the same staged groups again doesn't
+// change the result.
+func (p *Policy) applyStaged() {
+	obj := p.groupsObject()
+	if obj == nil || len(p.staged) == 0 {
+		return
+	}
+	for i := range obj.Members {
+		lit, ok := obj.Members[i].Name.Value.(hujson.Literal)
+		if !ok {
+			continue
+		}
+		members, staged := p.staged[lit.String()]
+		if !staged {
+			continue
+		}
+		// Replace only the value; the node's BeforeExtra/AfterExtra
+		// (surrounding spacing and inline comments) are left intact.
+		value := &obj.Members[i].Value
+		arr := mergeArray(value.Value, members, p.mergeStrategy(lit.String()))
+		if p.wrap > 0 && len(arr.Elements) > p.wrap {
+			wrapArray(arr, lineIndent(obj.Members[i].Name.BeforeExtra))
+		}
+		value.Value = arr
 	}
-	defer f.Close()
+}
 
-	if _, err := f.Write(data); err != nil {
-		return err
+// Groups returns the members of every group in the policy, by full group
+// name, as WritePolicyToFile would write them. Elements that aren't strings
+// are left out.
+func (p *Policy) Groups() map[string][]string {
+	p.applyStaged()
+	groups := map[string][]string{}
+	obj := p.groupsObject()
+	if obj == nil {
+		return groups
 	}
-	return nil
+	for i := range obj.Members {
+		lit, ok := obj.Members[i].Name.Value.(hujson.Literal)
+		if !ok {
+			continue
+		}
+		members := []string{}
+		if arr, ok := obj.Members[i].Value.Value.(*hujson.Array); ok {
+			for _, el := range arr.Elements {
+				if s, ok := el.Value.(hujson.Literal); ok && s.Kind() == '"' {
+					members = append(members, s.String())
+				}
+			}
+		}
+		groups[lit.String()] = members
+	}
+	return groups
 }
 
 // serialize renders the already-mutated AST in the requested format.
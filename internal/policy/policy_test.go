@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"reflect"
 	"sort"
 	"strings"
 	"testing"
@@ -198,7 +199,7 @@ func TestReadPolicyFromFile_ParsesHJSON(t *testing.T) {
 	got := p.GetGroupNames()
 	sort.Strings(got)
 	want := []string{"admins", "devs"}
-	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("GetGroupNames = %v, want %v", got, want)
 	}
 }
@@ -208,6 +209,7 @@ func TestGetGroupNames_StripsPrefixSkipsMalformed(t *testing.T) {
   "groups": {
     "group:admins": [],
     "group:devs":   [],
+    "group:app:ops": [],
     "malformed":    [],
   }
 }`)
@@ -217,8 +219,8 @@ func TestGetGroupNames_StripsPrefixSkipsMalformed(t *testing.T) {
 	}
 	got := p.GetGroupNames()
 	sort.Strings(got)
-	want := []string{"admins", "devs"}
-	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+	want := []string{"admins", "app:ops", "devs"}
+	if !reflect.DeepEqual(got, want) {
 		t.Errorf("GetGroupNames = %v, want %v", got, want)
 	}
 }
@@ -613,3 +615,26 @@ func TestWriteAuto_DetectsFormat(t *testing.T) {
 		t.Errorf("auto on hjson input should preserve comments:\n%s", hjsonOut)
 	}
 }
+
+func TestWritePolicyToFile_KeepsModeAndLeavesNoTempFiles(t *testing.T) {
+	dir := t.TempDir()
+	in := writeTemp(t, "in.hjson", sampleHJSON)
+	out := filepath.Join(dir, "out.hjson")
+	if err := os.WriteFile(out, []byte("old"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	p := Policy{}
+	if err := p.ReadPolicyFromFile(in); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := p.WritePolicyToFile(out, FormatHJSON); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if fi, err := os.Stat(out); err != nil || fi.Mode().Perm() != 0o644 {
+		t.Errorf("output mode = %v, %v; want 0644 kept", fi.Mode().Perm(), err)
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("temporary files left behind: %v", entries)
+	}
+}
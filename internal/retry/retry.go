@@ -0,0 +1,122 @@
+// Package retry holds the retry policy shared by the source adapters and the
+// Headscale API client, and the classification of transient errors that is
+// common to both.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"time"
+)
+
+// StatusError carries the HTTP status of a failed API call, so callers can
+// tell transient failures from permanent ones.
+type StatusError struct {
+	Code int
+	Err  error
+}
+
+func (e *StatusError) Error() string { return e.Err.Error() }
+func (e *StatusError) Unwrap() error { return e.Err }
+
+// WithStatus attaches the status code of resp to err. Errors without a
+// response (network failures) are returned unchanged.
+func WithStatus(resp *http.Response, err error) error {
+	if err == nil || resp == nil {
+		return err
+	}
+	return &StatusError{Code: resp.StatusCode, Err: err}
+}
+
+// Policy configures the retries of Do.
+type Policy struct {
+	MaxAttempts int           // per call, including the first; <= 1 disables retries
+	BaseDelay   time.Duration // wait before the first retry, doubled after each attempt
+	MaxDelay    time.Duration // cap for the wait between attempts
+	Jitter      float64       // random share (0..1) taken off each wait
+	// Retryable decides whether an error is worth another attempt. Nil means
+	// IsRetryable.
+	Retryable func(error) bool
+}
+
+// Default returns the policy used by the CLI.
+func Default() Policy {
+	return Policy{
+		MaxAttempts: 3,
+		BaseDelay:   500 * time.Millisecond,
+		MaxDelay:    10 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+// Delay returns the wait after the given failed attempt (1-based).
+func (p Policy) Delay(attempt int) time.Duration {
+	d := p.BaseDelay << min(attempt-1, 30)
+	if p.MaxDelay > 0 && (d > p.MaxDelay || d <= 0) {
+		d = p.MaxDelay
+	}
+	if p.Jitter > 0 && d > 0 {
+		d -= time.Duration(rand.Float64() * min(p.Jitter, 1) * float64(d))
+	}
+	return d
+}
+
+// IsRetryable reports whether err looks transient: network failures and
+// HTTP 408, 429 and 5xx responses. Context errors and everything else are
+// fatal.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return IsRetryableStatus(statusErr.Code)
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// IsRetryableStatus reports whether an HTTP status is worth another attempt:
+// 408, 429 and 5xx.
+func IsRetryableStatus(code int) bool {
+	return code == http.StatusRequestTimeout || code == http.StatusTooManyRequests || code >= 500
+}
+
+// Do runs call until it succeeds, fails with an error p doesn't retry, or the
+// attempts are used up, waiting between attempts. Cancelling ctx stops it
+// with ctx's error.
+func (p Policy) Do(ctx context.Context, call func() error) error {
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	attempts := max(p.MaxAttempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil || !retryable(err) {
+			return err
+		}
+		if attempt >= attempts {
+			if attempt == 1 {
+				return err
+			}
+			return fmt.Errorf("giving up after %d attempts: %w", attempt, err)
+		}
+
+		timer := time.NewTimer(p.Delay(attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"http 503", &StatusError{Code: 503, Err: errors.New("503")}, true},
+		{"http 429 wrapped", fmt.Errorf("list: %w", &StatusError{Code: 429, Err: errors.New("429")}), true},
+		{"http 408", &StatusError{Code: 408, Err: errors.New("408")}, true},
+		{"http 404", &StatusError{Code: 404, Err: errors.New("404")}, false},
+		{"net", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"canceled", context.Canceled, false},
+		{"deadline", fmt.Errorf("x: %w", context.DeadlineExceeded), false},
+		{"other", errors.New("boom"), false},
+		{"nil", nil, false},
+	}
+	for _, tc := range cases {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Errorf("%s: IsRetryable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestPolicy_Delay(t *testing.T) {
+	p := Policy{BaseDelay: 100 * time.Millisecond, MaxDelay: time.Second}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 4: 800 * time.Millisecond, 5: time.Second, 80: time.Second} {
+		if got := p.Delay(attempt); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", attempt, got, want)
+		}
+	}
+
+	p.Jitter = 0.5
+	for range 100 {
+		if d := p.Delay(2); d <= 100*time.Millisecond || d > 200*time.Millisecond {
+			t.Fatalf("jittered delay %v outside (100ms, 200ms]", d)
+		}
+	}
+}
+
+func TestPolicy_Do(t *testing.T) {
+	p := Policy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	transient := &StatusError{Code: 503, Err: errors.New("503")}
+
+	calls := 0
+	err := p.Do(t.Context(), func() error {
+		calls++
+		return transient
+	})
+	if !errors.Is(err, transient) || calls != 3 {
+		t.Errorf("expected 3 calls and the last error, got %d calls, err %v", calls, err)
+	}
+
+	calls = 0
+	err = p.Do(t.Context(), func() error {
+		calls++
+		return &StatusError{Code: 404, Err: errors.New("404")}
+	})
+	if err == nil || calls != 1 {
+		t.Errorf("a fatal error must not be retried, got %d calls, err %v", calls, err)
+	}
+}
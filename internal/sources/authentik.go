@@ -9,13 +9,27 @@ import (
 	"strings"
 
 	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
 	"github.com/yousysadmin/headscale-pf/pkg/tools"
 	api "goauthentik.io/api/v3"
 )
 
+// Page sizes for the Authentik list endpoints, and how many group PKs are
+// sent in one groups_by_pk users query.
+const (
+	akPageSize        = 100
+	akGroupsPerFilter = 20
+)
+
 // Authentik source
 type Authentik struct {
 	V3 *api.APIClient
+
+	// includeChildren adds the members of all descendant (child) groups.
+	includeChildren bool
+	// pagedMembers lists members through the paged users endpoint instead of
+	// embedding them in the group response.
+	pagedMembers bool
 }
 
 // NewAuthentikClient init Authentik source
@@ -44,38 +58,134 @@ func NewAuthentikClient(config SourceConfig) (*Authentik, error) {
 	akConf.HTTPClient = &http.Client{Transport: transport}
 	akConf.AddDefaultHeader("Authorization", fmt.Sprintf("Bearer %s", config.Token))
 
-	return &Authentik{V3: api.NewAPIClient(akConf)}, nil
+	return &Authentik{
+		V3:              api.NewAPIClient(akConf),
+		includeChildren: config.AuthentikIncludeChildren,
+		pagedMembers:    config.AuthentikPagedMembers,
+	}, nil
 }
 
-// GetGroupByName fetches the group and its members in a single API call.
-// The returned Group has Users populated (possibly empty but never nil) so
-// the caller can skip GetGroupMembers.
-func (c *Authentik) GetGroupByName(groupName string) (*models.Group, error) {
-	req, _, err := c.V3.CoreApi.CoreGroupsList(context.Background()).
-		Name(groupName).
-		IncludeUsers(true).
-		Execute()
-	if err != nil {
-		return nil, err
+// GetGroupByName looks the group up by exact name across all results. By
+// default its members are fetched in the same call and the returned Group
+// has Users populated (possibly empty but never nil) so the caller can skip
+// GetGroupMembers. With child groups or paged members enabled Users is left
+// nil and the members are listed by GetGroupMembers.
+func (c *Authentik) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
+	embedUsers := !c.includeChildren && !c.pagedMembers
+
+	var matches []api.Group
+	for page := int32(1); ; page++ {
+		req, resp, err := c.V3.CoreApi.CoreGroupsList(ctx).
+			Name(groupName).
+			IncludeUsers(embedUsers).
+			Page(page).
+			PageSize(akPageSize).
+			Execute()
+		if err != nil {
+			return nil, retry.WithStatus(resp, err)
+		}
+		for _, g := range req.Results {
+			if g.GetName() == groupName {
+				matches = append(matches, g)
+			}
+		}
+		if req.Pagination.Next <= 0 {
+			break
+		}
 	}
 
-	if len(req.Results) == 0 {
+	switch len(matches) {
+	case 0:
 		return nil, nil
+	case 1:
+	default:
+		pks := make([]string, len(matches))
+		for i, g := range matches {
+			pks[i] = g.GetPk()
+		}
+		return nil, fmt.Errorf("authentik: group name %q is ambiguous, matches groups %s", groupName, strings.Join(pks, ", "))
 	}
 
-	return toGroup(req.Results[0]), nil
+	if !embedUsers {
+		return &models.Group{ID: matches[0].GetPk(), Name: matches[0].GetName()}, nil
+	}
+	return toGroup(matches[0]), nil
 }
 
-// GetGroupMembers re-fetches the group by PK and returns its members. Acts as
-// a fallback for callers that hold a groupID without the embedded users.
-func (c *Authentik) GetGroupMembers(groupID string) ([]models.User, error) {
-	g, _, err := c.V3.CoreApi.CoreGroupsRetrieve(context.Background(), groupID).
-		IncludeUsers(true).
-		Execute()
-	if err != nil {
-		return nil, err
+// GetGroupMembers returns the members of the group with the given PK and,
+// with child groups enabled, of all its descendants. Without either option
+// it re-fetches the group with its embedded members.
+func (c *Authentik) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	if !c.includeChildren && !c.pagedMembers {
+		g, resp, err := c.V3.CoreApi.CoreGroupsRetrieve(ctx, groupID).
+			IncludeUsers(true).
+			Execute()
+		if err != nil {
+			return nil, retry.WithStatus(resp, err)
+		}
+		return toGroup(*g).Users, nil
+	}
+
+	groupIDs := []string{groupID}
+	if c.includeChildren {
+		var err error
+		groupIDs, err = c.descendantGroupIDs(ctx, groupID)
+		if err != nil {
+			return nil, err
+		}
 	}
-	return toGroup(*g).Users, nil
+
+	users := make([]models.User, 0)
+	seen := make(map[string]struct{})
+	for start := 0; start < len(groupIDs); start += akGroupsPerFilter {
+		chunk := groupIDs[start:min(start+akGroupsPerFilter, len(groupIDs))]
+		for page := int32(1); ; page++ {
+			req, resp, err := c.V3.CoreApi.CoreUsersList(ctx).
+				GroupsByPk(chunk).
+				Page(page).
+				PageSize(akPageSize).
+				Execute()
+			if err != nil {
+				return nil, fmt.Errorf("authentik: list members (page %d): %w", page, retry.WithStatus(resp, err))
+			}
+			for _, u := range req.Results {
+				if _, dup := seen[u.Uid]; dup {
+					continue
+				}
+				seen[u.Uid] = struct{}{}
+				users = append(users, toModelUserAK(u.Uid, u.Username, u.Email, u.IsActive))
+			}
+			if req.Pagination.Next <= 0 {
+				break
+			}
+		}
+	}
+	return users, nil
+}
+
+// descendantGroupIDs returns groupID followed by the PKs of all its
+// descendants, breadth-first. A group reachable through several parents is
+// listed once.
+func (c *Authentik) descendantGroupIDs(ctx context.Context, groupID string) ([]string, error) {
+	ids := []string{groupID}
+	seen := map[string]struct{}{groupID: {}}
+	for i := 0; i < len(ids); i++ {
+		g, resp, err := c.V3.CoreApi.CoreGroupsRetrieve(ctx, ids[i]).
+			IncludeUsers(false).
+			IncludeChildren(true).
+			Execute()
+		if err != nil {
+			return nil, fmt.Errorf("authentik: get child groups of %s: %w", ids[i], retry.WithStatus(resp, err))
+		}
+		for _, child := range g.Children {
+			if _, ok := seen[child]; ok {
+				continue
+			}
+			seen[child] = struct{}{}
+			ids = append(ids, child)
+		}
+	}
+	return ids, nil
 }
 
 // toGroup converts an Authentik Group response to models.Group with users
@@ -84,19 +194,7 @@ func (c *Authentik) GetGroupMembers(groupID string) ([]models.User, error) {
 func toGroup(g api.Group) *models.Group {
 	users := make([]models.User, 0, len(g.GetUsersObj()))
 	for _, u := range g.GetUsersObj() {
-		userName := u.Username
-		if !strings.Contains(userName, "@") {
-			userName += "@"
-		}
-		email := ""
-		if u.Email != nil {
-			email = *u.Email
-		}
-		users = append(users, models.User{
-			ID:       u.Uid,
-			Email:    email,
-			Username: userName,
-		})
+		users = append(users, toModelUserAK(u.Uid, u.Username, u.Email, u.IsActive))
 	}
 	return &models.Group{
 		ID:    g.GetPk(),
@@ -104,3 +202,24 @@ func toGroup(g api.Group) *models.Group {
 		Users: users,
 	}
 }
+
+// toModelUserAK maps the fields shared by Authentik's User and PartialUser.
+func toModelUserAK(uid, username string, email *string, isActive *bool) models.User {
+	e := ""
+	if email != nil {
+		e = *email
+	}
+	status := models.UserStatusUnknown
+	if isActive != nil {
+		status = models.UserStatusDisabled
+		if *isActive {
+			status = models.UserStatusActive
+		}
+	}
+	return models.User{
+		ID:       uid,
+		Email:    e,
+		Username: username,
+		Status:   status,
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -13,20 +14,35 @@ import (
 //
 //	GET /api/v3/core/groups/?name=X&include_users=true
 //	GET /api/v3/core/groups/{uuid}/?include_users=true
+//	GET /api/v3/core/users/?groups_by_pk=X&groups_by_pk=Y&page=N&page_size=N
 //
-// groupsByName feeds the list endpoint; groupsByPk feeds the retrieve endpoint.
+// groupsByName feeds the list endpoint; groupsByPk feeds the retrieve endpoint
+// and, through each group's Users, the users endpoint.
 type authentikTestServer struct {
 	groupsByName     map[string]akGroup
+	similarByName    map[string][]akGroup // extra list results for a name, e.g. case variants
 	groupsByPk       map[string]akGroup
 	listCalls        int32
 	retrieveCalls    int32
+	userListCalls    int32
 	includeUsersSeen bool
 }
 
 type akGroup struct {
-	Pk    string  `json:"pk"`
-	Name  string  `json:"name"`
-	Users []akUsr `json:"users_obj"`
+	Pk       string   `json:"pk"`
+	Name     string   `json:"name"`
+	Users    []akUsr  `json:"users_obj"`
+	Children []string `json:"children"`
+}
+
+// akPagination builds Authentik's pagination block for page (1-based) of n
+// items in pages of size.
+func akPagination(page, size, n int) map[string]float32 {
+	next := 0
+	if page*size < n {
+		next = page + 1
+	}
+	return map[string]float32{"next": float32(next), "previous": float32(page - 1), "count": float32(n), "current": float32(page), "total_pages": float32((n + size - 1) / max(size, 1)), "start_index": 1, "end_index": float32(n)}
 }
 
 type akUsr struct {
@@ -49,6 +65,7 @@ func (s *authentikTestServer) handler(t *testing.T) http.Handler {
 			atomic.AddInt32(&s.listCalls, 1)
 			name := r.URL.Query().Get("name")
 			results := []akGroup{}
+			results = append(results, s.similarByName[name]...)
 			if g, ok := s.groupsByName[name]; ok {
 				results = append(results, g)
 			}
@@ -58,6 +75,29 @@ func (s *authentikTestServer) handler(t *testing.T) http.Handler {
 				"autocomplete": map[string]any{},
 			})
 
+		case r.URL.Path == "/api/v3/core/users/":
+			atomic.AddInt32(&s.userListCalls, 1)
+			var users []akUsr
+			seen := map[string]bool{}
+			for _, pk := range r.URL.Query()["groups_by_pk"] {
+				for _, u := range s.groupsByPk[pk].Users {
+					if !seen[u.Uid] {
+						seen[u.Uid] = true
+						users = append(users, u)
+					}
+				}
+			}
+			page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+			size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+			page, size = max(page, 1), max(size, 1)
+			lo := min((page-1)*size, len(users))
+			hi := min(lo+size, len(users))
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"pagination":   akPagination(page, size, len(users)),
+				"results":      append([]akUsr{}, users[lo:hi]...),
+				"autocomplete": map[string]any{},
+			})
+
 		case strings.HasPrefix(r.URL.Path, "/api/v3/core/groups/") && strings.HasSuffix(r.URL.Path, "/"):
 			atomic.AddInt32(&s.retrieveCalls, 1)
 			parts := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
@@ -108,7 +148,7 @@ func TestAuthentik_GetGroupByName_PopulatesUsersInOneCall(t *testing.T) {
 	defer srv.Close()
 
 	c := newAuthentikTestClient(t, srv)
-	g, err := c.GetGroupByName("engineering")
+	g, err := c.GetGroupByName(t.Context(), "engineering")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -121,11 +161,11 @@ func TestAuthentik_GetGroupByName_PopulatesUsersInOneCall(t *testing.T) {
 	if len(g.Users) != 2 {
 		t.Fatalf("expected 2 users in returned group (B4 contract: GetGroupByName populates Users), got %d", len(g.Users))
 	}
-	if g.Users[0].Username != "alice@" {
-		t.Errorf("alice should get @ suffix, got %q", g.Users[0].Username)
+	if g.Users[0].Username != "alice" {
+		t.Errorf("alice should keep the raw username, got %q", g.Users[0].Username)
 	}
 	if g.Users[1].Username != "bob@corp" {
-		t.Errorf("bob should not be double-suffixed, got %q", g.Users[1].Username)
+		t.Errorf("bob should be kept as is, got %q", g.Users[1].Username)
 	}
 
 	if state.listCalls != 1 {
@@ -145,7 +185,7 @@ func TestAuthentik_GetGroupByName_NotFound(t *testing.T) {
 	defer srv.Close()
 
 	c := newAuthentikTestClient(t, srv)
-	g, err := c.GetGroupByName("ghost")
+	g, err := c.GetGroupByName(t.Context(), "ghost")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -170,7 +210,7 @@ func TestAuthentik_GetGroupByName_NilEmailDoesNotPanic(t *testing.T) {
 	defer srv.Close()
 
 	c := newAuthentikTestClient(t, srv)
-	g, err := c.GetGroupByName("team") // must not panic
+	g, err := c.GetGroupByName(t.Context(), "team") // must not panic
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -194,7 +234,7 @@ func TestAuthentik_GetGroupByName_EmptyGroupReturnsNonNilUsers(t *testing.T) {
 	defer srv.Close()
 
 	c := newAuthentikTestClient(t, srv)
-	g, err := c.GetGroupByName("empty-team")
+	g, err := c.GetGroupByName(t.Context(), "empty-team")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -225,14 +265,135 @@ func TestAuthentik_GetGroupMembers_FallbackByPK(t *testing.T) {
 	defer srv.Close()
 
 	c := newAuthentikTestClient(t, srv)
-	users, err := c.GetGroupMembers("pk-eng")
+	users, err := c.GetGroupMembers(t.Context(), "pk-eng")
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
-	if len(users) != 1 || users[0].Username != "carol@" {
+	if len(users) != 1 || users[0].Username != "carol" {
 		t.Errorf("retrieve fallback wrong: %+v", users)
 	}
 	if state.retrieveCalls != 1 {
 		t.Errorf("expected one /core/groups/{pk}/ call, got %d", state.retrieveCalls)
 	}
 }
+
+func TestAuthentik_GetGroupByName_ExactMatchAcrossResults(t *testing.T) {
+	state := &authentikTestServer{
+		groupsByName: map[string]akGroup{
+			"ops": {Pk: "pk-ops", Name: "ops", Users: []akUsr{}},
+		},
+		similarByName: map[string][]akGroup{
+			"ops": {{Pk: "pk-ops-upper", Name: "Ops", Users: []akUsr{}}},
+		},
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	c := newAuthentikTestClient(t, srv)
+	g, err := c.GetGroupByName(t.Context(), "ops")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.ID != "pk-ops" {
+		t.Errorf("expected the exact-name group behind the first result, got %+v", g)
+	}
+}
+
+func TestAuthentik_GetGroupByName_AmbiguousNameErrors(t *testing.T) {
+	state := &authentikTestServer{
+		groupsByName: map[string]akGroup{
+			"ops": {Pk: "pk-ops-1", Name: "ops", Users: []akUsr{}},
+		},
+		similarByName: map[string][]akGroup{
+			"ops": {{Pk: "pk-ops-2", Name: "ops", Users: []akUsr{}}},
+		},
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	c := newAuthentikTestClient(t, srv)
+	_, err := c.GetGroupByName(t.Context(), "ops")
+	if err == nil || !strings.Contains(err.Error(), "pk-ops-1") || !strings.Contains(err.Error(), "pk-ops-2") {
+		t.Errorf("expected an ambiguity error listing both PKs, got %v", err)
+	}
+}
+
+func mkAKUsers(prefix string, n int) []akUsr {
+	out := make([]akUsr, n)
+	for i := range out {
+		id := prefix + strconv.Itoa(i)
+		out[i] = akUsr{Uid: id, Username: id, Email: sptr(id + "@example.com")}
+	}
+	return out
+}
+
+func TestAuthentik_PagedMembers(t *testing.T) {
+	big := akGroup{Pk: "pk-big", Name: "big", Users: mkAKUsers("u", 250)}
+	state := &authentikTestServer{
+		groupsByName: map[string]akGroup{"big": big},
+		groupsByPk:   map[string]akGroup{"pk-big": big},
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	c := newAuthentikTestClient(t, srv)
+	c.pagedMembers = true
+
+	g, err := c.GetGroupByName(t.Context(), "big")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.Users != nil {
+		t.Fatalf("paged mode must leave Users nil so members are fetched separately, got %+v", g)
+	}
+	if state.includeUsersSeen {
+		t.Error("paged mode must not embed users in the group response")
+	}
+
+	users, err := c.GetGroupMembers(t.Context(), g.ID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(users) != 250 {
+		t.Errorf("expected 250 users, got %d", len(users))
+	}
+	if state.userListCalls != 3 {
+		t.Errorf("expected 3 pages of users, got %d", state.userListCalls)
+	}
+}
+
+func TestAuthentik_IncludeChildren(t *testing.T) {
+	// root -> a -> b, root -> b (b reachable twice), b -> root (cycle).
+	state := &authentikTestServer{
+		groupsByPk: map[string]akGroup{
+			"pk-root": {Pk: "pk-root", Name: "root", Children: []string{"pk-a", "pk-b"},
+				Users: []akUsr{{Uid: "u1", Username: "alice"}}},
+			"pk-a": {Pk: "pk-a", Name: "a", Children: []string{"pk-b"},
+				Users: []akUsr{{Uid: "u2", Username: "bob"}, {Uid: "u1", Username: "alice"}}},
+			"pk-b": {Pk: "pk-b", Name: "b", Children: []string{"pk-root"},
+				Users: []akUsr{{Uid: "u3", Username: "carol"}}},
+			"pk-other": {Pk: "pk-other", Name: "other",
+				Users: []akUsr{{Uid: "u4", Username: "dave"}}},
+		},
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	c := newAuthentikTestClient(t, srv)
+	c.includeChildren = true
+
+	users, err := c.GetGroupMembers(t.Context(), "pk-root")
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	if got, want := strings.Join(names, ","), "alice,bob,carol"; got != want {
+		t.Errorf("members = %s, want %s", got, want)
+	}
+	if state.retrieveCalls != 3 {
+		t.Errorf("each group must be retrieved once, got %d calls", state.retrieveCalls)
+	}
+}
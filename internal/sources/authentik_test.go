@@ -3,13 +3,14 @@ package sources
 import (
 	"testing"
 
+	"github.com/yousysadmin/headscale-pf/internal/models"
 	api "goauthentik.io/api/v3"
 )
 
 func ptr[T any](v T) *T { return &v }
 
 func TestToGroup(t *testing.T) {
-	t.Run("populates Users with @ suffix and nil-safe email", func(t *testing.T) {
+	t.Run("populates Users with raw usernames and nil-safe email", func(t *testing.T) {
 		in := api.Group{
 			Pk:   "pk-1",
 			Name: "admins",
@@ -28,11 +29,11 @@ func TestToGroup(t *testing.T) {
 			t.Fatalf("expected 3 users, got %d", len(got.Users))
 		}
 
-		// alice: @ appended
-		if got.Users[0].Username != "alice@" || got.Users[0].Email != "alice@example.com" {
+		// alice: username as returned by Authentik
+		if got.Users[0].Username != "alice" || got.Users[0].Email != "alice@example.com" {
 			t.Errorf("alice mapped wrong: %+v", got.Users[0])
 		}
-		// bob: already has @, untouched
+		// bob: contains @, untouched
 		if got.Users[1].Username != "bob@corp" {
 			t.Errorf("bob double-suffixed: %q", got.Users[1].Username)
 		}
@@ -40,8 +41,8 @@ func TestToGroup(t *testing.T) {
 		if got.Users[2].Email != "" {
 			t.Errorf("carol email should be empty, got %q", got.Users[2].Email)
 		}
-		if got.Users[2].Username != "carol@" {
-			t.Errorf("carol username = %q, want carol@", got.Users[2].Username)
+		if got.Users[2].Username != "carol" {
+			t.Errorf("carol username = %q, want carol", got.Users[2].Username)
 		}
 	})
 
@@ -55,3 +56,20 @@ func TestToGroup(t *testing.T) {
 		}
 	})
 }
+
+func TestToGroup_UserStatus(t *testing.T) {
+	got := toGroup(api.Group{
+		Pk: "pk-1",
+		UsersObj: []api.PartialUser{
+			{Uid: "u1", Username: "alice", IsActive: ptr(true)},
+			{Uid: "u2", Username: "bob", IsActive: ptr(false)},
+			{Uid: "u3", Username: "carol"},
+		},
+	})
+	want := []models.UserStatus{models.UserStatusActive, models.UserStatusDisabled, models.UserStatusUnknown}
+	for i, u := range got.Users {
+		if u.Status != want[i] {
+			t.Errorf("%s: Status = %q, want %q", u.Username, u.Status, want[i])
+		}
+	}
+}
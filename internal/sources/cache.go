@@ -0,0 +1,249 @@
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
+)
+
+// cacheVersion is bumped when the cache file layout changes; files with
+// another version are ignored.
+const cacheVersion = 1
+
+// CacheConfig configures the on-disk cache added by WithCache.
+type CacheConfig struct {
+	Path string // cache file
+	// TTL is how long a cached result is served without asking the source.
+	// 0 always asks the source and uses the cache only as a fallback.
+	TTL time.Duration
+	// MaxStale is the maximum age of a cached result served when the source
+	// fails. 0 disables the fallback.
+	MaxStale time.Duration
+	// Offline serves only cached results, whatever their age, and never
+	// contacts the source.
+	Offline bool
+	// Warn receives a message whenever stale or offline data is served.
+	Warn func(msg string)
+}
+
+// Flusher is implemented by sources that buffer data to write at the end of
+// a run, such as the cache added by WithCache.
+type Flusher interface {
+	Flush() error
+}
+
+// Flush flushes src if it is a Flusher.
+func Flush(src Source) error {
+	if f, ok := src.(Flusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// WithCache caches source results on disk; results are kept in memory until
+// Flush. Wrapping happens after WithRetry and WithCircuitBreaker, so the
+// cache only steps in once those gave up.
+func WithCache(c CacheConfig) Option {
+	return func(o *sourceOptions) { o.cache = &c }
+}
+
+// cacheFile is the on-disk layout of the cache.
+type cacheFile struct {
+	Version int    `json:"version"`
+	Scope   string `json:"scope"` // source settings the entries were fetched with
+	// Groups holds GetGroupByName results by group name, Members holds
+	// GetGroupMembers results by group ID.
+	Groups  map[string]cacheEntry `json:"groups"`
+	Members map[string]cacheEntry `json:"members"`
+}
+
+type cacheEntry struct {
+	FetchedAt time.Time     `json:"fetched_at"`
+	Group     *models.Group `json:"group,omitempty"` // nil: the group wasn't found
+	Users     []models.User `json:"users,omitempty"`
+}
+
+// cachedSource serves source results from a cache file (see CacheConfig).
+type cachedSource struct {
+	src  Source // nil when offline
+	conf CacheConfig
+	now  func() time.Time
+
+	mu    sync.Mutex
+	data  cacheFile
+	dirty bool // data has entries not yet written to the file
+}
+
+// newCachedSource loads the cache for scope. A missing file starts an empty
+// cache; so does a file written for another scope or cache version. Offline
+// mode needs an existing cache.
+func newCachedSource(src Source, conf CacheConfig, scope string) (*cachedSource, error) {
+	if conf.Path == "" {
+		return nil, errors.New("cache: file path is required")
+	}
+	if conf.Warn == nil {
+		conf.Warn = func(string) {}
+	}
+	cs := &cachedSource{
+		src:  src,
+		conf: conf,
+		now:  time.Now,
+		data: cacheFile{Version: cacheVersion, Scope: scope},
+	}
+
+	raw, err := os.ReadFile(conf.Path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if conf.Offline {
+			return nil, fmt.Errorf("cache: offline mode needs a cache, %s doesn't exist", conf.Path)
+		}
+	case err != nil:
+		return nil, fmt.Errorf("cache: %w", err)
+	default:
+		var f cacheFile
+		if err := json.Unmarshal(raw, &f); err != nil {
+			return nil, fmt.Errorf("cache: parse %s: %w", conf.Path, err)
+		}
+		switch {
+		case f.Version != cacheVersion || f.Scope != scope:
+			if conf.Offline {
+				return nil, fmt.Errorf("cache: %s was written for other source settings", conf.Path)
+			}
+		default:
+			cs.data = f
+		}
+	}
+	if cs.data.Groups == nil {
+		cs.data.Groups = map[string]cacheEntry{}
+	}
+	if cs.data.Members == nil {
+		cs.data.Members = map[string]cacheEntry{}
+	}
+	return cs, nil
+}
+
+func (s *cachedSource) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
+	entry, err := s.lookup(ctx, s.data.Groups, "group "+groupName, groupName, func() (cacheEntry, error) {
+		g, err := s.src.GetGroupByName(ctx, groupName)
+		return cacheEntry{Group: g}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Hand out a copy: callers update the group in place.
+	return cloneGroup(entry.Group), nil
+}
+
+func (s *cachedSource) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	entry, err := s.lookup(ctx, s.data.Members, "members of group ID "+groupID, groupID, func() (cacheEntry, error) {
+		users, err := s.src.GetGroupMembers(ctx, groupID)
+		return cacheEntry{Users: users}, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	users := cloneUsers(entry.Users)
+	if users == nil {
+		users = []models.User{}
+	}
+	return users, nil
+}
+
+// lookup returns the entry for key from entries: fresh cached data as is,
+// otherwise a new result from fetch, falling back to stale data within
+// MaxStale when fetch fails transiently or the circuit is open. Other errors,
+// e.g. an ambiguous group name, are returned: old data would only hide them.
+func (s *cachedSource) lookup(ctx context.Context, entries map[string]cacheEntry, what, key string, fetch func() (cacheEntry, error)) (cacheEntry, error) {
+	s.mu.Lock()
+	cached, ok := entries[key]
+	s.mu.Unlock()
+	age := s.now().Sub(cached.FetchedAt).Round(time.Second)
+
+	if s.conf.Offline {
+		if !ok {
+			return cacheEntry{}, fmt.Errorf("offline: %s is not in the cache", what)
+		}
+		s.conf.Warn(fmt.Sprintf("Offline: using cached %s from %s ago", what, age))
+		return cached, nil
+	}
+	if ok && age < s.conf.TTL {
+		return cached, nil
+	}
+
+	entry, err := fetch()
+	if err == nil {
+		entry.FetchedAt = s.now()
+		s.store(entries, key, entry)
+		return entry, nil
+	}
+	transient := IsRetryable(err) || errors.Is(err, ErrCircuitOpen)
+	if ctx.Err() != nil || !transient || !ok || s.conf.MaxStale <= 0 || age > s.conf.MaxStale {
+		return cacheEntry{}, err
+	}
+	s.conf.Warn(fmt.Sprintf("Source failed (%v), using cached %s from %s ago", err, what, age))
+	return cached, nil
+}
+
+// store saves entry in memory; Flush writes it to the file.
+func (s *cachedSource) store(entries map[string]cacheEntry, key string, entry cacheEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries[key] = entry
+	s.dirty = true
+}
+
+// Flush writes the results fetched since the last flush to the cache file.
+func (s *cachedSource) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.dirty {
+		return nil
+	}
+	raw, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("cache: %w", err)
+	}
+	if err := tools.WriteFileAtomic(s.conf.Path, raw, 0o600); err != nil {
+		return fmt.Errorf("cache: %w", err)
+	}
+	s.dirty = false
+	return nil
+}
+
+func cloneUsers(users []models.User) []models.User {
+	if users == nil {
+		return nil
+	}
+	return append(make([]models.User, 0, len(users)), users...)
+}
+
+// cacheScope identifies the source settings that shape results, so a cache
+// written for another source, endpoint or mode isn't reused.
+func cacheScope(c SourceConfig) string {
+	filters := make([]string, 0, len(c.LDAPFilterGroups))
+	for name, filter := range c.LDAPFilterGroups {
+		filters = append(filters, name+"="+filter)
+	}
+	sort.Strings(filters)
+
+	return strings.Join([]string{
+		CanonicalSourceName(c.Name),
+		c.Endpoint,
+		c.JumpcloudRegion,
+		c.LDAPBaseDN,
+		c.KeycloakRealm,
+		c.KeycloakMode,
+		fmt.Sprint(c.JumpcloudNestedGroups, c.AuthentikIncludeChildren, c.KeycloakIncludeSubgroups),
+		strings.Join(filters, ";"),
+	}, "|")
+}
@@ -0,0 +1,172 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
+)
+
+// notFoundSource finds no group.
+type notFoundSource struct{ calls int }
+
+func (s *notFoundSource) GetGroupByName(_ context.Context, _ string) (*models.Group, error) {
+	s.calls++
+	return nil, nil
+}
+
+func (s *notFoundSource) GetGroupMembers(_ context.Context, _ string) ([]models.User, error) {
+	s.calls++
+	return []models.User{}, nil
+}
+
+func newTestCache(t *testing.T, src Source, conf CacheConfig) (*cachedSource, *[]string) {
+	t.Helper()
+	var warnings []string
+	conf.Warn = func(msg string) { warnings = append(warnings, msg) }
+	cs, err := newCachedSource(src, conf, "test")
+	if err != nil {
+		t.Fatalf("newCachedSource: %v", err)
+	}
+	return cs, &warnings
+}
+
+func TestCachedSource_PersistsAndServesFresh(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	src := &flakySource{}
+
+	cs, _ := newTestCache(t, src, CacheConfig{Path: path, TTL: time.Hour})
+	if g, err := cs.GetGroupByName(t.Context(), "eng"); err != nil || g == nil {
+		t.Fatalf("GetGroupByName: %v, %v", g, err)
+	}
+	if users, err := cs.GetGroupMembers(t.Context(), "eng"); err != nil || len(users) != 1 {
+		t.Fatalf("GetGroupMembers: %v, %v", users, err)
+	}
+	if _, err := os.Stat(path); err == nil {
+		t.Fatal("results must not be written before Flush")
+	}
+	if err := cs.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("cache file must be written with 0600: %v, %v", info, err)
+	}
+
+	// A new run within the TTL is served from the file.
+	cs, _ = newTestCache(t, src, CacheConfig{Path: path, TTL: time.Hour})
+	g, err := cs.GetGroupByName(t.Context(), "eng")
+	if err != nil || g == nil || g.Name != "eng" {
+		t.Fatalf("cached GetGroupByName: %v, %v", g, err)
+	}
+	if users, err := cs.GetGroupMembers(t.Context(), "eng"); err != nil || len(users) != 1 || users[0].Username != "alice@" {
+		t.Fatalf("cached GetGroupMembers: %v, %v", users, err)
+	}
+	if src.calls != 2 {
+		t.Errorf("fresh entries must not reach the source, got %d calls", src.calls)
+	}
+}
+
+func TestCachedSource_StaleFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	cs, _ := newTestCache(t, &flakySource{}, CacheConfig{Path: path})
+	if _, err := cs.GetGroupMembers(t.Context(), "eng"); err != nil {
+		t.Fatalf("warm cache: %v", err)
+	}
+	if err := cs.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	down := &flakySource{failures: -1, err: &retry.StatusError{Code: 503, Err: errors.New("connection refused")}}
+	cs, warnings := newTestCache(t, down, CacheConfig{Path: path, MaxStale: time.Hour})
+	cs.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	users, err := cs.GetGroupMembers(t.Context(), "eng")
+	if err != nil || len(users) != 1 {
+		t.Fatalf("expected stale members, got %v, %v", users, err)
+	}
+	if len(*warnings) != 1 || !strings.Contains((*warnings)[0], "connection refused") {
+		t.Errorf("serving stale data must warn with the cause, got %q", *warnings)
+	}
+
+	cs.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := cs.GetGroupMembers(t.Context(), "eng"); err == nil {
+		t.Errorf("entries older than MaxStale must not be served")
+	}
+	if _, err := cs.GetGroupByName(t.Context(), "ops"); err == nil {
+		t.Errorf("an uncached group must return the source error")
+	}
+
+	broken := &flakySource{failures: -1, err: errors.New(`group "eng" is ambiguous`)}
+	cs, _ = newTestCache(t, broken, CacheConfig{Path: path, MaxStale: time.Hour})
+	cs.now = func() time.Time { return time.Now().Add(30 * time.Minute) }
+	if _, err := cs.GetGroupMembers(t.Context(), "eng"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Errorf("a non-transient error must not be hidden by stale data, got %v", err)
+	}
+}
+
+func TestCachedSource_Offline(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	if _, err := newCachedSource(nil, CacheConfig{Path: path, Offline: true}, "test"); err == nil {
+		t.Fatalf("offline mode without a cache file must fail")
+	}
+
+	cs, _ := newTestCache(t, &flakySource{}, CacheConfig{Path: path})
+	if _, err := cs.GetGroupByName(t.Context(), "eng"); err != nil {
+		t.Fatalf("warm cache: %v", err)
+	}
+	if err := cs.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	cs, warnings := newTestCache(t, nil, CacheConfig{Path: path, Offline: true})
+	cs.now = func() time.Time { return time.Now().Add(24 * 365 * time.Hour) }
+	if g, err := cs.GetGroupByName(t.Context(), "eng"); err != nil || g == nil {
+		t.Fatalf("offline GetGroupByName: %v, %v", g, err)
+	}
+	if len(*warnings) != 1 {
+		t.Errorf("offline data must be flagged, got %q", *warnings)
+	}
+	if _, err := cs.GetGroupByName(t.Context(), "ops"); err == nil {
+		t.Errorf("offline lookup of an uncached group must fail")
+	}
+
+	if _, err := newCachedSource(nil, CacheConfig{Path: path, Offline: true}, "other"); err == nil {
+		t.Errorf("offline mode must reject a cache written for other source settings")
+	}
+}
+
+func TestCachedSource_CachesNotFound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	src := &notFoundSource{}
+	cs, _ := newTestCache(t, src, CacheConfig{Path: path, TTL: time.Hour})
+	for range 2 {
+		if g, err := cs.GetGroupByName(t.Context(), "ghost"); err != nil || g != nil {
+			t.Fatalf("expected nil group, got %v, %v", g, err)
+		}
+	}
+	if src.calls != 1 {
+		t.Errorf("a missing group must be cached too, got %d calls", src.calls)
+	}
+}
+
+func TestNewSource_OfflineSkipsAdapter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.json")
+	config := SourceConfig{Name: "kk", Endpoint: "https://kc.example.com", KeycloakRealm: "corp"}
+	if err := os.WriteFile(path, []byte(`{"version":1,"scope":"`+cacheScope(config)+`"}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// No token or client secret: building the Keycloak adapter would fail.
+	src, err := NewSource(config, WithCache(CacheConfig{Path: path, Offline: true}))
+	if err != nil || src == nil {
+		t.Fatalf("NewSource: %v, %v", src, err)
+	}
+	if _, err := NewSource(SourceConfig{Name: "nope"}, WithCache(CacheConfig{Path: path, Offline: true})); err == nil {
+		t.Errorf("an unknown source name must still be rejected")
+	}
+}
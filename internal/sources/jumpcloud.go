@@ -4,27 +4,55 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
 	"strings"
 	"sync"
 
 	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
 
 	jcapiv1 "github.com/TheJumpCloud/jcapi-go/v1"
 	jcapiv2 "github.com/TheJumpCloud/jcapi-go/v2"
 )
 
-// jcUserFetchWorkers caps concurrent SystemusersGet calls. Tuned to be
-// well below JumpCloud's documented rate limit while still giving a
-// meaningful speedup
-const jcUserFetchWorkers = 8
+// JumpCloud regions and their console base URLs. The V1 API lives under
+// "/api" and the V2 API under "/api/v2" of the console URL.
+const (
+	JumpcloudRegionUS = "us"
+	JumpcloudRegionEU = "eu"
+)
+
+var jcRegionEndpoints = map[string]string{
+	JumpcloudRegionUS: "https://console.jumpcloud.com",
+	JumpcloudRegionEU: "https://console.eu.jumpcloud.com",
+}
 
 // Jumpcloud source
 type Jumpcloud struct {
 	V1          *jcapiv1.APIClient
-	V1Auth      context.Context
 	V2          *jcapiv2.APIClient
-	V2Auth      context.Context
+	APIKey      string
 	ContentType string
+
+	// workers caps concurrent SystemusersGet calls; the request rate itself
+	// is enforced by the client's transport.
+	workers int
+	// nestedGroups makes GetGroupMembers include users of nested user groups.
+	nestedGroups bool
+	// transport paces and retries the requests of V1 and V2.
+	transport *jcTransport
+}
+
+// setRetryAttempts sets the transport's attempts per request; see
+// selfRetrier.
+func (c *Jumpcloud) setRetryAttempts(n int) { c.transport.maxAttempts = n }
+
+// retried reports whether the transport already retried err: throttled and
+// transient server responses are, network errors aren't.
+func (c *Jumpcloud) retried(err error) bool {
+	var statusErr *retry.StatusError
+	return errors.As(err, &statusErr) && isJCRetryableStatus(statusErr.Code)
 }
 
 // NewJCClient init Jumpcloud source
@@ -33,32 +61,83 @@ func NewJCClient(config SourceConfig) (*Jumpcloud, error) {
 		return nil, errors.New("token is required")
 	}
 
-	c := &Jumpcloud{}
-	c.V1 = jcapiv1.NewAPIClient(jcapiv1.NewConfiguration())
-	c.V1Auth = context.WithValue(context.TODO(), jcapiv1.ContextAPIKey, jcapiv1.APIKey{
-		Key: config.Token,
-	})
+	v1Base, v2Base, err := jcBasePaths(config.JumpcloudRegion, config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
 
-	c.V2 = jcapiv2.NewAPIClient(jcapiv2.NewConfiguration())
-	c.V2Auth = context.WithValue(context.TODO(), jcapiv2.ContextAPIKey, jcapiv2.APIKey{
-		Key: config.Token,
-	})
+	transport, err := tools.GetTLSTransport(config.InsecureSkipTLSVerify)
+	if err != nil {
+		return nil, fmt.Errorf("jumpcloud: build TLS transport: %w", err)
+	}
+	if config.JumpcloudRPS < 0 {
+		return nil, fmt.Errorf("jumpcloud: requests per second must not be negative, got %v", config.JumpcloudRPS)
+	}
+	rps := config.JumpcloudRPS
+	if rps == 0 {
+		rps = jcDefaultRPS
+	}
+	jcTr := newJCTransport(transport, rps)
+	httpClient := &http.Client{Transport: jcTr}
+
+	c := &Jumpcloud{
+		workers:      min(max(1, int(rps)), jcMaxWorkers),
+		nestedGroups: config.JumpcloudNestedGroups,
+		transport:    jcTr,
+	}
+	v1Conf := jcapiv1.NewConfiguration()
+	v1Conf.BasePath = v1Base
+	v1Conf.HTTPClient = httpClient
+	c.V1 = jcapiv1.NewAPIClient(v1Conf)
 
+	v2Conf := jcapiv2.NewConfiguration()
+	v2Conf.BasePath = v2Base
+	v2Conf.HTTPClient = httpClient
+	c.V2 = jcapiv2.NewAPIClient(v2Conf)
+
+	c.APIKey = config.Token
 	c.ContentType = "application/json"
 
 	return c, nil
 }
 
+// v1Auth and v2Auth derive the per-call contexts the generated clients read
+// the API key from.
+func (c *Jumpcloud) v1Auth(ctx context.Context) context.Context {
+	return context.WithValue(ctx, jcapiv1.ContextAPIKey, jcapiv1.APIKey{Key: c.APIKey})
+}
+
+func (c *Jumpcloud) v2Auth(ctx context.Context) context.Context {
+	return context.WithValue(ctx, jcapiv2.ContextAPIKey, jcapiv2.APIKey{Key: c.APIKey})
+}
+
+// jcBasePaths returns the V1 and V2 API base URLs. An explicit endpoint (the
+// console URL, with or without a trailing "/api") wins over the region; an
+// empty region means the US console.
+func jcBasePaths(region, endpoint string) (v1, v2 string, err error) {
+	if region == "" {
+		region = JumpcloudRegionUS
+	}
+	root, ok := jcRegionEndpoints[strings.ToLower(region)]
+	if !ok {
+		return "", "", fmt.Errorf("jumpcloud: unknown region %q: must be %q or %q", region, JumpcloudRegionUS, JumpcloudRegionEU)
+	}
+	if endpoint != "" {
+		root = strings.TrimSuffix(strings.TrimRight(endpoint, "/"), "/api")
+	}
+	return root + "/api", root + "/api/v2", nil
+}
+
 // GetGroupByName Get Jumpcloud group by name
-func (c *Jumpcloud) GetGroupByName(groupName string) (*models.Group, error) {
+func (c *Jumpcloud) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
 	filter := map[string]any{
 		"filter": []string{fmt.Sprintf("name:eq:%s", groupName)},
 		"limit":  int32(100),
 	}
 
-	group, _, err := c.V2.UserGroupsApi.GroupsUserList(c.V2Auth, c.ContentType, c.ContentType, filter)
+	group, resp, err := c.V2.UserGroupsApi.GroupsUserList(c.v2Auth(ctx), c.ContentType, c.ContentType, filter)
 	if err != nil {
-		return nil, err
+		return nil, retry.WithStatus(resp, err)
 	}
 
 	if len(group) != 0 {
@@ -72,10 +151,27 @@ func (c *Jumpcloud) GetGroupByName(groupName string) (*models.Group, error) {
 }
 
 // GetGroupMembers gets ALL JumpCloud group members (handles pagination).
-// The JumpCloud membership endpoint returns only user IDs, so each ID is
-// resolved via getUserInfo. Lookups run through a bounded worker pool to
-// avoid the N+1 latency of a serial loop while staying inside rate limits.
-func (c *Jumpcloud) GetGroupMembers(groupID string) ([]models.User, error) {
+// The JumpCloud membership endpoint returns only user IDs; they are resolved
+// in bulk by fetchUsers. With nested groups enabled, member user groups are
+// traversed as well.
+func (c *Jumpcloud) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	var (
+		ids []string
+		err error
+	)
+	if c.nestedGroups {
+		ids, err = c.nestedMemberIDs(ctx, groupID)
+	} else {
+		ids, err = c.membershipIDs(ctx, groupID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c.fetchUsers(ctx, ids)
+}
+
+// membershipIDs lists the IDs of the users in a group.
+func (c *Jumpcloud) membershipIDs(ctx context.Context, groupID string) ([]string, error) {
 	const pageSize int32 = 100
 	skip := int32(0)
 	seen := make(map[string]struct{})
@@ -88,10 +184,10 @@ func (c *Jumpcloud) GetGroupMembers(groupID string) ([]models.User, error) {
 			"fields": []string{"id"},
 		}
 
-		groupUsers, _, err := c.V2.UserGroupsApi.
-			GraphUserGroupMembership(c.V2Auth, groupID, c.ContentType, c.ContentType, opts)
+		groupUsers, resp, err := c.V2.UserGroupsApi.
+			GraphUserGroupMembership(c.v2Auth(ctx), groupID, c.ContentType, c.ContentType, opts)
 		if err != nil {
-			return nil, err
+			return nil, retry.WithStatus(resp, err)
 		}
 		if len(groupUsers) == 0 {
 			break
@@ -111,12 +207,151 @@ func (c *Jumpcloud) GetGroupMembers(groupID string) ([]models.User, error) {
 		skip += int32(len(groupUsers))
 	}
 
-	return c.fetchUsersConcurrent(ids)
+	return ids, nil
+}
+
+// Graph object types of user group members.
+const (
+	jcGraphTypeUser      = "user"
+	jcGraphTypeUserGroup = "user_group"
+)
+
+// nestedMemberIDs walks the group and every user group nested in it,
+// breadth-first, and returns the IDs of all users found. Each group is read
+// once, so cycles between groups terminate.
+func (c *Jumpcloud) nestedMemberIDs(ctx context.Context, groupID string) ([]string, error) {
+	const pageSize int32 = 100
+	groups := []string{groupID}
+	seenGroups := map[string]struct{}{groupID: {}}
+	seenUsers := make(map[string]struct{})
+	ids := make([]string, 0)
+
+	for i := 0; i < len(groups); i++ {
+		for skip := int32(0); ; {
+			opts := map[string]any{
+				"limit": pageSize,
+				"skip":  skip,
+			}
+			members, resp, err := c.V2.UserGroupsApi.
+				GraphUserGroupMembersList(c.v2Auth(ctx), groups[i], c.ContentType, c.ContentType, opts)
+			if err != nil {
+				return nil, fmt.Errorf("jumpcloud: list members of group %s: %w", groups[i], retry.WithStatus(resp, err))
+			}
+
+			for _, m := range members {
+				if m.To == nil {
+					continue
+				}
+				switch m.To.Type_ {
+				case jcGraphTypeUser:
+					if _, ok := seenUsers[m.To.Id]; !ok {
+						seenUsers[m.To.Id] = struct{}{}
+						ids = append(ids, m.To.Id)
+					}
+				case jcGraphTypeUserGroup:
+					if _, ok := seenGroups[m.To.Id]; !ok {
+						seenGroups[m.To.Id] = struct{}{}
+						groups = append(groups, m.To.Id)
+					}
+				}
+			}
+
+			if int32(len(members)) < pageSize {
+				break
+			}
+			skip += int32(len(members))
+		}
+	}
+	return ids, nil
+}
+
+// jcBulkChunkSize is how many user IDs go into one systemusers list request
+// (also the maximum page size of that endpoint).
+const jcBulkChunkSize = 100
+
+// fetchUsers resolves user IDs through the systemusers list endpoint with an
+// "_id:$in" filter, chunkSize IDs per request. IDs the list doesn't return,
+// and chunks the endpoint rejects as a bad request, are resolved one by one
+// via fetchUsersConcurrent. The result follows the order of ids.
+func (c *Jumpcloud) fetchUsers(ctx context.Context, ids []string) ([]models.User, error) {
+	if len(ids) == 0 {
+		return []models.User{}, nil
+	}
+
+	found := make(map[string]models.User, len(ids))
+	var missing []string
+	for start := 0; start < len(ids); start += jcBulkChunkSize {
+		chunk := ids[start:min(start+jcBulkChunkSize, len(ids))]
+		users, err := c.listUsersByID(ctx, chunk)
+		if err != nil {
+			return nil, err
+		}
+		if users == nil {
+			missing = append(missing, chunk...)
+			continue
+		}
+		for _, u := range users {
+			found[u.ID] = u
+		}
+		for _, id := range chunk {
+			if _, ok := found[id]; !ok {
+				missing = append(missing, id)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		fetched, err := c.fetchUsersConcurrent(ctx, missing)
+		if err != nil {
+			return nil, err
+		}
+		for _, u := range fetched {
+			found[u.ID] = u
+		}
+	}
+
+	users := make([]models.User, 0, len(ids))
+	for _, id := range ids {
+		users = append(users, found[id])
+	}
+	return users, nil
+}
+
+// listUsersByID fetches the given users with one filtered list query (paging
+// if JumpCloud returns fewer per page). A nil result without error means the
+// endpoint rejected the filter and the caller should fall back to per-ID
+// lookups.
+func (c *Jumpcloud) listUsersByID(ctx context.Context, ids []string) ([]models.User, error) {
+	filter := "_id:$in:" + strings.Join(ids, "|")
+	users := make([]models.User, 0, len(ids))
+	skip := int32(0)
+	for {
+		opts := map[string]any{
+			"limit":  int32(jcBulkChunkSize),
+			"skip":   skip,
+			"filter": filter,
+		}
+		list, resp, err := c.V1.SystemusersApi.SystemusersList(c.v1Auth(ctx), c.ContentType, c.ContentType, opts)
+		if err != nil {
+			if resp != nil && resp.StatusCode == http.StatusBadRequest {
+				return nil, nil
+			}
+			return nil, retry.WithStatus(resp, err)
+		}
+		for _, u := range list.Results {
+			users = append(users, jcUser(u))
+		}
+		if len(list.Results) < jcBulkChunkSize || len(users) >= len(ids) {
+			return users, nil
+		}
+		skip += int32(len(list.Results))
+	}
 }
 
 // fetchUsersConcurrent resolves user IDs in parallel with a bounded worker
-// pool. The first error short-circuits and is returned to the caller.
-func (c *Jumpcloud) fetchUsersConcurrent(ids []string) ([]models.User, error) {
+// pool. Throttled and transient failures are retried by the transport; the
+// first remaining error short-circuits and is returned to the caller.
+func (c *Jumpcloud) fetchUsersConcurrent(ctx context.Context, ids []string) ([]models.User, error) {
 	if len(ids) == 0 {
 		return []models.User{}, nil
 	}
@@ -124,15 +359,22 @@ func (c *Jumpcloud) fetchUsersConcurrent(ids []string) ([]models.User, error) {
 	users := make([]models.User, len(ids))
 	errs := make([]error, len(ids))
 
-	sem := make(chan struct{}, jcUserFetchWorkers)
+	workers := c.workers
+	if workers <= 0 {
+		workers = int(jcDefaultRPS)
+	}
+	sem := make(chan struct{}, workers)
 	var wg sync.WaitGroup
 	for i, id := range ids {
+		if ctx.Err() != nil {
+			break
+		}
 		wg.Add(1)
 		sem <- struct{}{}
 		go func(i int, id string) {
 			defer wg.Done()
 			defer func() { <-sem }()
-			u, err := c.getUserInfo(id)
+			u, err := c.getUserInfo(ctx, id)
 			if err != nil {
 				errs[i] = err
 				return
@@ -142,6 +384,9 @@ func (c *Jumpcloud) fetchUsersConcurrent(ids []string) ([]models.User, error) {
 	}
 	wg.Wait()
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	for _, err := range errs {
 		if err != nil {
 			return nil, err
@@ -150,28 +395,41 @@ func (c *Jumpcloud) fetchUsersConcurrent(ids []string) ([]models.User, error) {
 	return users, nil
 }
 
-// getUserInfo fetches a Jumpcloud user by ID. Used internally by
-// GetGroupMembers to enrich the lightweight membership listing.
-func (c *Jumpcloud) getUserInfo(userID string) (models.User, error) {
+// getUserInfo fetches a Jumpcloud user by ID. Used as the fallback for users
+// the bulk lookup in fetchUsers didn't return.
+func (c *Jumpcloud) getUserInfo(ctx context.Context, userID string) (models.User, error) {
 	options := map[string]any{
 		"limit": int32(100),
 	}
 
-	user, _, err := c.V1.SystemusersApi.SystemusersGet(c.V1Auth, userID, c.ContentType, c.ContentType, options)
+	user, resp, err := c.V1.SystemusersApi.SystemusersGet(c.v1Auth(ctx), userID, c.ContentType, c.ContentType, options)
 	if err != nil {
-		return models.User{}, err
-	}
-
-	userName := user.Username
-	if !strings.Contains(userName, "@") {
-		userName += "@"
+		return models.User{}, retry.WithStatus(resp, err)
 	}
+	return jcUser(user), nil
+}
 
-	userInfo := models.User{
+// jcUser converts a V1 system user to models.User.
+func jcUser(user jcapiv1.Systemuserreturn) models.User {
+	return models.User{
 		ID:       user.Id,
 		Email:    user.Email,
-		Username: userName,
+		Username: user.Username,
+		Status:   jcUserStatus(user),
 	}
+}
 
-	return userInfo, nil
+// jcUserStatus maps JumpCloud's account flags to a status. Invited users that
+// haven't finished activation are pending.
+func jcUserStatus(user jcapiv1.Systemuserreturn) models.UserStatus {
+	switch {
+	case user.Suspended:
+		return models.UserStatusSuspended
+	case user.AccountLocked:
+		return models.UserStatusLocked
+	case !user.Activated:
+		return models.UserStatusPending
+	default:
+		return models.UserStatusActive
+	}
 }
@@ -3,6 +3,7 @@ package sources
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -10,16 +11,21 @@ import (
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	jcapiv1 "github.com/TheJumpCloud/jcapi-go/v1"
 	jcapiv2 "github.com/TheJumpCloud/jcapi-go/v2"
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
 )
 
 // jcTestServer mimics the two JumpCloud endpoints the adapter relies on:
 //
 //	GET /usergroups                       (used by GetGroupByName, optional)
 //	GET /usergroups/{group_id}/membership (used by GetGroupMembers, paginated)
-//	GET /systemusers/{id}                 (used by getUserInfo, per-user fetch)
+//	GET /usergroups/{group_id}/members    (used for nested groups, paginated)
+//	GET /systemusers?filter=_id:$in:a|b   (used by fetchUsers, bulk lookup)
+//	GET /systemusers/{id}                 (used by getUserInfo, per-user fallback)
 //
 // Tests configure groupsByName and members per group, then read counters off
 // the returned struct to assert pagination/concurrency behavior.
@@ -27,9 +33,14 @@ type jcTestServer struct {
 	groupsByName map[string]string            // name -> group ID
 	members      map[string][]string          // group ID -> user IDs (in order)
 	users        map[string]map[string]string // user ID -> {"username","email"} fields
-	failUserID   string                       // if non-empty, /systemusers/{id} for this ID returns 500
+	failUserID   string                       // if non-empty, any /systemusers request for this ID returns 500
 	memberCalls  int32                        // count of membership requests
 	userCalls    int32                        // count of /systemusers/{id} requests
+	listCalls    int32                        // count of /systemusers list requests
+	unlisted     map[string]bool              // user IDs the list endpoint omits (fallback path)
+	noBulk       bool                         // list endpoint rejects filters with 400
+	subgroups    map[string][]string          // group ID -> member user group IDs (graph members)
+	groupReads   map[string]int               // group ID -> /members requests
 	queryLog     []string                     // captured raw query strings, for assertion
 }
 
@@ -49,6 +60,26 @@ func (s *jcTestServer) handler(t *testing.T) http.Handler {
 			}
 			_ = json.NewEncoder(w).Encode(out)
 
+		case strings.HasPrefix(r.URL.Path, "/usergroups/") && strings.HasSuffix(r.URL.Path, "/members"):
+			groupID := strings.Split(r.URL.Path, "/")[2]
+			if s.groupReads == nil {
+				s.groupReads = map[string]int{}
+			}
+			s.groupReads[groupID]++
+
+			all := make([]map[string]any, 0)
+			for _, id := range s.members[groupID] {
+				all = append(all, map[string]any{"to": map[string]string{"id": id, "type": "user"}})
+			}
+			for _, id := range s.subgroups[groupID] {
+				all = append(all, map[string]any{"to": map[string]string{"id": id, "type": "user_group"}})
+			}
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+			lo := min(skip, len(all))
+			hi := min(lo+max(limit, 1), len(all))
+			_ = json.NewEncoder(w).Encode(all[lo:hi])
+
 		case strings.HasPrefix(r.URL.Path, "/usergroups/") && strings.HasSuffix(r.URL.Path, "/membership"):
 			atomic.AddInt32(&s.memberCalls, 1)
 			s.queryLog = append(s.queryLog, r.URL.RawQuery)
@@ -79,6 +110,29 @@ func (s *jcTestServer) handler(t *testing.T) http.Handler {
 			}
 			_ = json.NewEncoder(w).Encode(out)
 
+		case r.URL.Path == "/systemusers":
+			atomic.AddInt32(&s.listCalls, 1)
+			filter, ok := strings.CutPrefix(r.URL.Query().Get("filter"), "_id:$in:")
+			if !ok || s.noBulk {
+				http.Error(w, `{"message":"invalid filter"}`, http.StatusBadRequest)
+				return
+			}
+			results := []map[string]string{}
+			for _, id := range strings.Split(filter, "|") {
+				if id == s.failUserID {
+					http.Error(w, "boom", http.StatusInternalServerError)
+					return
+				}
+				if u, ok := s.users[id]; ok && !s.unlisted[id] {
+					results = append(results, map[string]string{"_id": id, "username": u["username"], "email": u["email"]})
+				}
+			}
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			skip, _ := strconv.Atoi(r.URL.Query().Get("skip"))
+			lo := min(skip, len(results))
+			hi := min(lo+max(limit, 1), len(results))
+			_ = json.NewEncoder(w).Encode(map[string]any{"results": results[lo:hi], "totalCount": len(results)})
+
 		case strings.HasPrefix(r.URL.Path, "/systemusers/"):
 			atomic.AddInt32(&s.userCalls, 1)
 			id := strings.TrimPrefix(r.URL.Path, "/systemusers/")
@@ -112,9 +166,7 @@ func newJCTestClient(t *testing.T, srv *httptest.Server) *Jumpcloud {
 	cfgV2.BasePath = srv.URL
 	return &Jumpcloud{
 		V1:          jcapiv1.NewAPIClient(cfgV1),
-		V1Auth:      context.Background(),
 		V2:          jcapiv2.NewAPIClient(cfgV2),
-		V2Auth:      context.Background(),
 		ContentType: "application/json",
 	}
 }
@@ -123,7 +175,7 @@ func mkUsers(ids ...string) map[string]map[string]string {
 	out := make(map[string]map[string]string, len(ids))
 	for _, id := range ids {
 		out[id] = map[string]string{
-			"username": id, // bare login; adapter must add @ suffix
+			"username": id, // bare login, rendered later by the username template
 			"email":    id + "@example.com",
 		}
 	}
@@ -151,7 +203,7 @@ func TestJumpcloud_GetGroupMembers_Pagination(t *testing.T) {
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	got, err := c.GetGroupMembers(groupID)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
@@ -161,13 +213,13 @@ func TestJumpcloud_GetGroupMembers_Pagination(t *testing.T) {
 	if state.memberCalls != 2 {
 		t.Errorf("expected 2 membership pages (skip=0, skip=100), got %d", state.memberCalls)
 	}
-	if state.userCalls != 150 {
-		t.Errorf("expected one /systemusers/* per ID, got %d", state.userCalls)
+	if state.listCalls != 2 || state.userCalls != 0 {
+		t.Errorf("expected 2 bulk lookups (100 + 50 IDs) and no per-ID calls, got %d list / %d per-ID", state.listCalls, state.userCalls)
 	}
 
-	// Order must match the membership listing (parallel pool preserves order via index).
+	// Order must match the membership listing.
 	for i, u := range got {
-		want := fmt.Sprintf("u%d@", i)
+		want := fmt.Sprintf("u%d", i)
 		if u.Username != want {
 			t.Errorf("user[%d].Username = %q, want %q", i, u.Username, want)
 		}
@@ -189,7 +241,7 @@ func TestJumpcloud_GetGroupMembers_DedupsAcrossPages(t *testing.T) {
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	got, err := c.GetGroupMembers(groupID)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
@@ -198,8 +250,8 @@ func TestJumpcloud_GetGroupMembers_DedupsAcrossPages(t *testing.T) {
 	if len(got) != 101 {
 		t.Errorf("expected 101 unique users after dedup, got %d", len(got))
 	}
-	if state.userCalls != 101 {
-		t.Errorf("expected 101 user fetches (no duplicates), got %d", state.userCalls)
+	if state.listCalls != 2 || state.userCalls != 0 {
+		t.Errorf("expected 2 bulk lookups for 101 unique IDs, got %d list / %d per-ID", state.listCalls, state.userCalls)
 	}
 }
 
@@ -210,7 +262,7 @@ func TestJumpcloud_GetGroupMembers_EmptyGroup(t *testing.T) {
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	got, err := c.GetGroupMembers(groupID)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
@@ -220,8 +272,8 @@ func TestJumpcloud_GetGroupMembers_EmptyGroup(t *testing.T) {
 	if len(got) != 0 {
 		t.Errorf("expected 0 users, got %d", len(got))
 	}
-	if state.userCalls != 0 {
-		t.Errorf("no per-user calls expected for empty group, got %d", state.userCalls)
+	if state.userCalls != 0 || state.listCalls != 0 {
+		t.Errorf("no user lookups expected for empty group, got %d per-ID / %d list", state.userCalls, state.listCalls)
 	}
 }
 
@@ -232,16 +284,121 @@ func TestJumpcloud_GetGroupMembers_PerUserErrorShortCircuits(t *testing.T) {
 	state := &jcTestServer{
 		members:    map[string][]string{groupID: memberIDs},
 		users:      mkUsers(memberIDs...),
-		failUserID: "u5", // worker fetching u5 will get a 500
+		failUserID: "u5", // the lookup including u5 gets a 500
 	}
 	srv := httptest.NewServer(state.handler(t))
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	_, err := c.GetGroupMembers(groupID)
+	_, err := c.GetGroupMembers(t.Context(), groupID)
 	if err == nil {
 		t.Fatalf("expected error from /systemusers/u5 failure")
 	}
+	var statusErr *retry.StatusError
+	if !errors.As(err, &statusErr) || statusErr.Code != 500 {
+		t.Errorf("expected the HTTP status to be kept for retry classification, got %v", err)
+	}
+}
+
+func TestJumpcloud_GetGroupMembers_Cancelled(t *testing.T) {
+	groupID := "grp-1"
+	memberIDs := ids(10)
+
+	state := &jcTestServer{
+		members: map[string][]string{groupID: memberIDs},
+		users:   mkUsers(memberIDs...),
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	c := newJCTestClient(t, srv)
+	_, err := c.GetGroupMembers(ctx, groupID)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if state.memberCalls != 0 {
+		t.Errorf("expected no requests after cancellation, got %d membership calls", state.memberCalls)
+	}
+}
+
+func TestJumpcloud_GetGroupMembers_FallsBackToPerIDLookups(t *testing.T) {
+	groupID := "grp-1"
+	memberIDs := ids(10)
+
+	state := &jcTestServer{
+		members:  map[string][]string{groupID: memberIDs},
+		users:    mkUsers(memberIDs...),
+		unlisted: map[string]bool{"u3": true, "u7": true},
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	c := newJCTestClient(t, srv)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(got) != 10 || got[3].Username != "u3" || got[7].Username != "u7" {
+		t.Errorf("users missing from the bulk result must be fetched by ID in place: %+v", got)
+	}
+	if state.listCalls != 1 || state.userCalls != 2 {
+		t.Errorf("expected 1 bulk lookup and 2 per-ID lookups, got %d / %d", state.listCalls, state.userCalls)
+	}
+
+	// An endpoint that rejects the filter falls back to per-ID lookups entirely.
+	state.noBulk = true
+	state.userCalls = 0
+	got, err = c.GetGroupMembers(t.Context(), groupID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers without bulk support: %v", err)
+	}
+	if len(got) != 10 || state.userCalls != 10 {
+		t.Errorf("expected 10 users via 10 per-ID lookups, got %d users / %d calls", len(got), state.userCalls)
+	}
+}
+
+func TestJumpcloud_GetGroupMembers_NestedGroups(t *testing.T) {
+	// umbrella -> eng -> sre -> umbrella (cycle); eng and sre share u2.
+	state := &jcTestServer{
+		members: map[string][]string{
+			"umbrella": {"u0"},
+			"eng":      append([]string{"u1", "u2"}, ids(120)[10:120]...),
+			"sre":      {"u2", "u3"},
+		},
+		subgroups: map[string][]string{
+			"umbrella": {"eng"},
+			"eng":      {"sre"},
+			"sre":      {"umbrella"},
+		},
+		users: mkUsers(append(ids(120), "u0")...),
+	}
+	srv := httptest.NewServer(state.handler(t))
+	defer srv.Close()
+
+	c := newJCTestClient(t, srv)
+	direct, err := c.GetGroupMembers(t.Context(), "umbrella")
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(direct) != 1 {
+		t.Errorf("without nesting only direct members are returned, got %d", len(direct))
+	}
+
+	c.nestedGroups = true
+	got, err := c.GetGroupMembers(t.Context(), "umbrella")
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	// u0..u3 plus u10..u119 from the paged eng group, each once.
+	if len(got) != 114 {
+		t.Errorf("expected 114 unique users, got %d", len(got))
+	}
+	if state.groupReads["umbrella"] != 1 || state.groupReads["sre"] != 1 || state.groupReads["eng"] != 2 {
+		t.Errorf("each group must be read once per page despite the cycle, got %v", state.groupReads)
+	}
 }
 
 func TestJumpcloud_GetGroupMembers_ExactPageSizeBoundary(t *testing.T) {
@@ -258,7 +415,7 @@ func TestJumpcloud_GetGroupMembers_ExactPageSizeBoundary(t *testing.T) {
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	got, err := c.GetGroupMembers(groupID)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
@@ -280,7 +437,7 @@ func TestJumpcloud_GetGroupByName_Found(t *testing.T) {
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	got, err := c.GetGroupByName("engineering")
+	got, err := c.GetGroupByName(t.Context(), "engineering")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -298,7 +455,7 @@ func TestJumpcloud_GetGroupByName_NotFound(t *testing.T) {
 	defer srv.Close()
 
 	c := newJCTestClient(t, srv)
-	got, err := c.GetGroupByName("ghost")
+	got, err := c.GetGroupByName(t.Context(), "ghost")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -306,3 +463,262 @@ func TestJumpcloud_GetGroupByName_NotFound(t *testing.T) {
 		t.Errorf("expected nil for missing group, got %+v", got)
 	}
 }
+
+func TestJcBasePaths(t *testing.T) {
+	cases := []struct {
+		region, endpoint string
+		v1, v2           string
+		wantErr          bool
+	}{
+		{"", "", "https://console.jumpcloud.com/api", "https://console.jumpcloud.com/api/v2", false},
+		{"eu", "", "https://console.eu.jumpcloud.com/api", "https://console.eu.jumpcloud.com/api/v2", false},
+		{"EU", "", "https://console.eu.jumpcloud.com/api", "https://console.eu.jumpcloud.com/api/v2", false},
+		{"eu", "http://localhost:8080/", "http://localhost:8080/api", "http://localhost:8080/api/v2", false},
+		{"", "https://jc.example.com/api", "https://jc.example.com/api", "https://jc.example.com/api/v2", false},
+		{"apac", "", "", "", true},
+	}
+	for _, tc := range cases {
+		v1, v2, err := jcBasePaths(tc.region, tc.endpoint)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("jcBasePaths(%q, %q) err = %v, wantErr %v", tc.region, tc.endpoint, err, tc.wantErr)
+			continue
+		}
+		if v1 != tc.v1 || v2 != tc.v2 {
+			t.Errorf("jcBasePaths(%q, %q) = %q, %q; want %q, %q", tc.region, tc.endpoint, v1, v2, tc.v1, tc.v2)
+		}
+	}
+}
+
+func TestNewJCClient_UsesEndpoint(t *testing.T) {
+	state := &jcTestServer{
+		groupsByName: map[string]string{"eng": "g1"},
+		members:      map[string][]string{"g1": {"u1"}},
+		users:        mkUsers("u1"),
+	}
+	// Serve the API the way the console does: V1 under /api, V2 under /api/v2.
+	mux := http.NewServeMux()
+	mux.Handle("/api/v2/", http.StripPrefix("/api/v2", state.handler(t)))
+	mux.Handle("/api/", http.StripPrefix("/api", state.handler(t)))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	c, err := NewJCClient(SourceConfig{Token: "t", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatalf("NewJCClient: %v", err)
+	}
+	g, err := c.GetGroupByName(t.Context(), "eng")
+	if err != nil || g == nil || g.ID != "g1" {
+		t.Fatalf("GetGroupByName = %+v, %v", g, err)
+	}
+	users, err := c.GetGroupMembers(t.Context(), g.ID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(users) != 1 || users[0].Username != "u1" {
+		t.Errorf("unexpected users: %+v", users)
+	}
+}
+
+func TestJumpcloud_WrappedSourceRetriesOnce(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, &calls, []int{503, 503, 503, 503, 503, 503}, nil)
+	defer srv.Close()
+
+	c, err := NewJCClient(SourceConfig{Token: "t", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatalf("NewJCClient: %v", err)
+	}
+	src := wrapSource(c, WithRetry(retry.Policy{MaxAttempts: 1}))
+	if _, err := src.GetGroupByName(t.Context(), "eng"); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("calls = %d, want 1: --retry-attempts 1 must disable retries", n)
+	}
+}
+
+func TestJumpcloud_WrappedSourceRetriesPerRequest(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	c, err := NewJCClient(SourceConfig{Token: "t", Endpoint: srv.URL})
+	if err != nil {
+		t.Fatalf("NewJCClient: %v", err)
+	}
+	c.transport.baseBackoff = time.Millisecond
+	src := wrapSource(c, WithRetry(retry.Policy{MaxAttempts: 3}))
+	if _, err := src.GetGroupByName(t.Context(), "eng"); err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Errorf("calls = %d, want 2: the transport retries the failed request", n)
+	}
+}
+
+// flakyServer answers with the given statuses (and headers) in order, then 200.
+func flakyServer(t *testing.T, calls *int32, statuses []int, header http.Header) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := int(atomic.AddInt32(calls, 1))
+		if n <= len(statuses) {
+			for k, v := range header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(statuses[n-1])
+			return
+		}
+		_, _ = w.Write([]byte(`{}`))
+	}))
+}
+
+func newTestJCTransport(rps float64) *jcTransport {
+	tr := newJCTransport(http.DefaultTransport, rps)
+	tr.baseBackoff = time.Millisecond
+	return tr
+}
+
+func TestJCTransport_HonoursRetryAfter(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, &calls, []int{http.StatusTooManyRequests}, http.Header{"Retry-After": {"1"}})
+	defer srv.Close()
+
+	client := &http.Client{Transport: newTestJCTransport(100)}
+	start := time.Now()
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 2 {
+		t.Errorf("expected success on the second call, got status %d after %d calls", resp.StatusCode, calls)
+	}
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Errorf("Retry-After: 1 not honoured, retried after %v", elapsed)
+	}
+}
+
+func TestJCTransport_RetriesTransientServerErrors(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, &calls, []int{http.StatusServiceUnavailable, http.StatusBadGateway}, nil)
+	defer srv.Close()
+
+	client := &http.Client{Transport: newTestJCTransport(100)}
+	resp, err := client.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || calls != 3 {
+		t.Errorf("expected success on the third call, got status %d after %d calls", resp.StatusCode, calls)
+	}
+}
+
+func TestJCTransport_GivesUpAndSkipsClientErrors(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, &calls, []int{500, 500, 500, 500, 500, 500}, nil)
+	defer srv.Close()
+
+	tr := newTestJCTransport(100)
+	tr.maxAttempts = 3
+	resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || calls != 3 {
+		t.Errorf("expected the last 500 after 3 calls, got %d after %d", resp.StatusCode, calls)
+	}
+
+	calls = 0
+	srv404 := flakyServer(t, &calls, []int{http.StatusNotFound}, nil)
+	defer srv404.Close()
+	resp, err = (&http.Client{Transport: tr}).Get(srv404.URL)
+	if err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || calls != 1 {
+		t.Errorf("client errors must not be retried, got %d after %d calls", resp.StatusCode, calls)
+	}
+}
+
+func TestJCTransport_LimitsRate(t *testing.T) {
+	var calls int32
+	srv := flakyServer(t, &calls, nil, nil)
+	defer srv.Close()
+
+	client := &http.Client{Transport: newTestJCTransport(20)}
+	start := time.Now()
+	for range 30 {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		resp.Body.Close()
+	}
+	// A burst of 20, then 10 more at 20/s.
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("30 requests at 20 rps finished in %v", elapsed)
+	}
+}
+
+func TestJcRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		header http.Header
+		want   time.Duration
+		ok     bool
+	}{
+		{"none", http.Header{}, 0, false},
+		{"seconds", http.Header{"Retry-After": {"3"}}, 3 * time.Second, true},
+		{"http date", http.Header{"Retry-After": {now.Add(5 * time.Second).Format(http.TimeFormat)}}, 5 * time.Second, true},
+		{"capped", http.Header{"Retry-After": {"3600"}}, jcMaxRetryWait, true},
+		{"reset seconds", http.Header{"X-Ratelimit-Reset": {"7"}}, 7 * time.Second, true},
+		{"reset unix", http.Header{"X-Ratelimit-Reset": {strconv.FormatInt(now.Add(2*time.Second).Unix(), 10)}}, 2 * time.Second, true},
+	}
+	for _, tc := range cases {
+		got, ok := jcRetryAfter(tc.header, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("%s: got %v, %v; want %v, %v", tc.name, got, ok, tc.want, tc.ok)
+		}
+	}
+
+	if _, ok := jcQuotaReset(http.Header{"X-Ratelimit-Remaining": {"3"}, "X-Ratelimit-Reset": {"7"}}, now); ok {
+		t.Error("quota with requests left must not pause")
+	}
+	if d, ok := jcQuotaReset(http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {"7"}}, now); !ok || d != 7*time.Second {
+		t.Errorf("exhausted quota: got %v, %v", d, ok)
+	}
+}
+
+func TestNewJCClient_RejectsNegativeRPS(t *testing.T) {
+	if _, err := NewJCClient(SourceConfig{Token: "t", JumpcloudRPS: -1}); err == nil {
+		t.Error("expected an error for a negative rate")
+	}
+}
+
+func TestJCUserStatus(t *testing.T) {
+	cases := []struct {
+		name string
+		in   jcapiv1.Systemuserreturn
+		want models.UserStatus
+	}{
+		{"active", jcapiv1.Systemuserreturn{Activated: true}, models.UserStatusActive},
+		{"suspended", jcapiv1.Systemuserreturn{Activated: true, Suspended: true}, models.UserStatusSuspended},
+		{"locked", jcapiv1.Systemuserreturn{Activated: true, AccountLocked: true}, models.UserStatusLocked},
+		{"never activated", jcapiv1.Systemuserreturn{}, models.UserStatusPending},
+	}
+	for _, tc := range cases {
+		if got := jcUser(tc.in).Status; got != tc.want {
+			t.Errorf("%s: Status = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package sources
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Defaults for the JumpCloud HTTP client. JumpCloud doesn't publish a fixed
+// limit per endpoint, so the default stays conservative.
+const (
+	jcDefaultRPS     = 10.0
+	jcMaxWorkers     = 16 // upper bound for concurrent user lookups
+	jcMaxAttempts    = 5  // per request, including the first
+	jcBaseBackoff    = 500 * time.Millisecond
+	jcMaxRetryWait   = 60 * time.Second // cap for server-suggested waits
+	jcMaxBackoffWait = 10 * time.Second // cap for exponential backoff
+)
+
+// jcTransport paces JumpCloud requests with a token bucket and retries
+// throttled (429) and transient server errors (502/503/504, 500). Waits
+// suggested by the server via Retry-After or X-RateLimit-* take precedence
+// over the exponential backoff. When a response reports the quota as used up,
+// all further requests are held back until it resets.
+type jcTransport struct {
+	base        http.RoundTripper
+	limiter     *rate.Limiter
+	maxAttempts int
+	baseBackoff time.Duration
+
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func newJCTransport(base http.RoundTripper, rps float64) *jcTransport {
+	if rps <= 0 {
+		rps = jcDefaultRPS
+	}
+	return &jcTransport{
+		base:        base,
+		limiter:     rate.NewLimiter(rate.Limit(rps), max(1, int(rps))),
+		maxAttempts: jcMaxAttempts,
+		baseBackoff: jcBaseBackoff,
+	}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *jcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	replayable := req.Body == nil || req.GetBody != nil
+	for attempt := 1; ; attempt++ {
+		if err := t.waitTurn(ctx); err != nil {
+			return nil, err
+		}
+
+		if attempt > 1 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+
+		resp, err := t.base.RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+
+		now := time.Now()
+		if wait, ok := jcQuotaReset(resp.Header, now); ok {
+			t.pause(now.Add(wait))
+		}
+		if !isJCRetryableStatus(resp.StatusCode) {
+			return resp, nil
+		}
+		wait, ok := jcRetryAfter(resp.Header, now)
+		if attempt >= t.maxAttempts || !replayable {
+			// Whoever retries the call next must still respect the wait
+			// the server asked for.
+			if ok {
+				t.pause(now.Add(wait))
+			}
+			return resp, nil
+		}
+		if !ok {
+			wait = min(t.baseBackoff<<(attempt-1), jcMaxBackoffWait)
+		}
+		// Drain so the connection can be reused.
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		t.pause(now.Add(wait))
+	}
+}
+
+// waitTurn blocks until a pause set by the server has passed and the limiter
+// grants a token.
+func (t *jcTransport) waitTurn(ctx context.Context) error {
+	t.mu.Lock()
+	until := t.pausedUntil
+	t.mu.Unlock()
+
+	if d := time.Until(until); d > 0 {
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return t.limiter.Wait(ctx)
+}
+
+// pause holds back all requests until the given time (if later than the
+// current pause).
+func (t *jcTransport) pause(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+}
+
+func isJCRetryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// jcRetryAfter returns the wait requested by a throttled response: the
+// Retry-After header (seconds or HTTP date), else X-RateLimit-Reset.
+func jcRetryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	if v := h.Get("Retry-After"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+			return min(time.Duration(secs)*time.Second, jcMaxRetryWait), true
+		}
+		if at, err := http.ParseTime(v); err == nil {
+			return min(max(at.Sub(now), 0), jcMaxRetryWait), true
+		}
+	}
+	return jcRateLimitReset(h, now)
+}
+
+// jcQuotaReset reports how long to hold back when a response says no requests
+// are left in the current window (X-RateLimit-Remaining: 0).
+func jcQuotaReset(h http.Header, now time.Time) (time.Duration, bool) {
+	if h.Get("X-RateLimit-Remaining") != "0" {
+		return 0, false
+	}
+	return jcRateLimitReset(h, now)
+}
+
+// jcRateLimitReset parses X-RateLimit-Reset, given either as seconds until
+// the window resets or as a Unix timestamp.
+func jcRateLimitReset(h http.Header, now time.Time) (time.Duration, bool) {
+	v, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil || v < 0 {
+		return 0, false
+	}
+	wait := time.Duration(v) * time.Second
+	if v > 1_000_000_000 {
+		wait = time.Unix(v, 0).Sub(now)
+	}
+	return min(max(wait, 0), jcMaxRetryWait), true
+}
@@ -4,22 +4,72 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	gocloak "github.com/Nerzal/gocloak/v13"
 	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
 )
 
+// kcTokenRefreshSkew is how long before its expiry a client-credentials
+// token is considered stale and renewed, so a request never starts with a
+// token that is about to expire.
+const kcTokenRefreshSkew = 30 * time.Second
+
+// kcGroupSearchPageSize is the page size for group searches and subgroup
+// listings.
+const kcGroupSearchPageSize = 100
+
+// kcMembersPageSize is the page size for user listings (group members,
+// role users).
+const kcMembersPageSize = 200
+
 type Keycloak struct {
-	client *gocloak.GoCloak
-	realm  string
-	token  string
+	client   *gocloak.GoCloak
+	basePath string
+	realm    string
+
+	// mode selects what template group names resolve to: Keycloak groups
+	// (KeycloakModeGroups) or realm/client roles (KeycloakModeRoles).
+	mode string
+
+	// includeSubgroups makes GetGroupMembers include the members of all
+	// descendant groups.
+	includeSubgroups bool
+
+	// maxAttempts is the number of attempts per request in withRetry,
+	// including the first; 0 means kcMaxAttempts.
+	maxAttempts int
+
+	// Client-credentials (service account) login. When clientID is set the
+	// adapter logs in itself and renews the token on expiry; otherwise token
+	// is a static admin token supplied by the caller.
+	clientID     string
+	clientSecret string
+	authRealm    string
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+
+	// parents maps a role ID to the composite roles that include it; built
+	// on the first role lookup and reused (see compositeParents).
+	parentsMu sync.Mutex
+	parents   map[string][]kcRole
 }
 
 func NewKeycloakClient(config SourceConfig) (*Keycloak, error) {
-	if len(config.Token) <= 0 {
-		return nil, errors.New("token is required")
+	clientLogin := len(config.KeycloakClientID) > 0
+	if !clientLogin && len(config.Token) <= 0 {
+		return nil, errors.New("token or client ID/secret is required")
+	}
+	if clientLogin && len(config.KeycloakClientSecret) <= 0 {
+		return nil, errors.New("client secret is required")
 	}
 	if len(config.Endpoint) <= 0 {
 		return nil, errors.New("endpoint is required")
@@ -27,104 +77,454 @@ func NewKeycloakClient(config SourceConfig) (*Keycloak, error) {
 	if len(config.KeycloakRealm) <= 0 {
 		return nil, errors.New("realm is required")
 	}
+	mode := config.KeycloakMode
+	if mode == "" {
+		mode = KeycloakModeGroups
+	}
+	if mode != KeycloakModeGroups && mode != KeycloakModeRoles {
+		return nil, fmt.Errorf("unknown keycloak mode %q: must be %q or %q", mode, KeycloakModeGroups, KeycloakModeRoles)
+	}
 
-	return &Keycloak{
-		client: gocloak.NewClient(config.Endpoint),
-		realm:  config.KeycloakRealm,
-		token:  config.Token,
-	}, nil
+	kc := &Keycloak{
+		client:           gocloak.NewClient(config.Endpoint),
+		basePath:         config.Endpoint,
+		realm:            config.KeycloakRealm,
+		mode:             mode,
+		includeSubgroups: config.KeycloakIncludeSubgroups,
+		token:            config.Token,
+	}
+	if clientLogin {
+		kc.clientID = config.KeycloakClientID
+		kc.clientSecret = config.KeycloakClientSecret
+		kc.authRealm = config.KeycloakAuthRealm
+		if kc.authRealm == "" {
+			kc.authRealm = config.KeycloakRealm
+		}
+		// The client token always wins over a static one.
+		kc.token = ""
+	}
+
+	return kc, nil
 }
 
-// GetGroupByName Get Keycloak group by name
-func (kc *Keycloak) GetGroupByName(name string) (*models.Group, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
+// accessToken returns a token for the admin API. A static token is returned
+// as-is; a client-credentials token is obtained on first use and renewed
+// once it is within kcTokenRefreshSkew of expiry.
+func (kc *Keycloak) accessToken(ctx context.Context) (string, error) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
 
-	group, err := kc.client.GetGroups(ctx, kc.token, kc.realm, gocloak.GetGroupsParams{
-		Search: gocloak.StringP(name),
-	})
+	if kc.clientID == "" || (kc.token != "" && time.Now().Before(kc.tokenExpiry)) {
+		return kc.token, nil
+	}
+
+	jwt, err := kc.client.LoginClient(ctx, kc.clientID, kc.clientSecret, kc.authRealm)
 	if err != nil {
-		return nil, err
+		return "", fmt.Errorf("keycloak: client login (client=%s, realm=%s): %w", kc.clientID, kc.authRealm, err)
 	}
 
-	if len(group) != 0 && gocloak.PString(group[0].Name) == name {
-		return &models.Group{
-			ID:   gocloak.PString(group[0].ID),
-			Name: gocloak.PString(group[0].Name),
-		}, nil
+	// Renew a little early; for very short-lived tokens renew at half-life.
+	lifetime := time.Duration(jwt.ExpiresIn) * time.Second
+	skew := kcTokenRefreshSkew
+	if lifetime < 2*skew {
+		skew = lifetime / 2
 	}
+	kc.token = jwt.AccessToken
+	kc.tokenExpiry = time.Now().Add(lifetime - skew)
+	return kc.token, nil
+}
 
-	return nil, nil
+// invalidateToken drops a client-credentials token the server rejected, so
+// the next accessToken call logs in again. A token refreshed concurrently by
+// another caller is kept. Static tokens can't be renewed and are left alone.
+func (kc *Keycloak) invalidateToken(rejected string) {
+	kc.mu.Lock()
+	defer kc.mu.Unlock()
+
+	if kc.clientID != "" && kc.token == rejected {
+		kc.token = ""
+	}
 }
 
-// GetGroupMembers gets ALL Keycloak group members (handles pagination)
-func (kc *Keycloak) GetGroupMembers(groupID string) ([]models.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
-	defer cancel()
+// withToken runs fn with a valid access token. If the server answers 401 to
+// a client-credentials token (revoked, or expired early), the token is
+// renewed and fn is run once more.
+func (kc *Keycloak) withToken(ctx context.Context, fn func(token string) error) error {
+	for attempt := 1; ; attempt++ {
+		token, err := kc.accessToken(ctx)
+		if err != nil {
+			return err
+		}
+		err = fn(token)
+		if attempt == 1 && kc.clientID != "" && isKeycloakUnauthorized(err) {
+			kc.invalidateToken(token)
+			continue
+		}
+		return err
+	}
+}
 
-	const pageSize = 200 // page size
-	first := 0
+// isKeycloakUnauthorized reports whether err is a gocloak 401 response.
+func isKeycloakUnauthorized(err error) bool {
+	var apiErr *gocloak.APIError
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusUnauthorized
+}
 
-	out := make([]models.User, 0, pageSize)
-	seen := make(map[string]struct{}, pageSize)
+// GetGroupByName Get Keycloak group by name.
+// A name starting with "/" is a full group path (e.g. "/engineering/sre") and
+// is looked up directly. Any other name must match exactly one group, at any
+// depth of the group tree; a name shared by several groups is an error, use
+// the full path to pick one. The returned Name is the requested name, so it
+// matches the template group.
+// In roles mode the name is a realm role, or a client role as "clientId:role".
+func (kc *Keycloak) GetGroupByName(ctx context.Context, name string) (*models.Group, error) {
+	if kc.mode == KeycloakModeRoles {
+		return kc.getRoleGroup(ctx, name)
+	}
 
+	if strings.HasPrefix(name, "/") {
+		return kc.getGroupByPath(ctx, name)
+	}
+
+	var matches []gocloak.Group
+	first := 0
 	for {
-		users, err := kc.fetchGroupMembersPage(ctx, groupID, first, pageSize)
+		var page []*gocloak.Group
+		err := kc.withToken(ctx, func(token string) error {
+			var err error
+			page, err = kc.client.GetGroups(ctx, token, kc.realm, gocloak.GetGroupsParams{
+				Search: gocloak.StringP(name),
+				First:  gocloak.IntP(first),
+				Max:    gocloak.IntP(kcGroupSearchPageSize),
+			})
+			return err
+		})
 		if err != nil {
 			return nil, err
 		}
-		if len(users) == 0 {
+		for _, g := range page {
+			matches = appendGroupsNamed(matches, *g, name)
+		}
+
+		first += len(page)
+		if len(page) < kcGroupSearchPageSize {
 			break
 		}
+	}
 
-		for _, u := range users {
-			mu := toModelUser(u)
-			if _, ok := seen[mu.ID]; ok {
+	switch len(matches) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &models.Group{
+			ID:   gocloak.PString(matches[0].ID),
+			Name: name,
+		}, nil
+	default:
+		paths := make([]string, 0, len(matches))
+		for _, g := range matches {
+			paths = append(paths, gocloak.PString(g.Path))
+		}
+		return nil, fmt.Errorf("keycloak: group name %q is ambiguous, use the full path of one of: %s", name, strings.Join(paths, ", "))
+	}
+}
+
+// getGroupByPath resolves a group by its full path. A missing path is "not
+// found" (nil, nil) rather than an error.
+func (kc *Keycloak) getGroupByPath(ctx context.Context, path string) (*models.Group, error) {
+	var group *gocloak.Group
+	err := kc.withToken(ctx, func(token string) error {
+		var err error
+		// Keycloak accepts the path with or without the leading slash; without
+		// it the request URL has no empty segment.
+		group, err = kc.client.GetGroupByPath(ctx, token, kc.realm, strings.TrimPrefix(path, "/"))
+		return err
+	})
+	if err != nil {
+		var apiErr *gocloak.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return &models.Group{
+		ID:   gocloak.PString(group.ID),
+		Name: path,
+	}, nil
+}
+
+// appendGroupsNamed walks g and its (search-pruned) subgroups and appends
+// every group whose name equals name exactly. Keycloak's search matches
+// substrings, so the results are always filtered here.
+func appendGroupsNamed(out []gocloak.Group, g gocloak.Group, name string) []gocloak.Group {
+	if gocloak.PString(g.Name) == name {
+		out = append(out, g)
+	}
+	if g.SubGroups != nil {
+		for _, sg := range *g.SubGroups {
+			out = appendGroupsNamed(out, sg, name)
+		}
+	}
+	return out
+}
+
+// GetGroupMembers gets ALL Keycloak group members (handles pagination).
+// With IncludeSubgroups the members of every descendant group are included
+// too; users found in several groups are returned once. In roles mode the
+// groupID identifies a role (see GetGroupByName) and the role's users are
+// returned.
+func (kc *Keycloak) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	if role, ok := parseKCRoleGroupID(groupID); ok {
+		return kc.getRoleMembers(ctx, role)
+	}
+
+	groupIDs := []string{groupID}
+	if kc.includeSubgroups {
+		var err error
+		groupIDs, err = kc.descendantGroupIDs(ctx, groupID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	set := newKCUserSet()
+	if err := kc.collectGroupMembers(ctx, set, groupIDs); err != nil {
+		return nil, err
+	}
+	return set.users, nil
+}
+
+// collectGroupMembers adds the direct members of every group in groupIDs.
+func (kc *Keycloak) collectGroupMembers(ctx context.Context, set *kcUserSet, groupIDs []string) error {
+	for _, id := range groupIDs {
+		err := pageUsers(set, kcMembersPageSize, func(first, max int) ([]*gocloak.User, error) {
+			return kc.fetchGroupMembersPage(ctx, id, first, max)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// descendantGroupIDs returns groupID followed by the IDs of all its
+// descendants, breadth-first.
+func (kc *Keycloak) descendantGroupIDs(ctx context.Context, groupID string) ([]string, error) {
+	ids := []string{groupID}
+	seen := map[string]struct{}{groupID: {}}
+	for i := 0; i < len(ids); i++ {
+		children, err := kc.childGroups(ctx, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range children {
+			id := gocloak.PString(c.ID)
+			if _, ok := seen[id]; ok || id == "" {
 				continue
 			}
-			seen[mu.ID] = struct{}{}
-			out = append(out, mu)
+			seen[id] = struct{}{}
+			ids = append(ids, id)
 		}
+	}
+	return ids, nil
+}
 
-		first += len(users)
-		// if len of user list < pageSize that is the last page
-		// break pagination
-		if len(users) < pageSize {
-			break
+// childGroups lists the direct subgroups of a group. Keycloak 23+ serves them
+// paged from /groups/{id}/children; older servers answer 404 there and embed
+// them in the group representation instead.
+func (kc *Keycloak) childGroups(ctx context.Context, groupID string) ([]gocloak.Group, error) {
+	var out []gocloak.Group
+	first := 0
+	for {
+		var page []gocloak.Group
+		err := kc.withRetry(ctx, func(token string) error {
+			resp, err := kc.client.GetRequestWithBearerAuth(ctx, token).
+				SetResult(&page).
+				SetQueryParams(map[string]string{
+					"first": strconv.Itoa(first),
+					"max":   strconv.Itoa(kcGroupSearchPageSize),
+				}).
+				Get(kc.adminURL("groups", groupID, "children"))
+			if err != nil {
+				return err
+			}
+			if resp.IsError() {
+				return &gocloak.APIError{Code: resp.StatusCode(), Message: resp.Status()}
+			}
+			return nil
+		})
+		if err != nil {
+			var apiErr *gocloak.APIError
+			if first == 0 && errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+				return kc.embeddedSubGroups(ctx, groupID)
+			}
+			return nil, fmt.Errorf("keycloak: list subgroups of %s: %w", groupID, err)
+		}
+		out = append(out, page...)
+
+		first += len(page)
+		if len(page) < kcGroupSearchPageSize {
+			return out, nil
 		}
 	}
+}
+
+// embeddedSubGroups reads a group's subgroups from its representation
+// (Keycloak < 23).
+func (kc *Keycloak) embeddedSubGroups(ctx context.Context, groupID string) ([]gocloak.Group, error) {
+	var group *gocloak.Group
+	err := kc.withRetry(ctx, func(token string) error {
+		var err error
+		group, err = kc.client.GetGroup(ctx, token, kc.realm, groupID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keycloak: get group %s: %w", groupID, err)
+	}
+	if group.SubGroups == nil {
+		return nil, nil
+	}
+	return *group.SubGroups, nil
+}
 
-	return out, nil
+// adminURL builds a URL under the realm's admin API for endpoints gocloak
+// doesn't wrap.
+func (kc *Keycloak) adminURL(path ...string) string {
+	parts := []string{strings.TrimRight(kc.basePath, "/"), "admin", "realms", url.PathEscape(kc.realm)}
+	for _, p := range path {
+		parts = append(parts, url.PathEscape(p))
+	}
+	return strings.Join(parts, "/")
 }
 
 // pagination
 func (kc *Keycloak) fetchGroupMembersPage(ctx context.Context, groupID string, first, max int) ([]*gocloak.User, error) {
-	const (
-		maxAttempts = 5
-		baseBackoff = 300 * time.Millisecond
-	)
-
-	var lastErr error
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		users, err := kc.client.GetGroupMembers(
-			ctx, kc.token, kc.realm, groupID,
+	var users []*gocloak.User
+	err := kc.withRetry(ctx, func(token string) error {
+		var err error
+		users, err = kc.client.GetGroupMembers(
+			ctx, token, kc.realm, groupID,
 			gocloak.GetGroupsParams{
 				First: gocloak.IntP(first),
 				Max:   gocloak.IntP(max),
 			},
 		)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keycloak: failed to get members (first=%d,max=%d): %w", first, max, err)
+	}
+	return users, nil
+}
+
+// kcMaxAttempts is the default number of attempts per request, including
+// the first.
+const kcMaxAttempts = 5
+
+// setRetryAttempts sets the attempts per request of withRetry; see
+// selfRetrier.
+func (kc *Keycloak) setRetryAttempts(n int) { kc.maxAttempts = n }
+
+// retried reports whether withRetry already retried err.
+func (kc *Keycloak) retried(err error) bool { return isKeycloakRetryable(err) }
+
+// withRetry runs fn (see withToken) and retries failures with an exponential
+// backoff. Client errors other than 408/429 won't succeed on retry and are
+// returned at once.
+func (kc *Keycloak) withRetry(ctx context.Context, fn func(token string) error) error {
+	maxAttempts := kcMaxAttempts
+	if kc.maxAttempts > 0 {
+		maxAttempts = kc.maxAttempts
+	}
+	backoff := retry.Policy{BaseDelay: 300 * time.Millisecond, MaxDelay: 5 * time.Second, Jitter: 0.5}
+
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		err := kc.withToken(ctx, fn)
 		if err == nil {
-			return users, nil
+			return nil
 		}
 
 		if ctx.Err() != nil {
-			return nil, ctx.Err()
+			return ctx.Err()
+		}
+		if !isKeycloakRetryable(err) {
+			return err
 		}
 
 		lastErr = err
-		time.Sleep(time.Duration(attempt) * baseBackoff)
+		if attempt < maxAttempts {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff.Delay(attempt)):
+			}
+		}
 	}
-	return nil, fmt.Errorf("keycloak: failed to get members (first=%d,max=%d): %w", first, max, lastErr)
+	return lastErr
+}
+
+// isKeycloakRetryable reports whether a failed call may succeed when
+// repeated: transport errors, timeouts, throttling and server errors.
+func isKeycloakRetryable(err error) bool {
+	var apiErr *gocloak.APIError
+	if !errors.As(err, &apiErr) || apiErr.Code == 0 {
+		return true
+	}
+	switch {
+	case apiErr.Code == http.StatusRequestTimeout, apiErr.Code == http.StatusTooManyRequests:
+		return true
+	case apiErr.Code >= 400 && apiErr.Code < 500:
+		return false
+	default:
+		return true
+	}
+}
+
+// pageUsers calls fetch with growing offsets until it returns a short page,
+// adding every user to set.
+func pageUsers(set *kcUserSet, pageSize int, fetch func(first, max int) ([]*gocloak.User, error)) error {
+	first := 0
+	for {
+		users, err := fetch(first, pageSize)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			set.add(u)
+		}
+
+		first += len(users)
+		// if len of user list < pageSize that is the last page
+		// break pagination
+		if len(users) < pageSize {
+			return nil
+		}
+	}
+}
+
+// kcUserSet collects users in first-seen order, dropping duplicates (a user
+// may be reachable through several groups or roles).
+type kcUserSet struct {
+	users []models.User
+	seen  map[string]struct{}
+}
+
+func newKCUserSet() *kcUserSet {
+	return &kcUserSet{
+		users: make([]models.User, 0, kcMembersPageSize),
+		seen:  make(map[string]struct{}, kcMembersPageSize),
+	}
+}
+
+func (s *kcUserSet) add(u *gocloak.User) {
+	mu := toModelUser(u)
+	if _, ok := s.seen[mu.ID]; ok {
+		return
+	}
+	s.seen[mu.ID] = struct{}{}
+	s.users = append(s.users, mu)
 }
 
 // Mapping keycloak user to models.User{}
@@ -132,13 +532,19 @@ func toModelUser(u *gocloak.User) models.User {
 	userID := gocloak.PString(u.ID)
 	userEmail := gocloak.PString(u.Email)
 	userName := gocloak.PString(u.Username)
-	if !strings.Contains(userName, "@") {
-		userName += "@"
+
+	status := models.UserStatusUnknown
+	if u.Enabled != nil {
+		status = models.UserStatusDisabled
+		if *u.Enabled {
+			status = models.UserStatusActive
+		}
 	}
 
 	return models.User{
 		ID:       userID,
 		Email:    userEmail,
 		Username: userName,
+		Status:   status,
 	}
 }
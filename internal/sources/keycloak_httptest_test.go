@@ -2,24 +2,200 @@ package sources
 
 import (
 	"encoding/json"
+	"fmt"
+	"maps"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"strconv"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
 )
 
-// keycloakTestServer mocks the two Keycloak admin REST endpoints the
-// adapter uses:
+// keycloakTestServer mocks the Keycloak endpoints the adapter uses:
 //
-//	GET /admin/realms/{realm}/groups?search={name}
-//	GET /admin/realms/{realm}/groups/{groupID}/members?first=N&max=N
+//	POST /realms/{realm}/protocol/openid-connect/token  (client-credentials login)
+//	GET  /admin/realms/{realm}/groups?search={name}
+//	GET  /admin/realms/{realm}/group-by-path/{path}
+//	GET  /admin/realms/{realm}/groups/{groupID}/children
+//	GET  /admin/realms/{realm}/groups/{groupID}/members?first=N&max=N
+//	GET  /admin/realms/{realm}/roles[/{role}[/users|/groups]]
+//	GET  /admin/realms/{realm}/roles-by-id/{roleID}/composites
+//	GET  /admin/realms/{realm}/clients[?clientId={id}]
+//	GET  /admin/realms/{realm}/clients/{uuid}/roles[/{role}[/users|/groups]]
 type keycloakTestServer struct {
-	groups        []map[string]string         // {"id","name"} — name-search returns substring matches
-	members       map[string][]map[string]any // groupID -> users (in order)
-	memberCalls   int32
-	failsBeforeOK int32 // /members returns 500 this many times before succeeding
+	groups         []kcTestGroup               // group tree — name-search returns substring matches with their ancestors
+	members        map[string][]map[string]any // groupID -> users (in order)
+	memberCalls    int32
+	compositeCalls int32 // roles-by-id/{roleID}/composites requests
+	failsBeforeOK  int32 // /members returns 500 this many times before succeeding
+
+	// Token issuing. When requireIssued is set, admin calls must carry the
+	// most recently issued token ("tok-<logins>"), anything else gets a 401.
+	logins        int32
+	tokenTTL      int   // expires_in of issued tokens (seconds)
+	requireIssued bool  // enforce the bearer token on admin calls
+	revokeAfter   int32 // after this many /members calls, the current token is revoked (0 = never)
+	revoked       int32
+
+	roles   []kcTestRole      // realm and client roles
+	clients map[string]string // clientId -> client UUID
+}
+
+// kcTestRole is a role with its direct user and group mappings.
+type kcTestRole struct {
+	ID         string
+	Name       string
+	ClientUUID string           // empty for realm roles
+	Composites []string         // IDs of the roles this composite includes
+	Users      []map[string]any // users the role is mapped to directly
+	Groups     []string         // IDs of groups the role is mapped to
+}
+
+// pageKC applies Keycloak's first/max query parameters to items.
+func pageKC[T any](r *http.Request, items []T) []T {
+	first, _ := strconv.Atoi(r.URL.Query().Get("first"))
+	max, _ := strconv.Atoi(r.URL.Query().Get("max"))
+	if max == 0 {
+		max = 100
+	}
+	lo := min(first, len(items))
+	hi := min(lo+max, len(items))
+	return items[lo:hi]
+}
+
+// serveRoles handles the role and client endpoints; segs is the path below
+// /admin/realms/{realm}/. It reports whether the request was handled.
+func (s *keycloakTestServer) serveRoles(w http.ResponseWriter, r *http.Request, segs []string) bool {
+	clientUUID := ""
+	switch {
+	case segs[0] == "clients" && len(segs) == 1:
+		out := []map[string]any{}
+		want, filtered := r.URL.Query()["clientId"]
+		for _, clientID := range slices.Sorted(maps.Keys(s.clients)) {
+			if !filtered || clientID == want[0] {
+				out = append(out, map[string]any{"id": s.clients[clientID], "clientId": clientID})
+			}
+		}
+		_ = json.NewEncoder(w).Encode(pageKC(r, out))
+		return true
+	case segs[0] == "clients" && len(segs) >= 3 && segs[2] == "roles":
+		clientUUID = segs[1]
+		segs = segs[2:]
+	case segs[0] == "roles-by-id" && len(segs) == 3 && segs[2] == "composites":
+		atomic.AddInt32(&s.compositeCalls, 1)
+		out := []map[string]any{}
+		for _, role := range s.roles {
+			if role.ID != segs[1] {
+				continue
+			}
+			for _, id := range role.Composites {
+				for _, c := range s.roles {
+					if c.ID == id {
+						out = append(out, s.roleJSON(c))
+					}
+				}
+			}
+		}
+		_ = json.NewEncoder(w).Encode(out)
+		return true
+	case segs[0] != "roles":
+		return false
+	}
+
+	if len(segs) == 1 {
+		out := []map[string]any{}
+		for _, role := range s.roles {
+			if role.ClientUUID == clientUUID {
+				out = append(out, s.roleJSON(role))
+			}
+		}
+		_ = json.NewEncoder(w).Encode(pageKC(r, out))
+		return true
+	}
+
+	var role *kcTestRole
+	for i := range s.roles {
+		if s.roles[i].Name == segs[1] && s.roles[i].ClientUUID == clientUUID {
+			role = &s.roles[i]
+		}
+	}
+	if role == nil {
+		http.Error(w, `{"error":"Could not find role"}`, http.StatusNotFound)
+		return true
+	}
+
+	switch {
+	case len(segs) == 2:
+		_ = json.NewEncoder(w).Encode(s.roleJSON(*role))
+	case segs[2] == "users":
+		users := role.Users
+		if users == nil {
+			users = []map[string]any{}
+		}
+		_ = json.NewEncoder(w).Encode(pageKC(r, users))
+	case segs[2] == "groups":
+		out := []kcTestGroup{}
+		for _, id := range role.Groups {
+			if g, ok := findKCGroup(s.groups, func(g kcTestGroup) bool { return g.ID == id }); ok {
+				out = append(out, g)
+			}
+		}
+		_ = json.NewEncoder(w).Encode(pageKC(r, out))
+	default:
+		return false
+	}
+	return true
+}
+
+func (s *keycloakTestServer) roleJSON(role kcTestRole) map[string]any {
+	return map[string]any{
+		"id":          role.ID,
+		"name":        role.Name,
+		"composite":   len(role.Composites) > 0,
+		"clientRole":  role.ClientUUID != "",
+		"containerId": role.ClientUUID,
+	}
+}
+
+// kcTestGroup is a group tree node as Keycloak serializes it.
+type kcTestGroup struct {
+	ID        string        `json:"id"`
+	Name      string        `json:"name"`
+	Path      string        `json:"path,omitempty"`
+	SubGroups []kcTestGroup `json:"subGroups,omitempty"`
+}
+
+// searchKCGroups mimics Keycloak's search: top-level groups are returned when
+// they or any descendant match, with subGroups pruned to the matching branches.
+func searchKCGroups(groups []kcTestGroup, term string) []kcTestGroup {
+	out := []kcTestGroup{}
+	for _, g := range groups {
+		subs := searchKCGroups(g.SubGroups, term)
+		if term == "" || strings.Contains(g.Name, term) || len(subs) > 0 {
+			g.SubGroups = subs
+			out = append(out, g)
+		}
+	}
+	return out
+}
+
+// findKCGroup returns the group matching pred anywhere in the tree.
+func findKCGroup(groups []kcTestGroup, pred func(kcTestGroup) bool) (kcTestGroup, bool) {
+	for _, g := range groups {
+		if pred(g) {
+			return g, true
+		}
+		if found, ok := findKCGroup(g.SubGroups, pred); ok {
+			return found, true
+		}
+	}
+	return kcTestGroup{}, false
 }
 
 func (s *keycloakTestServer) handler(t *testing.T, realm string) http.Handler {
@@ -28,19 +204,62 @@ func (s *keycloakTestServer) handler(t *testing.T, realm string) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 
+		if r.URL.Path == "/realms/"+realm+"/protocol/openid-connect/token" {
+			if id, secret, ok := r.BasicAuth(); !ok || id != "pf-client" || secret != "pf-secret" {
+				http.Error(w, `{"error":"unauthorized_client"}`, http.StatusUnauthorized)
+				return
+			}
+			n := atomic.AddInt32(&s.logins, 1)
+			atomic.StoreInt32(&s.revoked, 0)
+			_ = json.NewEncoder(w).Encode(map[string]any{
+				"access_token": fmt.Sprintf("tok-%d", n),
+				"expires_in":   s.tokenTTL,
+				"token_type":   "Bearer",
+			})
+			return
+		}
+
+		if s.requireIssued {
+			want := fmt.Sprintf("Bearer tok-%d", atomic.LoadInt32(&s.logins))
+			if r.Header.Get("Authorization") != want || atomic.LoadInt32(&s.revoked) == 1 {
+				http.Error(w, `{"error":"HTTP 401 Unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
+		}
+
 		switch {
 		case r.URL.Path == prefix:
-			search := r.URL.Query().Get("search")
-			out := []map[string]string{}
-			for _, g := range s.groups {
-				if search == "" || strings.Contains(g["name"], search) {
-					out = append(out, g)
-				}
+			_ = json.NewEncoder(w).Encode(searchKCGroups(s.groups, r.URL.Query().Get("search")))
+
+		case strings.HasPrefix(r.URL.Path, "/admin/realms/"+realm+"/group-by-path/"):
+			path := "/" + strings.TrimPrefix(r.URL.Path, "/admin/realms/"+realm+"/group-by-path/")
+			g, ok := findKCGroup(s.groups, func(g kcTestGroup) bool { return g.Path == path })
+			if !ok {
+				http.Error(w, `{"error":"Group path does not exist"}`, http.StatusNotFound)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(g)
+
+		case strings.HasPrefix(r.URL.Path, prefix+"/") && strings.HasSuffix(r.URL.Path, "/children"):
+			id := strings.Split(strings.TrimPrefix(r.URL.Path, prefix+"/"), "/")[0]
+			g, ok := findKCGroup(s.groups, func(g kcTestGroup) bool { return g.ID == id })
+			if !ok {
+				http.NotFound(w, r)
+				return
 			}
-			_ = json.NewEncoder(w).Encode(out)
+			children := g.SubGroups
+			if children == nil {
+				children = []kcTestGroup{}
+			}
+			_ = json.NewEncoder(w).Encode(children)
 
 		case strings.HasPrefix(r.URL.Path, prefix+"/") && strings.HasSuffix(r.URL.Path, "/members"):
-			atomic.AddInt32(&s.memberCalls, 1)
+			if n := atomic.AddInt32(&s.memberCalls, 1); s.revokeAfter > 0 && n == s.revokeAfter+1 {
+				// Simulate the token being revoked mid-pagination.
+				atomic.StoreInt32(&s.revoked, 1)
+				http.Error(w, `{"error":"HTTP 401 Unauthorized"}`, http.StatusUnauthorized)
+				return
+			}
 
 			if remaining := atomic.LoadInt32(&s.failsBeforeOK); remaining > 0 {
 				atomic.AddInt32(&s.failsBeforeOK, -1)
@@ -68,6 +287,9 @@ func (s *keycloakTestServer) handler(t *testing.T, realm string) http.Handler {
 			}
 			_ = json.NewEncoder(w).Encode(users[lo:hi])
 
+		case strings.HasPrefix(r.URL.Path, "/admin/realms/"+realm+"/") &&
+			s.serveRoles(w, r, strings.Split(strings.TrimPrefix(r.URL.Path, "/admin/realms/"+realm+"/"), "/")):
+
 		default:
 			t.Errorf("unexpected request: %s %s", r.Method, r.URL.String())
 			http.NotFound(w, r)
@@ -103,15 +325,15 @@ func mkKCUsers(n int) []map[string]any {
 
 func TestKeycloak_GetGroupByName_Found(t *testing.T) {
 	state := &keycloakTestServer{
-		groups: []map[string]string{
-			{"id": "kc-eng", "name": "engineering"},
+		groups: []kcTestGroup{
+			{ID: "kc-eng", Name: "engineering", Path: "/engineering"},
 		},
 	}
 	srv := httptest.NewServer(state.handler(t, "myrealm"))
 	defer srv.Close()
 
 	c := newKeycloakTestClient(t, srv, "myrealm")
-	g, err := c.GetGroupByName("engineering")
+	g, err := c.GetGroupByName(t.Context(), "engineering")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -124,15 +346,15 @@ func TestKeycloak_GetGroupByName_SearchSubstringMatchRejected(t *testing.T) {
 	// Keycloak's `search` is substring; the adapter must filter to exact-name
 	// matches so "eng" does not return "engineering" as if it matched.
 	state := &keycloakTestServer{
-		groups: []map[string]string{
-			{"id": "kc-eng", "name": "engineering"},
+		groups: []kcTestGroup{
+			{ID: "kc-eng", Name: "engineering", Path: "/engineering"},
 		},
 	}
 	srv := httptest.NewServer(state.handler(t, "myrealm"))
 	defer srv.Close()
 
 	c := newKeycloakTestClient(t, srv, "myrealm")
-	g, err := c.GetGroupByName("eng")
+	g, err := c.GetGroupByName(t.Context(), "eng")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -142,12 +364,12 @@ func TestKeycloak_GetGroupByName_SearchSubstringMatchRejected(t *testing.T) {
 }
 
 func TestKeycloak_GetGroupByName_NotFound(t *testing.T) {
-	state := &keycloakTestServer{groups: []map[string]string{}}
+	state := &keycloakTestServer{groups: []kcTestGroup{}}
 	srv := httptest.NewServer(state.handler(t, "myrealm"))
 	defer srv.Close()
 
 	c := newKeycloakTestClient(t, srv, "myrealm")
-	g, err := c.GetGroupByName("ghost")
+	g, err := c.GetGroupByName(t.Context(), "ghost")
 	if err != nil {
 		t.Fatalf("GetGroupByName: %v", err)
 	}
@@ -167,7 +389,7 @@ func TestKeycloak_GetGroupMembers_PaginatesAndDedups(t *testing.T) {
 	defer srv.Close()
 
 	c := newKeycloakTestClient(t, srv, "myrealm")
-	got, err := c.GetGroupMembers(groupID)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
@@ -181,7 +403,7 @@ func TestKeycloak_GetGroupMembers_PaginatesAndDedups(t *testing.T) {
 
 	// Order is preserved.
 	for i, u := range got {
-		want := "user" + strconv.Itoa(i) + "@"
+		want := "user" + strconv.Itoa(i)
 		if u.Username != want {
 			t.Errorf("user[%d].Username = %q, want %q", i, u.Username, want)
 			break
@@ -201,7 +423,7 @@ func TestKeycloak_GetGroupMembers_RetriesOnTransient500(t *testing.T) {
 	defer srv.Close()
 
 	c := newKeycloakTestClient(t, srv, "myrealm")
-	got, err := c.GetGroupMembers(groupID)
+	got, err := c.GetGroupMembers(t.Context(), groupID)
 	if err != nil {
 		t.Fatalf("GetGroupMembers should retry past transient failures: %v", err)
 	}
@@ -210,13 +432,34 @@ func TestKeycloak_GetGroupMembers_RetriesOnTransient500(t *testing.T) {
 	}
 }
 
+func TestKeycloak_WrappedSourceRetriesOnce(t *testing.T) {
+	// With WithRetry the adapter retries each request with the policy's
+	// attempts and the wrapper doesn't retry on top: 2 attempts mean 2
+	// requests, not 2×5 or 2×2.
+	groupID := "kc-eng"
+	state := &keycloakTestServer{
+		members:       map[string][]map[string]any{groupID: mkKCUsers(3)},
+		failsBeforeOK: 100,
+	}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	src := wrapSource(newKeycloakTestClient(t, srv, "myrealm"), WithRetry(retry.Policy{MaxAttempts: 2, BaseDelay: time.Millisecond}))
+	if _, err := src.GetGroupMembers(t.Context(), groupID); err == nil {
+		t.Fatal("expected an error")
+	}
+	if n := atomic.LoadInt32(&state.memberCalls); n != 2 {
+		t.Errorf("member calls = %d, want 2", n)
+	}
+}
+
 func TestKeycloak_GetGroupMembers_EmptyGroup(t *testing.T) {
 	state := &keycloakTestServer{members: map[string][]map[string]any{"kc-empty": nil}}
 	srv := httptest.NewServer(state.handler(t, "myrealm"))
 	defer srv.Close()
 
 	c := newKeycloakTestClient(t, srv, "myrealm")
-	got, err := c.GetGroupMembers("kc-empty")
+	got, err := c.GetGroupMembers(t.Context(), "kc-empty")
 	if err != nil {
 		t.Fatalf("GetGroupMembers: %v", err)
 	}
@@ -227,3 +470,383 @@ func TestKeycloak_GetGroupMembers_EmptyGroup(t *testing.T) {
 		t.Errorf("expected 0 users, got %d", len(got))
 	}
 }
+
+func newKeycloakClientCredentialsTestClient(t *testing.T, srv *httptest.Server, realm string) *Keycloak {
+	t.Helper()
+	c, err := NewKeycloakClient(SourceConfig{
+		Endpoint:             srv.URL,
+		KeycloakRealm:        realm,
+		KeycloakClientID:     "pf-client",
+		KeycloakClientSecret: "pf-secret",
+	})
+	if err != nil {
+		t.Fatalf("NewKeycloakClient: %v", err)
+	}
+	return c
+}
+
+func TestKeycloak_ClientCredentials_LogsInOnce(t *testing.T) {
+	state := &keycloakTestServer{
+		groups:        []kcTestGroup{{ID: "kc-eng", Name: "engineering", Path: "/engineering"}},
+		members:       map[string][]map[string]any{"kc-eng": mkKCUsers(3)},
+		tokenTTL:      300,
+		requireIssued: true,
+	}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakClientCredentialsTestClient(t, srv, "myrealm")
+	g, err := c.GetGroupByName(t.Context(), "engineering")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil {
+		t.Fatalf("expected group, got nil")
+	}
+	users, err := c.GetGroupMembers(t.Context(), g.ID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(users) != 3 {
+		t.Errorf("expected 3 users, got %d", len(users))
+	}
+	if state.logins != 1 {
+		t.Errorf("a valid token must be reused across calls; got %d logins", state.logins)
+	}
+}
+
+func TestKeycloak_ClientCredentials_RenewsExpiredToken(t *testing.T) {
+	state := &keycloakTestServer{
+		groups:        []kcTestGroup{{ID: "kc-eng", Name: "engineering", Path: "/engineering"}},
+		tokenTTL:      300,
+		requireIssued: true,
+	}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakClientCredentialsTestClient(t, srv, "myrealm")
+	if _, err := c.GetGroupByName(t.Context(), "engineering"); err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+
+	// Pretend the token has aged past its refresh point.
+	c.tokenExpiry = c.tokenExpiry.Add(-time.Hour)
+
+	if _, err := c.GetGroupByName(t.Context(), "engineering"); err != nil {
+		t.Fatalf("GetGroupByName after expiry: %v", err)
+	}
+	if state.logins != 2 {
+		t.Errorf("expired token must be renewed; got %d logins", state.logins)
+	}
+}
+
+func TestKeycloak_ClientCredentials_RenewsRevokedTokenDuringPaging(t *testing.T) {
+	// 450 users → 3 pages of 200; the token is revoked after the first page.
+	groupID := "kc-eng"
+	state := &keycloakTestServer{
+		members:       map[string][]map[string]any{groupID: mkKCUsers(450)},
+		tokenTTL:      300,
+		requireIssued: true,
+		revokeAfter:   1,
+	}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakClientCredentialsTestClient(t, srv, "myrealm")
+	got, err := c.GetGroupMembers(t.Context(), groupID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers should survive a revoked token: %v", err)
+	}
+	if len(got) != 450 {
+		t.Errorf("expected 450 users, got %d", len(got))
+	}
+	if state.logins != 2 {
+		t.Errorf("expected one re-login after the 401, got %d logins", state.logins)
+	}
+}
+
+func TestNewKeycloakClient_AuthValidation(t *testing.T) {
+	base := SourceConfig{Endpoint: "https://kc.example.com", KeycloakRealm: "r"}
+
+	noAuth := base
+	if _, err := NewKeycloakClient(noAuth); err == nil {
+		t.Errorf("expected an error without a token or client credentials")
+	}
+
+	noSecret := base
+	noSecret.KeycloakClientID = "pf-client"
+	if _, err := NewKeycloakClient(noSecret); err == nil {
+		t.Errorf("expected an error for a client ID without a secret")
+	}
+
+	client := base
+	client.KeycloakClientID = "pf-client"
+	client.KeycloakClientSecret = "pf-secret"
+	c, err := NewKeycloakClient(client)
+	if err != nil {
+		t.Fatalf("NewKeycloakClient: %v", err)
+	}
+	if c.authRealm != "r" {
+		t.Errorf("auth realm should default to the target realm, got %q", c.authRealm)
+	}
+}
+
+// kcTree is a small hierarchy shared by the subgroup tests:
+//
+//	/engineering
+//	/engineering/sre
+//	/engineering/sre/oncall
+//	/engineering-tools
+//	/ops/sre
+func kcTree() []kcTestGroup {
+	return []kcTestGroup{
+		{ID: "g-eng", Name: "engineering", Path: "/engineering", SubGroups: []kcTestGroup{
+			{ID: "g-eng-sre", Name: "sre", Path: "/engineering/sre", SubGroups: []kcTestGroup{
+				{ID: "g-eng-sre-oncall", Name: "oncall", Path: "/engineering/sre/oncall"},
+			}},
+		}},
+		{ID: "g-eng-tools", Name: "engineering-tools", Path: "/engineering-tools"},
+		{ID: "g-ops", Name: "ops", Path: "/ops", SubGroups: []kcTestGroup{
+			{ID: "g-ops-sre", Name: "sre", Path: "/ops/sre"},
+		}},
+	}
+}
+
+func TestKeycloak_GetGroupByName_ByPath(t *testing.T) {
+	state := &keycloakTestServer{groups: kcTree()}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+	g, err := c.GetGroupByName(t.Context(), "/engineering/sre")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.ID != "g-eng-sre" {
+		t.Fatalf("path lookup wrong: %+v", g)
+	}
+	if g.Name != "/engineering/sre" {
+		t.Errorf("Name must be the requested path so it maps back to the template group, got %q", g.Name)
+	}
+
+	missing, err := c.GetGroupByName(t.Context(), "/engineering/nope")
+	if err != nil {
+		t.Fatalf("missing path must not be an error: %v", err)
+	}
+	if missing != nil {
+		t.Errorf("expected nil for a missing path, got %+v", missing)
+	}
+}
+
+func TestKeycloak_GetGroupByName_ExactMatchAcrossResultsAndSubgroups(t *testing.T) {
+	state := &keycloakTestServer{groups: kcTree()}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+
+	// "engineering" is a prefix of "engineering-tools"; the search returns
+	// both and the exact one must win regardless of order.
+	g, err := c.GetGroupByName(t.Context(), "engineering-tools")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.ID != "g-eng-tools" {
+		t.Errorf("expected engineering-tools, got %+v", g)
+	}
+
+	// A subgroup is found by its bare name.
+	g, err = c.GetGroupByName(t.Context(), "oncall")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.ID != "g-eng-sre-oncall" {
+		t.Errorf("expected nested oncall group, got %+v", g)
+	}
+}
+
+func TestKeycloak_GetGroupByName_AmbiguousNameErrors(t *testing.T) {
+	state := &keycloakTestServer{groups: kcTree()}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+	_, err := c.GetGroupByName(t.Context(), "sre")
+	if err == nil {
+		t.Fatal("expected an error for a name shared by /engineering/sre and /ops/sre")
+	}
+	if !strings.Contains(err.Error(), "/engineering/sre") || !strings.Contains(err.Error(), "/ops/sre") {
+		t.Errorf("error should list the candidate paths: %v", err)
+	}
+}
+
+func TestKeycloak_GetGroupMembers_IncludeSubgroups(t *testing.T) {
+	state := &keycloakTestServer{
+		groups: kcTree(),
+		members: map[string][]map[string]any{
+			"g-eng":            {mkKCUser("u1", "alice", "alice@example.com")},
+			"g-eng-sre":        {mkKCUser("u2", "bob", "bob@example.com"), mkKCUser("u1", "alice", "alice@example.com")},
+			"g-eng-sre-oncall": {mkKCUser("u3", "carol", "carol@example.com")},
+			"g-ops-sre":        {mkKCUser("u4", "dave", "dave@example.com")},
+		},
+	}
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+
+	direct, err := c.GetGroupMembers(t.Context(), "g-eng")
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(direct) != 1 {
+		t.Errorf("without the option only direct members are returned, got %d", len(direct))
+	}
+
+	c.includeSubgroups = true
+	got, err := c.GetGroupMembers(t.Context(), "g-eng")
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	var names []string
+	for _, u := range got {
+		names = append(names, u.Username)
+	}
+	want := []string{"alice", "bob", "carol"}
+	if strings.Join(names, ",") != strings.Join(want, ",") {
+		t.Errorf("members = %v, want %v (descendants included, duplicates dropped, other branches excluded)", names, want)
+	}
+}
+
+// kcRolesServer maps roles onto the kcTree groups:
+//
+//	vpn-admin          realm role: alice directly, and the /ops group tree
+//	net-admins         composite realm role containing vpn-admin: bob
+//	pf-app:operator    client role: carol, and composite pf-app:lead (dave)
+//	vpn-app:bundle     composite client role containing vpn-admin: frank
+func kcRolesServer() *keycloakTestServer {
+	return &keycloakTestServer{
+		groups: kcTree(),
+		members: map[string][]map[string]any{
+			"g-ops":     {mkKCUser("u4", "dave", "dave@example.com")},
+			"g-ops-sre": {mkKCUser("u5", "erin", "erin@example.com"), mkKCUser("u1", "alice", "alice@example.com")},
+		},
+		clients: map[string]string{"pf-app": "c-pf-app", "vpn-app": "c-vpn-app"},
+		roles: []kcTestRole{
+			{ID: "r-vpn", Name: "vpn-admin", Users: []map[string]any{mkKCUser("u1", "alice", "alice@example.com")}, Groups: []string{"g-ops"}},
+			{ID: "r-net", Name: "net-admins", Composites: []string{"r-vpn"}, Users: []map[string]any{mkKCUser("u2", "bob", "bob@example.com")}},
+			{ID: "r-other", Name: "other", Users: []map[string]any{mkKCUser("u9", "mallory", "mallory@example.com")}},
+			{ID: "cr-op", Name: "operator", ClientUUID: "c-pf-app", Users: []map[string]any{mkKCUser("u3", "carol", "carol@example.com")}},
+			{ID: "cr-lead", Name: "lead", ClientUUID: "c-pf-app", Composites: []string{"cr-op"}, Users: []map[string]any{mkKCUser("u4", "dave", "dave@example.com")}},
+			{ID: "cr-bundle", Name: "bundle", ClientUUID: "c-vpn-app", Composites: []string{"r-vpn"}, Users: []map[string]any{mkKCUser("u6", "frank", "frank@example.com")}},
+		},
+	}
+}
+
+func usernames(users []models.User) string {
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestKeycloak_RolesMode_RealmRole(t *testing.T) {
+	state := kcRolesServer()
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+	c.mode = KeycloakModeRoles
+
+	g, err := c.GetGroupByName(t.Context(), "vpn-admin")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.Name != "vpn-admin" {
+		t.Fatalf("unexpected group: %+v", g)
+	}
+
+	got, err := c.GetGroupMembers(t.Context(), g.ID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	// Direct holder, holders of the realm and client composites, then members
+	// of the mapped group and its subgroups (role mappings are inherited),
+	// deduplicated.
+	if want := "alice,bob,frank,dave,erin"; usernames(got) != want {
+		t.Errorf("members = %s, want %s", usernames(got), want)
+	}
+
+	missing, err := c.GetGroupByName(t.Context(), "nope")
+	if err != nil || missing != nil {
+		t.Errorf("missing role must be (nil, nil), got %+v, %v", missing, err)
+	}
+}
+
+func TestKeycloak_RolesMode_ClientRole(t *testing.T) {
+	state := kcRolesServer()
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+	c.mode = KeycloakModeRoles
+
+	g, err := c.GetGroupByName(t.Context(), "pf-app:operator")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.Name != "pf-app:operator" {
+		t.Fatalf("unexpected group: %+v", g)
+	}
+	got, err := c.GetGroupMembers(t.Context(), g.ID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if want := "carol,dave"; usernames(got) != want {
+		t.Errorf("members = %s, want %s", usernames(got), want)
+	}
+
+	for _, name := range []string{"no-such-client:operator", "pf-app:nope"} {
+		missing, err := c.GetGroupByName(t.Context(), name)
+		if err != nil || missing != nil {
+			t.Errorf("%s: expected (nil, nil), got %+v, %v", name, missing, err)
+		}
+	}
+}
+
+func TestKeycloak_RolesMode_CompositesLoadedOnce(t *testing.T) {
+	state := kcRolesServer()
+	srv := httptest.NewServer(state.handler(t, "myrealm"))
+	defer srv.Close()
+
+	c := newKeycloakTestClient(t, srv, "myrealm")
+	c.mode = KeycloakModeRoles
+
+	for _, name := range []string{"vpn-admin", "pf-app:operator", "net-admins"} {
+		g, err := c.GetGroupByName(t.Context(), name)
+		if err != nil || g == nil {
+			t.Fatalf("GetGroupByName(%s): %+v, %v", name, g, err)
+		}
+		if _, err := c.GetGroupMembers(t.Context(), g.ID); err != nil {
+			t.Fatalf("GetGroupMembers(%s): %v", name, err)
+		}
+	}
+	// One request per composite role (net-admins, pf-app:lead,
+	// vpn-app:bundle), however many roles are looked up.
+	if n := atomic.LoadInt32(&state.compositeCalls); n != 3 {
+		t.Errorf("composite calls = %d, want 3", n)
+	}
+}
+
+func TestNewKeycloakClient_ModeValidation(t *testing.T) {
+	_, err := NewKeycloakClient(SourceConfig{
+		Token:         "t",
+		Endpoint:      "http://kc.invalid",
+		KeycloakRealm: "r",
+		KeycloakMode:  "users",
+	})
+	if err == nil {
+		t.Error("expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,389 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/yousysadmin/headscale-pf/internal/models"
+)
+
+// Keycloak modes: what a template group name resolves to.
+const (
+	KeycloakModeGroups = "groups" // a Keycloak group (default)
+	KeycloakModeRoles  = "roles"  // a realm role, or a client role written as "clientId:role"
+)
+
+// Group IDs handed out in roles mode. They carry everything needed to find
+// the role again: "realm-role:<role>" or "client-role:<client UUID>:<role>".
+const (
+	kcRealmRolePrefix  = "realm-role:"
+	kcClientRolePrefix = "client-role:"
+)
+
+// kcRole identifies a realm role (clientUUID empty) or a client role.
+type kcRole struct {
+	id         string
+	name       string
+	clientUUID string
+}
+
+func (r kcRole) groupID() string {
+	if r.clientUUID == "" {
+		return kcRealmRolePrefix + r.name
+	}
+	return kcClientRolePrefix + r.clientUUID + ":" + r.name
+}
+
+// parseKCRoleGroupID is the inverse of kcRole.groupID (without the role ID).
+func parseKCRoleGroupID(groupID string) (kcRole, bool) {
+	if name, ok := strings.CutPrefix(groupID, kcRealmRolePrefix); ok {
+		return kcRole{name: name}, true
+	}
+	if rest, ok := strings.CutPrefix(groupID, kcClientRolePrefix); ok {
+		clientUUID, name, ok := strings.Cut(rest, ":")
+		if ok {
+			return kcRole{name: name, clientUUID: clientUUID}, true
+		}
+	}
+	return kcRole{}, false
+}
+
+// getRoleGroup resolves a template group name to a role: "clientId:role" is
+// a client role, anything else a realm role. A missing client or role is
+// "not found" (nil, nil).
+func (kc *Keycloak) getRoleGroup(ctx context.Context, name string) (*models.Group, error) {
+	role := kcRole{name: name}
+	if clientID, roleName, ok := strings.Cut(name, ":"); ok {
+		clientUUID, err := kc.clientUUID(ctx, clientID)
+		if err != nil || clientUUID == "" {
+			return nil, err
+		}
+		role = kcRole{name: roleName, clientUUID: clientUUID}
+	}
+
+	found, err := kc.getRole(ctx, role)
+	if err != nil || found == nil {
+		return nil, err
+	}
+	return &models.Group{
+		ID:   found.groupID(),
+		Name: name,
+	}, nil
+}
+
+// clientUUID returns the internal ID of the client with the given clientId,
+// or "" if there is none.
+func (kc *Keycloak) clientUUID(ctx context.Context, clientID string) (string, error) {
+	var clients []*gocloak.Client
+	err := kc.withRetry(ctx, func(token string) error {
+		var err error
+		clients, err = kc.client.GetClients(ctx, token, kc.realm, gocloak.GetClientsParams{
+			ClientID: gocloak.StringP(clientID),
+		})
+		return err
+	})
+	if err != nil {
+		return "", fmt.Errorf("keycloak: find client %q: %w", clientID, err)
+	}
+	for _, c := range clients {
+		if gocloak.PString(c.ClientID) == clientID {
+			return gocloak.PString(c.ID), nil
+		}
+	}
+	return "", nil
+}
+
+// getRole loads a role by name, filling in its ID. A missing role is
+// (nil, nil).
+func (kc *Keycloak) getRole(ctx context.Context, role kcRole) (*kcRole, error) {
+	var found *gocloak.Role
+	err := kc.withRetry(ctx, func(token string) error {
+		var err error
+		if role.clientUUID == "" {
+			found, err = kc.client.GetRealmRole(ctx, token, kc.realm, role.name)
+		} else {
+			found, err = kc.client.GetClientRole(ctx, token, kc.realm, role.clientUUID, role.name)
+		}
+		return err
+	})
+	if err != nil {
+		var apiErr *gocloak.APIError
+		if errors.As(err, &apiErr) && apiErr.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("keycloak: get role %q: %w", role.name, err)
+	}
+	role.id = gocloak.PString(found.ID)
+	return &role, nil
+}
+
+// getRoleMembers returns every user holding the role: directly, through a
+// composite role that includes it, or through membership in a group (or a
+// descendant of a group) the role or such a composite is mapped to.
+func (kc *Keycloak) getRoleMembers(ctx context.Context, target kcRole) ([]models.User, error) {
+	role, err := kc.getRole(ctx, target)
+	if err != nil {
+		return nil, err
+	}
+	if role == nil {
+		return nil, fmt.Errorf("keycloak: role %q not found", target.name)
+	}
+
+	granting, err := kc.grantingRoles(ctx, *role)
+	if err != nil {
+		return nil, err
+	}
+
+	set := newKCUserSet()
+	var groupIDs []string
+	seenGroups := make(map[string]struct{})
+	for _, r := range granting {
+		err := pageUsers(set, kcMembersPageSize, func(first, max int) ([]*gocloak.User, error) {
+			return kc.fetchRoleUsersPage(ctx, r, first, max)
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		groups, err := kc.roleGroups(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			// Role mappings are inherited by subgroups.
+			ids, err := kc.descendantGroupIDs(ctx, g)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range ids {
+				if _, ok := seenGroups[id]; !ok {
+					seenGroups[id] = struct{}{}
+					groupIDs = append(groupIDs, id)
+				}
+			}
+		}
+	}
+
+	if err := kc.collectGroupMembers(ctx, set, groupIDs); err != nil {
+		return nil, err
+	}
+	return set.users, nil
+}
+
+// grantingRoles returns target plus every composite role that contains it,
+// directly or transitively.
+func (kc *Keycloak) grantingRoles(ctx context.Context, target kcRole) ([]kcRole, error) {
+	parents, err := kc.compositeParents(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	out := []kcRole{target}
+	seen := map[string]struct{}{target.id: {}}
+	for i := 0; i < len(out); i++ {
+		for _, p := range parents[out[i].id] {
+			if _, ok := seen[p.id]; ok {
+				continue
+			}
+			seen[p.id] = struct{}{}
+			out = append(out, p)
+		}
+	}
+	return out, nil
+}
+
+// compositeParents returns a map from role ID to the composite roles that
+// include it. Candidates are the realm roles and the roles of every client,
+// since a client role may include a realm role or a role of another client.
+// The map doesn't depend on the role looked up, so it is built once per
+// instance; concurrent callers wait for the first build, and a failed build
+// is retried by the next caller.
+func (kc *Keycloak) compositeParents(ctx context.Context) (map[string][]kcRole, error) {
+	kc.parentsMu.Lock()
+	defer kc.parentsMu.Unlock()
+	if kc.parents != nil {
+		return kc.parents, nil
+	}
+
+	candidates, err := kc.listRoles(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	clientUUIDs, err := kc.listClientUUIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, uuid := range clientUUIDs {
+		clientRoles, err := kc.listRoles(ctx, uuid)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, clientRoles...)
+	}
+
+	parents := make(map[string][]kcRole)
+	for _, c := range candidates {
+		if !c.composite {
+			continue
+		}
+		var children []*gocloak.Role
+		err := kc.withRetry(ctx, func(token string) error {
+			var err error
+			children, err = kc.client.GetCompositeRolesByRoleID(ctx, token, kc.realm, c.role.id)
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("keycloak: get composites of role %q: %w", c.role.name, err)
+		}
+		for _, child := range children {
+			id := gocloak.PString(child.ID)
+			parents[id] = append(parents[id], c.role)
+		}
+	}
+	kc.parents = parents
+	return parents, nil
+}
+
+// listClientUUIDs lists the internal IDs of all clients in the realm.
+func (kc *Keycloak) listClientUUIDs(ctx context.Context) ([]string, error) {
+	var out []string
+	first := 0
+	for {
+		var page []*gocloak.Client
+		err := kc.withRetry(ctx, func(token string) error {
+			var err error
+			page, err = kc.client.GetClients(ctx, token, kc.realm, gocloak.GetClientsParams{
+				First: gocloak.IntP(first),
+				Max:   gocloak.IntP(kcMembersPageSize),
+			})
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("keycloak: list clients: %w", err)
+		}
+		for _, c := range page {
+			out = append(out, gocloak.PString(c.ID))
+		}
+		if len(page) < kcMembersPageSize {
+			return out, nil
+		}
+		first += len(page)
+	}
+}
+
+// kcRoleInfo is a listed role and whether it is a composite.
+type kcRoleInfo struct {
+	role      kcRole
+	composite bool
+}
+
+// listRoles lists all realm roles (clientUUID empty) or all roles of a client.
+func (kc *Keycloak) listRoles(ctx context.Context, clientUUID string) ([]kcRoleInfo, error) {
+	var out []kcRoleInfo
+	first := 0
+	for {
+		var page []*gocloak.Role
+		err := kc.withRetry(ctx, func(token string) error {
+			params := gocloak.GetRoleParams{
+				First:               gocloak.IntP(first),
+				Max:                 gocloak.IntP(kcMembersPageSize),
+				BriefRepresentation: gocloak.BoolP(true),
+			}
+			var err error
+			if clientUUID == "" {
+				page, err = kc.client.GetRealmRoles(ctx, token, kc.realm, params)
+			} else {
+				page, err = kc.client.GetClientRoles(ctx, token, kc.realm, clientUUID, params)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, fmt.Errorf("keycloak: list roles: %w", err)
+		}
+		for _, r := range page {
+			out = append(out, kcRoleInfo{
+				role: kcRole{
+					id:         gocloak.PString(r.ID),
+					name:       gocloak.PString(r.Name),
+					clientUUID: clientUUID,
+				},
+				composite: gocloak.PBool(r.Composite),
+			})
+		}
+
+		first += len(page)
+		if len(page) < kcMembersPageSize {
+			return out, nil
+		}
+	}
+}
+
+// fetchRoleUsersPage returns one page of users the role is directly mapped to.
+func (kc *Keycloak) fetchRoleUsersPage(ctx context.Context, role kcRole, first, max int) ([]*gocloak.User, error) {
+	var users []*gocloak.User
+	err := kc.withRetry(ctx, func(token string) error {
+		params := gocloak.GetUsersByRoleParams{
+			First: gocloak.IntP(first),
+			Max:   gocloak.IntP(max),
+		}
+		var err error
+		if role.clientUUID == "" {
+			users, err = kc.client.GetUsersByRoleName(ctx, token, kc.realm, role.name, params)
+		} else {
+			users, err = kc.client.GetUsersByClientRoleName(ctx, token, kc.realm, role.clientUUID, role.name, params)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("keycloak: failed to get users of role %q (first=%d,max=%d): %w", role.name, first, max, err)
+	}
+	return users, nil
+}
+
+// roleGroups returns the IDs of all groups the role is directly mapped to.
+// gocloak's GetGroupsByRole doesn't page, so the endpoint is called directly.
+func (kc *Keycloak) roleGroups(ctx context.Context, role kcRole) ([]string, error) {
+	path := []string{"roles", role.name, "groups"}
+	if role.clientUUID != "" {
+		path = []string{"clients", role.clientUUID, "roles", role.name, "groups"}
+	}
+
+	var ids []string
+	first := 0
+	for {
+		var page []gocloak.Group
+		err := kc.withRetry(ctx, func(token string) error {
+			resp, err := kc.client.GetRequestWithBearerAuth(ctx, token).
+				SetResult(&page).
+				SetQueryParams(map[string]string{
+					"first":               strconv.Itoa(first),
+					"max":                 strconv.Itoa(kcGroupSearchPageSize),
+					"briefRepresentation": "true",
+				}).
+				Get(kc.adminURL(path...))
+			if err != nil {
+				return err
+			}
+			if resp.IsError() {
+				return &gocloak.APIError{Code: resp.StatusCode(), Message: resp.Status()}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("keycloak: list groups of role %q: %w", role.name, err)
+		}
+		for _, g := range page {
+			ids = append(ids, gocloak.PString(g.ID))
+		}
+
+		first += len(page)
+		if len(page) < kcGroupSearchPageSize {
+			return ids, nil
+		}
+	}
+}
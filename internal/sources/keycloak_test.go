@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	gocloak "github.com/Nerzal/gocloak/v13"
+	"github.com/yousysadmin/headscale-pf/internal/models"
 )
 
 func TestToModelUser(t *testing.T) {
@@ -23,10 +24,10 @@ func TestToModelUser(t *testing.T) {
 			},
 			wantID:       "id-1",
 			wantEmail:    "alice@example.com",
-			wantUsername: "alice@",
+			wantUsername: "alice",
 		},
 		{
-			name: "username already contains @ — no double suffix",
+			name: "username already contains @ — kept as is",
 			in: &gocloak.User{
 				ID:       gocloak.StringP("id-2"),
 				Email:    gocloak.StringP("bob@example.com"),
@@ -43,7 +44,7 @@ func TestToModelUser(t *testing.T) {
 			},
 			wantID:       "",
 			wantEmail:    "",
-			wantUsername: "carol@",
+			wantUsername: "carol",
 		},
 	}
 	for _, tc := range cases {
@@ -61,3 +62,20 @@ func TestToModelUser(t *testing.T) {
 		})
 	}
 }
+
+func TestToModelUser_Status(t *testing.T) {
+	cases := []struct {
+		enabled *bool
+		want    models.UserStatus
+	}{
+		{nil, models.UserStatusUnknown},
+		{gocloak.BoolP(true), models.UserStatusActive},
+		{gocloak.BoolP(false), models.UserStatusDisabled},
+	}
+	for _, tc := range cases {
+		got := toModelUser(&gocloak.User{Username: gocloak.StringP("a"), Enabled: tc.enabled})
+		if got.Status != tc.want || got.Active() != (tc.want != models.UserStatusDisabled) {
+			t.Errorf("Enabled=%v: Status = %q (active %v), want %q", gocloak.PBool(tc.enabled), got.Status, got.Active(), tc.want)
+		}
+	}
+}
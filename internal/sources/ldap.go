@@ -4,14 +4,23 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"strconv"
 	"strings"
-	"time"
 
 	ldap "github.com/go-ldap/ldap/v3"
 
 	"github.com/yousysadmin/headscale-pf/internal/models"
 )
 
+// ldapFilterGroupPrefix marks the ID of a virtual group defined by an LDAP
+// filter (see LDAP.FilterGroups). Real group IDs are DNs, which always
+// contain "=", so the prefix cannot collide with them.
+const ldapFilterGroupPrefix = "filter:"
+
+// ldapPageSize is the paging size used for searches that may return many
+// entries (filter-defined groups).
+const ldapPageSize = 500
+
 // LDAP implements Source for LDAP directories (AD / OpenLDAP / JumpCloud LDAPaaS).
 // It supports:
 //   - groupOfNames / group via "member" / "uniqueMember" (DN-valued)
@@ -39,6 +48,16 @@ type LDAP struct {
 
 	// Domain used to synthesize an email when none is present (username@DefaultEmailDomain).
 	DefaultEmailDomain string
+
+	// FilterGroups maps a template group name to an LDAP filter. Such groups
+	// are virtual: they don't exist in the directory, their members are the
+	// user entries matching the filter, e.g.
+	// "berlin-office" => "(&(objectClass=person)(l=Berlin))".
+	FilterGroups map[string]string
+
+	// dial opens a connection to the server; nil means dialServer. Tests
+	// replace it with a fake ldap.Client.
+	dial func() (ldap.Client, error)
 }
 
 // NewLDAPClient constructs an LDAP client with sensible defaults.
@@ -59,6 +78,12 @@ func NewLDAPClient(config SourceConfig) (*LDAP, error) {
 		config.LDAPDefaultEmailDomain = "example.com"
 	}
 
+	for name, filter := range config.LDAPFilterGroups {
+		if _, err := ldap.CompileFilter(filter); err != nil {
+			return nil, fmt.Errorf("ldap filter group %q: invalid filter %q: %w", name, filter, err)
+		}
+	}
+
 	host := config.Endpoint
 	if i := strings.LastIndex(host, ":"); i >= 0 {
 		host = host[:i]
@@ -82,17 +107,27 @@ func NewLDAPClient(config SourceConfig) (*LDAP, error) {
 		GroupObjectClasses:   []string{"groupOfNames", "group", "posixGroup"},
 		ExpandOneLevelNested: false,
 		DefaultEmailDomain:   config.LDAPDefaultEmailDomain,
+		FilterGroups:         config.LDAPFilterGroups,
 	}, nil
 }
 
 // GetGroupByName finds the first group whose GroupNameAttr (default "cn")
 // exactly matches the provided groupName. It returns the group's DN as ID.
-func (c *LDAP) GetGroupByName(groupName string) (*models.Group, error) {
-	conn, err := c.connect()
+// A name configured in FilterGroups resolves to a virtual group without
+// touching the directory; its members are resolved by GetGroupMembers.
+func (c *LDAP) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
+	if _, ok := c.FilterGroups[groupName]; ok {
+		return &models.Group{
+			ID:   ldapFilterGroupPrefix + groupName,
+			Name: groupName,
+		}, nil
+	}
+
+	conn, release, err := c.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer release()
 
 	filter := fmt.Sprintf(
 		"(&(|%s)(%s=%s))",
@@ -111,7 +146,7 @@ func (c *LDAP) GetGroupByName(groupName string) (*models.Group, error) {
 
 	sr, err := conn.SearchWithPaging(req, 50)
 	if err != nil {
-		return nil, fmt.Errorf("search group by name: %w", err)
+		return nil, ctxErr(ctx, fmt.Errorf("search group by name: %w", err))
 	}
 	if len(sr.Entries) == 0 {
 		return nil, nil
@@ -128,12 +163,22 @@ func (c *LDAP) GetGroupByName(groupName string) (*models.Group, error) {
 // For posixGroup, it resolves memberUid logins to user entries.
 // For groupOfNames/group, it resolves each member DN to a user entry.
 // If ExpandOneLevelNested is true, a member that is itself a group will be expanded one level.
-func (c *LDAP) GetGroupMembers(groupID string) ([]models.User, error) {
-	conn, err := c.connect()
+// For a virtual group (see FilterGroups) it returns the users matching the group's filter.
+func (c *LDAP) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	conn, release, err := c.connect(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	defer release()
+
+	if name, ok := strings.CutPrefix(groupID, ldapFilterGroupPrefix); ok {
+		filter, ok := c.FilterGroups[name]
+		if !ok {
+			return nil, fmt.Errorf("ldap filter group %q is not configured", name)
+		}
+		users, err := c.searchUsersByFilter(conn, filter)
+		return users, ctxErr(ctx, err)
+	}
 
 	// Load the group entry by DN
 	groupReq := ldap.NewSearchRequest(
@@ -145,7 +190,7 @@ func (c *LDAP) GetGroupMembers(groupID string) ([]models.User, error) {
 	)
 	gsr, err := conn.Search(groupReq)
 	if err != nil {
-		return nil, fmt.Errorf("resolve group DN %q: %w", groupID, err)
+		return nil, ctxErr(ctx, fmt.Errorf("resolve group DN %q: %w", groupID, err))
 	}
 	if len(gsr.Entries) == 0 {
 		return nil, fmt.Errorf("group DN %q not found", groupID)
@@ -159,6 +204,9 @@ func (c *LDAP) GetGroupMembers(groupID string) ([]models.User, error) {
 	if hasObjectClass(groupClasses, "posixGroup") {
 		memberUids := group.GetAttributeValues(c.PosixMemberUidAttr)
 		for _, u := range memberUids {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			user, err := c.lookupUserByLogin(conn, u)
 			if err != nil {
 				// Skip missing users, keep going
@@ -179,6 +227,9 @@ func (c *LDAP) GetGroupMembers(groupID string) ([]models.User, error) {
 	if c.ExpandOneLevelNested && len(memberDNs) > 0 {
 		expanded := make([]string, 0, len(memberDNs))
 		for _, dn := range memberDNs {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
 			isGroup, err := c.dnIsGroup(conn, dn)
 			if err != nil {
 				continue
@@ -206,15 +257,10 @@ func (c *LDAP) GetGroupMembers(groupID string) ([]models.User, error) {
 		memberDNs = expanded
 	}
 
-	// Resolve DN members to users with a timeout guard
-	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
-	defer cancel()
-
+	// Resolve DN members to users
 	for _, dn := range memberDNs {
-		select {
-		case <-ctx.Done():
-			return users, ctx.Err()
-		default:
+		if err := ctx.Err(); err != nil {
+			return nil, err
 		}
 		u, err := c.lookupUserByDN(conn, dn)
 		if err == nil {
@@ -226,12 +272,12 @@ func (c *LDAP) GetGroupMembers(groupID string) ([]models.User, error) {
 
 // GetUserInfo resolves a user by ID. If userID looks like a DN, it loads that DN.
 // Otherwise it treats userID as a login (sAMAccountName/uid/cn—config-driven) and searches.
-func (c *LDAP) GetUserInfo(userID string) (models.User, error) {
-	conn, err := c.connect()
+func (c *LDAP) GetUserInfo(ctx context.Context, userID string) (models.User, error) {
+	conn, release, err := c.connect(ctx)
 	if err != nil {
 		return models.User{}, err
 	}
-	defer conn.Close()
+	defer release()
 
 	// DN path
 	if strings.Contains(userID, "=") && strings.Contains(userID, ",") {
@@ -245,37 +291,114 @@ func (c *LDAP) GetUserInfo(userID string) (models.User, error) {
 // LDAPS (UseTLS) wraps the connection in TLS up front. Otherwise StartTLS is
 // required before bind so credentials never travel over plaintext; if StartTLS
 // fails the connection is aborted.
-func (c *LDAP) connect() (*ldap.Conn, error) {
-	tlsConf := &tls.Config{
+// The connection is closed as soon as ctx is done, which aborts the operation
+// in flight; release closes it when the caller is finished.
+func (c *LDAP) connect(ctx context.Context) (conn ldap.Client, release func(), err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	dial := c.dial
+	if dial == nil {
+		dial = c.dialServer
+	}
+	conn, err = dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	release = func() {
+		stop()
+		conn.Close()
+	}
+
+	if !c.UseTLS {
+		if err := conn.StartTLS(c.tlsConfig()); err != nil {
+			release()
+			return nil, nil, ctxErr(ctx, fmt.Errorf("ldap starttls: %w", err))
+		}
+	}
+	if err := conn.Bind(c.BindDN, c.BindPass); err != nil {
+		release()
+		return nil, nil, ctxErr(ctx, fmt.Errorf("ldap bind: %w", err))
+	}
+	return conn, release, nil
+}
+
+// tlsConfig returns the TLS settings for LDAPS and StartTLS.
+func (c *LDAP) tlsConfig() *tls.Config {
+	return &tls.Config{
 		MinVersion:         tls.VersionTLS12,
 		ServerName:         c.Host,
 		InsecureSkipVerify: c.Insecure,
 	}
+}
 
-	var conn *ldap.Conn
-	var err error
+// dialServer connects to Addr, over TLS with UseTLS.
+func (c *LDAP) dialServer() (ldap.Client, error) {
 	if c.UseTLS {
-		conn, err = ldap.DialTLS("tcp", c.Addr, tlsConf)
+		conn, err := ldap.DialTLS("tcp", c.Addr, c.tlsConfig())
 		if err != nil {
 			return nil, fmt.Errorf("ldap dial tls: %w", err)
 		}
-	} else {
-		conn, err = ldap.Dial("tcp", c.Addr)
-		if err != nil {
-			return nil, fmt.Errorf("ldap dial: %w", err)
-		}
-		if err := conn.StartTLS(tlsConf); err != nil {
-			conn.Close()
-			return nil, fmt.Errorf("ldap starttls: %w", err)
-		}
+		return conn, nil
 	}
-	if err := conn.Bind(c.BindDN, c.BindPass); err != nil {
-		conn.Close()
-		return nil, fmt.Errorf("ldap bind: %w", err)
+	conn, err := ldap.Dial("tcp", c.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("ldap dial: %w", err)
 	}
 	return conn, nil
 }
 
+// ctxErr prefers the context's error over err once ctx is done: an operation
+// that failed because connect closed the connection reports the cancellation.
+func ctxErr(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// searchUsersByFilter returns every entry under BaseDN matching filter, mapped
+// via entryToUser. The search is paged so large result sets don't hit the
+// server's size limit.
+func (c *LDAP) searchUsersByFilter(conn ldap.Client, filter string) ([]models.User, error) {
+	req := ldap.NewSearchRequest(
+		c.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		c.userAttrs(),
+		nil,
+	)
+	sr, err := conn.SearchWithPaging(req, ldapPageSize)
+	if err != nil {
+		return nil, fmt.Errorf("search users by filter %q: %w", filter, err)
+	}
+
+	users := make([]models.User, 0, len(sr.Entries))
+	for _, e := range sr.Entries {
+		users = append(users, c.entryToUser(e))
+	}
+	return users, nil
+}
+
+// Account state attributes: Active Directory's userAccountControl, the
+// OpenLDAP ppolicy lock time, and the 389 DS / FreeIPA lock flag.
+const (
+	ldapAttrUserAccountControl = "userAccountControl"
+	ldapAttrPwdLockedTime      = "pwdAccountLockedTime"
+	ldapAttrNsAccountLock      = "nsAccountLock"
+
+	adAccountDisable = 0x2  // userAccountControl ACCOUNTDISABLE
+	adLockout        = 0x10 // userAccountControl LOCKOUT
+)
+
+// userAttrs lists the attributes requested for user entries.
+func (c *LDAP) userAttrs() []string {
+	attrs := []string{"dn", c.UserEmailAttr, ldapAttrUserAccountControl, ldapAttrPwdLockedTime, ldapAttrNsAccountLock}
+	return append(attrs, c.UserLoginAttrs...)
+}
+
 // joinOC builds an LDAP filter fragment that ORs multiple objectClass checks.
 // For example, ["groupOfNames","group"] => "(objectClass=groupOfNames)(objectClass=group)"
 // The caller typically wraps this with an enclosing "(| ... )".
@@ -290,7 +413,7 @@ func (c *LDAP) joinOC(classes []string) string {
 // dnIsGroup returns true if the entry at the given DN has an objectClass that
 // matches any name in GroupObjectClasses. It uses a base-object search to avoid
 // scanning the tree.
-func (c *LDAP) dnIsGroup(conn *ldap.Conn, dn string) (bool, error) {
+func (c *LDAP) dnIsGroup(conn ldap.Client, dn string) (bool, error) {
 	req := ldap.NewSearchRequest(
 		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 5, false,
 		"(objectClass=*)", []string{"objectClass"}, nil,
@@ -321,12 +444,12 @@ func hasObjectClass(values []string, target string) bool {
 
 // lookupUserByDN fetches a user entry by its DN (base-object search) and maps
 // it into models.User via entryToUser.
-func (c *LDAP) lookupUserByDN(conn *ldap.Conn, dn string) (models.User, error) {
+func (c *LDAP) lookupUserByDN(conn ldap.Client, dn string) (models.User, error) {
 	req := ldap.NewSearchRequest(
 		dn,
 		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, 5, false,
 		"(objectClass=*)",
-		append([]string{"dn", c.UserEmailAttr}, c.UserLoginAttrs...),
+		c.userAttrs(),
 		nil,
 	)
 	sr, err := conn.Search(req)
@@ -340,7 +463,7 @@ func (c *LDAP) lookupUserByDN(conn *ldap.Conn, dn string) (models.User, error) {
 // lookupUserByLogin searches the directory subtree (BaseDN) for a user whose
 // login attributes (UserLoginAttrs) equal the provided login. It limits results
 // to avoid ambiguity and returns the first match mapped via entryToUser.
-func (c *LDAP) lookupUserByLogin(conn *ldap.Conn, login string) (models.User, error) {
+func (c *LDAP) lookupUserByLogin(conn ldap.Client, login string) (models.User, error) {
 	// Build an OR filter across allowed user objectClasses and login attrs
 	loginFilterParts := make([]string, 0, len(c.UserLoginAttrs))
 	for _, a := range c.UserLoginAttrs {
@@ -352,7 +475,7 @@ func (c *LDAP) lookupUserByLogin(conn *ldap.Conn, login string) (models.User, er
 		c.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, 10, false,
 		filter,
-		append([]string{"dn", c.UserEmailAttr}, c.UserLoginAttrs...),
+		c.userAttrs(),
 		nil,
 	)
 	sr, err := conn.SearchWithPaging(req, 50)
@@ -365,16 +488,14 @@ func (c *LDAP) lookupUserByLogin(conn *ldap.Conn, login string) (models.User, er
 // entryToUser converts an LDAP entry into models.User.
 // It picks the first non-empty attribute from UserLoginAttrs as "username" and
 // prefers UserEmailAttr for the email. If the email is absent but a username is
-// available and DefaultEmailDomain is set, it synthesizes username@DefaultEmailDomain.
+// available and DefaultEmailDomain is set, it synthesizes username@DefaultEmailDomain
+// (or uses the username itself if it already is an address).
 func (c *LDAP) entryToUser(e *ldap.Entry) models.User {
 	// Username (preferred attr in order)
 	var userName string
 	for _, a := range c.UserLoginAttrs {
 		if v := e.GetAttributeValue(a); v != "" {
 			userName = v
-			if !strings.Contains(userName, "@") {
-				userName += "@"
-			}
 			break
 		}
 	}
@@ -382,12 +503,40 @@ func (c *LDAP) entryToUser(e *ldap.Entry) models.User {
 	// Email (fallback: synthesize from username)
 	email := e.GetAttributeValue(c.UserEmailAttr)
 	if email == "" && userName != "" && c.DefaultEmailDomain != "" {
-		email = fmt.Sprintf("%s%s", userName, c.DefaultEmailDomain)
+		email = userName
+		if !strings.Contains(userName, "@") {
+			email = fmt.Sprintf("%s@%s", userName, c.DefaultEmailDomain)
+		}
 	}
 	// Map to models.User. Adjust field names if they differ.
 	return models.User{
 		ID:       e.DN, // user ID = DN
 		Email:    email,
 		Username: userName,
+		Status:   ldapUserStatus(e),
+	}
+}
+
+// ldapUserStatus derives the account state from whichever of the known state
+// attributes the directory returned. Without any of them the status is
+// unknown.
+func ldapUserStatus(e *ldap.Entry) models.UserStatus {
+	if v := e.GetAttributeValue(ldapAttrUserAccountControl); v != "" {
+		if uac, err := strconv.ParseInt(v, 10, 64); err == nil {
+			switch {
+			case uac&adAccountDisable != 0:
+				return models.UserStatusDisabled
+			case uac&adLockout != 0:
+				return models.UserStatusLocked
+			}
+			return models.UserStatusActive
+		}
+	}
+	if e.GetAttributeValue(ldapAttrPwdLockedTime) != "" {
+		return models.UserStatusLocked
+	}
+	if strings.EqualFold(e.GetAttributeValue(ldapAttrNsAccountLock), "true") {
+		return models.UserStatusDisabled
 	}
+	return models.UserStatusUnknown
 }
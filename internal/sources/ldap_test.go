@@ -1,9 +1,11 @@
 package sources
 
 import (
+	"crypto/tls"
 	"testing"
 
 	"github.com/go-ldap/ldap/v3"
+	"github.com/yousysadmin/headscale-pf/internal/models"
 )
 
 func newLDAPForTest() *LDAP {
@@ -40,7 +42,7 @@ func TestEntryToUser(t *testing.T) {
 			},
 			wantID:       "uid=alice,ou=Users,dc=example,dc=com",
 			wantEmail:    "alice@elsewhere.com",
-			wantUsername: "alice@",
+			wantUsername: "alice",
 		},
 		{
 			name: "no mail attr, synthesize from default domain",
@@ -49,11 +51,11 @@ func TestEntryToUser(t *testing.T) {
 				"uid": {"bob"},
 			},
 			wantEmail:    "bob@example.com",
-			wantUsername: "bob@",
+			wantUsername: "bob",
 			wantID:       "uid=bob,ou=Users,dc=example,dc=com",
 		},
 		{
-			name: "username already contains @, not double-suffixed",
+			name: "username already contains @, kept as is",
 			dn:   "uid=carol@corp,ou=Users,dc=example,dc=com",
 			attrs: map[string][]string{
 				"uid":  {"carol@corp"},
@@ -72,7 +74,7 @@ func TestEntryToUser(t *testing.T) {
 				"cn":             {"Dave Daveson"},
 				"mail":           {"dave@example.com"},
 			},
-			wantUsername: "dave@",
+			wantUsername: "dave",
 			wantEmail:    "dave@example.com",
 			wantID:       "CN=dave,OU=Users,DC=example,DC=com",
 		},
@@ -112,8 +114,8 @@ func TestEntryToUser_NoDefaultDomain_NoSynthesis(t *testing.T) {
 	if got.Email != "" {
 		t.Errorf("Email should not be synthesized when DefaultEmailDomain is empty: got %q", got.Email)
 	}
-	if got.Username != "erin@" {
-		t.Errorf("Username should still get @ suffix: got %q", got.Username)
+	if got.Username != "erin" {
+		t.Errorf("Username should still be set: got %q", got.Username)
 	}
 }
 
@@ -138,3 +140,150 @@ func TestHasObjectClass(t *testing.T) {
 		})
 	}
 }
+
+func validLDAPConfig() SourceConfig {
+	return SourceConfig{
+		Endpoint:         "ldap.example.com:636",
+		LDAPBindDN:       "cn=svc,dc=example,dc=com",
+		LDAPBaseDN:       "dc=example,dc=com",
+		LDAPBindPassword: "secret",
+	}
+}
+
+func TestNewLDAPClient_FilterGroups(t *testing.T) {
+	t.Run("valid filter accepted", func(t *testing.T) {
+		cfg := validLDAPConfig()
+		cfg.LDAPFilterGroups = map[string]string{
+			"berlin-office": "(&(objectClass=person)(l=Berlin)(!(employeeType=intern)))",
+		}
+		c, err := NewLDAPClient(cfg)
+		if err != nil {
+			t.Fatalf("NewLDAPClient: %v", err)
+		}
+		if c.FilterGroups["berlin-office"] == "" {
+			t.Errorf("filter group not kept on client: %v", c.FilterGroups)
+		}
+	})
+
+	t.Run("invalid filter rejected at construction", func(t *testing.T) {
+		cfg := validLDAPConfig()
+		cfg.LDAPFilterGroups = map[string]string{"broken": "(&(objectClass=person)"}
+		if _, err := NewLDAPClient(cfg); err == nil {
+			t.Fatal("expected an error for an unbalanced filter")
+		}
+	})
+}
+
+// TestLDAP_GetGroupByName_FilterGroupIsVirtual confirms a configured filter
+// group resolves without a directory round-trip: Addr points nowhere, so any
+// connection attempt would fail the test.
+func TestLDAP_GetGroupByName_FilterGroupIsVirtual(t *testing.T) {
+	c := newLDAPForTest()
+	c.Addr = "127.0.0.1:1"
+	c.FilterGroups = map[string]string{"berlin-office": "(l=Berlin)"}
+
+	g, err := c.GetGroupByName(t.Context(), "berlin-office")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if g == nil || g.Name != "berlin-office" || g.ID != ldapFilterGroupPrefix+"berlin-office" {
+		t.Errorf("virtual group wrong: %+v", g)
+	}
+	if g.Users != nil {
+		t.Errorf("members must be left to GetGroupMembers, got %v", g.Users)
+	}
+}
+
+// fakeLDAP is an ldap.Client answering paged searches with fixed entries. It
+// records the requests; methods the adapter doesn't use panic through the
+// nil embedded interface.
+type fakeLDAP struct {
+	ldap.Client
+	entries  []*ldap.Entry
+	requests []*ldap.SearchRequest
+	pageSize uint32
+	bound    bool
+}
+
+func (f *fakeLDAP) StartTLS(*tls.Config) error { return nil }
+func (f *fakeLDAP) Close() error               { return nil }
+
+func (f *fakeLDAP) Bind(username, password string) error {
+	f.bound = true
+	return nil
+}
+
+func (f *fakeLDAP) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	f.requests = append(f.requests, req)
+	f.pageSize = pagingSize
+	return &ldap.SearchResult{Entries: f.entries}, nil
+}
+
+func TestLDAP_GetGroupMembers_FilterGroup(t *testing.T) {
+	fake := &fakeLDAP{entries: []*ldap.Entry{
+		entry("uid=alice,ou=people,dc=example,dc=com", map[string][]string{"uid": {"alice"}, "mail": {"alice@example.com"}}),
+		entry("uid=bob,ou=people,dc=example,dc=com", map[string][]string{"uid": {"bob"}}),
+	}}
+	c := newLDAPForTest()
+	c.BaseDN = "dc=example,dc=com"
+	c.FilterGroups = map[string]string{"berlin-office": "(&(objectClass=person)(l=Berlin))"}
+	c.dial = func() (ldap.Client, error) { return fake, nil }
+
+	g, err := c.GetGroupByName(t.Context(), "berlin-office")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	users, err := c.GetGroupMembers(t.Context(), g.ID)
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+
+	if !fake.bound {
+		t.Error("the connection must be bound before searching")
+	}
+	if len(fake.requests) != 1 {
+		t.Fatalf("expected one search, got %d", len(fake.requests))
+	}
+	req := fake.requests[0]
+	if req.Filter != "(&(objectClass=person)(l=Berlin))" || req.BaseDN != c.BaseDN || req.Scope != ldap.ScopeWholeSubtree {
+		t.Errorf("search = base %q scope %d filter %q", req.BaseDN, req.Scope, req.Filter)
+	}
+	if req.SizeLimit != 0 || fake.pageSize != ldapPageSize {
+		t.Errorf("search must be paged without a size limit, got size limit %d, page size %d", req.SizeLimit, fake.pageSize)
+	}
+
+	want := []models.User{
+		{ID: "uid=alice,ou=people,dc=example,dc=com", Username: "alice", Email: "alice@example.com"},
+		{ID: "uid=bob,ou=people,dc=example,dc=com", Username: "bob", Email: "bob@example.com"},
+	}
+	if len(users) != len(want) {
+		t.Fatalf("users = %+v, want %+v", users, want)
+	}
+	for i := range want {
+		if users[i] != want[i] {
+			t.Errorf("user %d = %+v, want %+v", i, users[i], want[i])
+		}
+	}
+}
+
+func TestLDAPUserStatus(t *testing.T) {
+	cases := []struct {
+		name  string
+		attrs map[string][]string
+		want  models.UserStatus
+	}{
+		{"no state attributes", map[string][]string{"uid": {"a"}}, models.UserStatusUnknown},
+		{"AD enabled", map[string][]string{"userAccountControl": {"512"}}, models.UserStatusActive},
+		{"AD ACCOUNTDISABLE", map[string][]string{"userAccountControl": {"514"}}, models.UserStatusDisabled},
+		{"AD LOCKOUT", map[string][]string{"userAccountControl": {"528"}}, models.UserStatusLocked},
+		{"ppolicy locked", map[string][]string{"pwdAccountLockedTime": {"000001010000Z"}}, models.UserStatusLocked},
+		{"389 DS / FreeIPA lock", map[string][]string{"nsAccountLock": {"TRUE"}}, models.UserStatusDisabled},
+		{"nsAccountLock false", map[string][]string{"nsAccountLock": {"false"}}, models.UserStatusUnknown},
+	}
+	c := newLDAPForTest()
+	for _, tc := range cases {
+		if got := c.entryToUser(entry("uid=a,dc=x", tc.attrs)).Status; got != tc.want {
+			t.Errorf("%s: Status = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
+)
+
+// ErrCircuitOpen is returned without contacting the source while the circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open: source keeps failing")
+
+// IsRetryable reports whether err looks transient: besides the failures
+// retry.IsRetryable accepts, Keycloak transport and server errors and busy or
+// unavailable LDAP servers. An open circuit and everything else (4xx,
+// not-found, ambiguous names, ...) are fatal.
+func IsRetryable(err error) bool {
+	if errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var kcErr *gocloak.APIError
+	if errors.As(err, &kcErr) {
+		return kcErr.Code == 0 || retry.IsRetryableStatus(kcErr.Code)
+	}
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		switch ldapErr.ResultCode {
+		case ldap.ErrorNetwork, ldap.LDAPResultBusy, ldap.LDAPResultUnavailable,
+			ldap.LDAPResultServerDown, ldap.LDAPResultTimeout:
+			return true
+		}
+		return false
+	}
+	return retry.IsRetryable(err)
+}
+
+// circuitBreaker opens after threshold consecutive failed calls and rejects
+// calls until cooldown has passed. Then a single trial call is let through:
+// success closes the circuit, failure opens it again.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	trial     bool // a trial call is in flight
+}
+
+// allow reports whether a call may go ahead.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.trial || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.trial = true
+	return true
+}
+
+// record updates the breaker with the outcome of an allowed call. Only
+// transient failures count; a fatal error says nothing about the source's
+// health.
+func (b *circuitBreaker) record(err error, retryable bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.trial = false
+	switch {
+	case err == nil:
+		b.failures = 0
+	case retryable:
+		b.failures++
+		if b.failures >= b.threshold {
+			b.openUntil = time.Now().Add(b.cooldown)
+		}
+	}
+}
+
+// Option configures a Source returned by NewSource.
+type Option func(*sourceOptions)
+
+type sourceOptions struct {
+	retry   *retry.Policy
+	breaker *circuitBreaker
+	cache   *CacheConfig
+}
+
+// WithRetry retries failed calls according to p.
+func WithRetry(p retry.Policy) Option {
+	return func(o *sourceOptions) { o.retry = &p }
+}
+
+// WithCircuitBreaker stops calling the source for cooldown after threshold
+// consecutive transient failures. A threshold below 1 disables it.
+func WithCircuitBreaker(threshold int, cooldown time.Duration) Option {
+	return func(o *sourceOptions) {
+		if threshold < 1 {
+			o.breaker = nil
+			return
+		}
+		o.breaker = &circuitBreaker{threshold: threshold, cooldown: cooldown}
+	}
+}
+
+// selfRetrier is implemented by adapters that retry failed requests on their
+// own, one page or lookup at a time. wrapSource hands them the retry policy
+// and retries only the errors they don't, so a failed page isn't retried by
+// restarting the whole call and attempts don't multiply.
+type selfRetrier interface {
+	// setRetryAttempts sets the attempts per request, including the first.
+	setRetryAttempts(n int)
+	// retried reports whether the adapter already retried err.
+	retried(err error) bool
+}
+
+// resilientSource wraps a Source with retries and a circuit breaker.
+type resilientSource struct {
+	src     Source
+	policy  retry.Policy
+	breaker *circuitBreaker // nil if disabled
+	// transient decides which failures count towards the breaker.
+	transient func(error) bool
+}
+
+// wrapSource applies the retry and circuit breaker options to src. Without
+// them src is returned as is.
+func wrapSource(src Source, opts ...Option) Source {
+	var o sourceOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.retry == nil && o.breaker == nil {
+		return src
+	}
+
+	rs := &resilientSource{src: src, breaker: o.breaker}
+	if o.retry != nil {
+		rs.policy = *o.retry
+	}
+	if rs.policy.Retryable == nil {
+		rs.policy.Retryable = IsRetryable
+	}
+	rs.transient = rs.policy.Retryable
+	if r, ok := src.(selfRetrier); ok && o.retry != nil {
+		r.setRetryAttempts(max(rs.policy.MaxAttempts, 1))
+		rs.policy.Retryable = func(err error) bool {
+			return rs.transient(err) && !r.retried(err)
+		}
+	}
+	return rs
+}
+
+func (s *resilientSource) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
+	var group *models.Group
+	err := s.do(ctx, func() error {
+		var err error
+		group, err = s.src.GetGroupByName(ctx, groupName)
+		return err
+	})
+	return group, err
+}
+
+func (s *resilientSource) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	var users []models.User
+	err := s.do(ctx, func() error {
+		var err error
+		users, err = s.src.GetGroupMembers(ctx, groupID)
+		return err
+	})
+	return users, err
+}
+
+// do runs call with the retry policy, going through the circuit breaker on
+// every attempt.
+func (s *resilientSource) do(ctx context.Context, call func() error) error {
+	return s.policy.Do(ctx, func() error {
+		if s.breaker != nil && !s.breaker.allow() {
+			return ErrCircuitOpen
+		}
+		err := call()
+		if s.breaker != nil && ctx.Err() == nil {
+			s.breaker.record(err, err != nil && s.transient(err))
+		}
+		return err
+	})
+}
@@ -0,0 +1,210 @@
+package sources
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	gocloak "github.com/Nerzal/gocloak/v13"
+	ldap "github.com/go-ldap/ldap/v3"
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/internal/retry"
+)
+
+// flakySource fails the first failures calls with err, then succeeds.
+type flakySource struct {
+	mu       sync.Mutex
+	calls    int
+	failures int
+	err      error
+}
+
+func (s *flakySource) call() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.failures < 0 || s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakySource) GetGroupByName(_ context.Context, name string) (*models.Group, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return &models.Group{ID: name, Name: name}, nil
+}
+
+func (s *flakySource) GetGroupMembers(_ context.Context, _ string) ([]models.User, error) {
+	if err := s.call(); err != nil {
+		return nil, err
+	}
+	return []models.User{{ID: "u1", Username: "alice@"}}, nil
+}
+
+// selfRetryingSource is a flakySource that claims to retry HTTP 5xx
+// responses itself, like the JumpCloud and Keycloak adapters.
+type selfRetryingSource struct {
+	flakySource
+	attempts int
+}
+
+func (s *selfRetryingSource) setRetryAttempts(n int) { s.attempts = n }
+
+func (s *selfRetryingSource) retried(err error) bool {
+	var statusErr *retry.StatusError
+	return errors.As(err, &statusErr) && statusErr.Code >= 500
+}
+
+var testRetry = retry.Policy{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond}
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"http 503", &retry.StatusError{Code: 503, Err: errors.New("503")}, true},
+		{"http 404", &retry.StatusError{Code: 404, Err: errors.New("404")}, false},
+		{"keycloak 502", &gocloak.APIError{Code: 502}, true},
+		{"keycloak 403", &gocloak.APIError{Code: 403}, false},
+		{"keycloak transport", &gocloak.APIError{Code: 0}, true},
+		{"ldap network", ldap.NewError(ldap.ErrorNetwork, errors.New("reset")), true},
+		{"ldap busy", ldap.NewError(ldap.LDAPResultBusy, errors.New("busy")), true},
+		{"ldap invalid credentials", ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("bad")), false},
+		{"net", &net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{"circuit open", ErrCircuitOpen, false},
+		{"circuit open wrapped", fmt.Errorf("x: %w", ErrCircuitOpen), false},
+		{"other", errors.New(`ambiguous group name "eng"`), false},
+	}
+	for _, tc := range cases {
+		if got := IsRetryable(tc.err); got != tc.want {
+			t.Errorf("%s: IsRetryable = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestWrapSource_NoOptions(t *testing.T) {
+	src := &flakySource{}
+	if got := wrapSource(src); got != Source(src) {
+		t.Errorf("without options the source must be returned unwrapped")
+	}
+}
+
+func TestResilientSource_RetriesTransientErrors(t *testing.T) {
+	src := &flakySource{failures: 2, err: &retry.StatusError{Code: 503, Err: errors.New("503 Service Unavailable")}}
+	rs := wrapSource(src, WithRetry(testRetry))
+
+	users, err := rs.GetGroupMembers(t.Context(), "g1")
+	if err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if len(users) != 1 || src.calls != 3 {
+		t.Errorf("expected success on the 3rd call, got %d users after %d calls", len(users), src.calls)
+	}
+}
+
+func TestResilientSource_FatalErrorNotRetried(t *testing.T) {
+	src := &flakySource{failures: -1, err: &retry.StatusError{Code: 404, Err: errors.New("404 Not Found")}}
+	rs := wrapSource(src, WithRetry(testRetry))
+
+	_, err := rs.GetGroupByName(t.Context(), "eng")
+	if err == nil || src.calls != 1 {
+		t.Errorf("expected one call and an error, got %d calls, err %v", src.calls, err)
+	}
+}
+
+func TestResilientSource_GivesUp(t *testing.T) {
+	transient := &retry.StatusError{Code: 502, Err: errors.New("502 Bad Gateway")}
+	src := &flakySource{failures: -1, err: transient}
+	rs := wrapSource(src, WithRetry(testRetry))
+
+	_, err := rs.GetGroupByName(t.Context(), "eng")
+	if !errors.Is(err, transient) || src.calls != 3 {
+		t.Errorf("expected 3 calls and the last error, got %d calls, err %v", src.calls, err)
+	}
+}
+
+func TestResilientSource_StopsOnCancel(t *testing.T) {
+	src := &flakySource{failures: -1, err: &retry.StatusError{Code: 503, Err: errors.New("503")}}
+	rs := wrapSource(src, WithRetry(retry.Policy{MaxAttempts: 5, BaseDelay: time.Hour}))
+
+	ctx, cancel := context.WithTimeout(t.Context(), 20*time.Millisecond)
+	defer cancel()
+	_, err := rs.GetGroupByName(ctx, "eng")
+	if !errors.Is(err, context.DeadlineExceeded) || src.calls != 1 {
+		t.Errorf("expected the backoff wait to end with the context, got %d calls, err %v", src.calls, err)
+	}
+}
+
+func TestResilientSource_CircuitBreaker(t *testing.T) {
+	src := &flakySource{failures: 2, err: &retry.StatusError{Code: 503, Err: errors.New("503")}}
+	rs := wrapSource(src, WithCircuitBreaker(2, 30*time.Millisecond))
+
+	for range 2 {
+		if _, err := rs.GetGroupByName(t.Context(), "eng"); err == nil {
+			t.Fatalf("expected the source error")
+		}
+	}
+	if _, err := rs.GetGroupByName(t.Context(), "eng"); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("expected ErrCircuitOpen after 2 failures, got %v", err)
+	}
+	if src.calls != 2 {
+		t.Errorf("an open circuit must not call the source, got %d calls", src.calls)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, err := rs.GetGroupByName(t.Context(), "eng"); err != nil {
+		t.Fatalf("trial call after the cooldown: %v", err)
+	}
+	if _, err := rs.GetGroupByName(t.Context(), "eng"); err != nil {
+		t.Errorf("a successful trial must close the circuit: %v", err)
+	}
+}
+
+func TestResilientSource_FatalErrorsDontTripBreaker(t *testing.T) {
+	src := &flakySource{failures: 3, err: &retry.StatusError{Code: 404, Err: errors.New("404")}}
+	rs := wrapSource(src, WithCircuitBreaker(2, time.Hour))
+
+	for range 3 {
+		_, _ = rs.GetGroupByName(t.Context(), "eng")
+	}
+	if _, err := rs.GetGroupByName(t.Context(), "eng"); err != nil {
+		t.Errorf("fatal errors must not open the circuit: %v", err)
+	}
+}
+
+func TestResilientSource_LeavesAdapterRetriesInPlace(t *testing.T) {
+	src := &selfRetryingSource{flakySource: flakySource{failures: -1, err: &retry.StatusError{Code: 503, Err: errors.New("503")}}}
+	rs := wrapSource(src, WithRetry(testRetry), WithCircuitBreaker(1, time.Hour))
+
+	if _, err := rs.GetGroupMembers(t.Context(), "g1"); err == nil {
+		t.Fatal("expected the source error")
+	}
+	if src.attempts != testRetry.MaxAttempts {
+		t.Errorf("adapter attempts = %d, want %d", src.attempts, testRetry.MaxAttempts)
+	}
+	if src.calls != 1 {
+		t.Errorf("an error the adapter already retried must not restart the call, got %d calls", src.calls)
+	}
+	if _, err := rs.GetGroupMembers(t.Context(), "g1"); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("adapter-retried failures must still count for the breaker, got %v", err)
+	}
+}
+
+func TestResilientSource_RetriesWhatAdapterDoesNot(t *testing.T) {
+	src := &selfRetryingSource{flakySource: flakySource{failures: 1, err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}}
+	rs := wrapSource(src, WithRetry(testRetry))
+
+	if _, err := rs.GetGroupMembers(t.Context(), "g1"); err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	if src.calls != 2 {
+		t.Errorf("expected success on the 2nd call, got %d calls", src.calls)
+	}
+}
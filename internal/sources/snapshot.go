@@ -0,0 +1,171 @@
+package sources
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/yousysadmin/headscale-pf/internal/models"
+	"github.com/yousysadmin/headscale-pf/pkg/tools"
+)
+
+// snapshotVersion is the current snapshot file layout.
+const snapshotVersion = 1
+
+// Snapshot is a record of the source results of one run: every group looked
+// up by name and every member list fetched. Replayed with the "snapshot"
+// source it reproduces the run without contacting the source.
+type Snapshot struct {
+	Version   int       `json:"version"`
+	Source    string    `json:"source"` // source the results came from
+	CreatedAt time.Time `json:"created_at"`
+	// Groups holds GetGroupByName results by group name (null: not found),
+	// Members holds GetGroupMembers results by group ID.
+	Groups  map[string]*models.Group `json:"groups"`
+	Members map[string][]models.User `json:"members"`
+}
+
+// ReadSnapshot reads a snapshot file.
+func ReadSnapshot(path string) (*Snapshot, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot: %w", err)
+	}
+	var s Snapshot
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, fmt.Errorf("snapshot: parse %s: %w", path, err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("snapshot: %s has unsupported version %d", path, s.Version)
+	}
+	return &s, nil
+}
+
+// WriteFile writes the snapshot to path. It holds user data, so the file is
+// only readable by the owner.
+func (s *Snapshot) WriteFile(path string) error {
+	raw, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	if err := tools.WriteFileAtomic(path, raw, 0o600); err != nil {
+		return fmt.Errorf("snapshot: %w", err)
+	}
+	return nil
+}
+
+// Recorder is a Source that passes calls to another Source and records the
+// results in a Snapshot.
+type Recorder struct {
+	src Source
+
+	mu   sync.Mutex
+	snap Snapshot
+}
+
+// NewRecorder records the results of src, naming sourceName as their origin.
+func NewRecorder(src Source, sourceName string) *Recorder {
+	return &Recorder{
+		src: src,
+		snap: Snapshot{
+			Version:   snapshotVersion,
+			Source:    CanonicalSourceName(sourceName),
+			CreatedAt: time.Now().UTC(),
+			Groups:    map[string]*models.Group{},
+			Members:   map[string][]models.User{},
+		},
+	}
+}
+
+func (r *Recorder) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
+	g, err := r.src.GetGroupByName(ctx, groupName)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.snap.Groups[groupName] = cloneGroup(g)
+	r.mu.Unlock()
+	return g, nil
+}
+
+func (r *Recorder) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	users, err := r.src.GetGroupMembers(ctx, groupID)
+	if err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	r.snap.Members[groupID] = cloneUsers(users)
+	r.mu.Unlock()
+	return users, nil
+}
+
+// Snapshot returns what has been recorded so far.
+func (r *Recorder) Snapshot() *Snapshot {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s := r.snap
+	s.Groups = make(map[string]*models.Group, len(r.snap.Groups))
+	for name, g := range r.snap.Groups {
+		s.Groups[name] = cloneGroup(g)
+	}
+	s.Members = make(map[string][]models.User, len(r.snap.Members))
+	for id, users := range r.snap.Members {
+		s.Members[id] = cloneUsers(users)
+	}
+	return &s
+}
+
+// snapshotSource replays a Snapshot. Lookups the snapshot doesn't cover are
+// errors rather than "not found", so a replay never silently differs from
+// the recorded run.
+type snapshotSource struct {
+	snap *Snapshot
+}
+
+// NewSnapshotSource returns a Source replaying the snapshot file at path.
+func NewSnapshotSource(path string) (Source, error) {
+	snap, err := ReadSnapshot(path)
+	if err != nil {
+		return nil, err
+	}
+	return &snapshotSource{snap: snap}, nil
+}
+
+func (s *snapshotSource) GetGroupByName(ctx context.Context, groupName string) (*models.Group, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	g, ok := s.snap.Groups[groupName]
+	if !ok {
+		return nil, fmt.Errorf("snapshot: group %q was not recorded", groupName)
+	}
+	return cloneGroup(g), nil
+}
+
+func (s *snapshotSource) GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	users, ok := s.snap.Members[groupID]
+	if !ok {
+		return nil, fmt.Errorf("snapshot: members of group ID %q were not recorded", groupID)
+	}
+	if users == nil {
+		return []models.User{}, nil
+	}
+	return cloneUsers(users), nil
+}
+
+// cloneGroup copies g, including its member list, so later changes by the
+// caller don't leak into recorded data.
+func cloneGroup(g *models.Group) *models.Group {
+	if g == nil {
+		return nil
+	}
+	c := *g
+	c.Users = cloneUsers(g.Users)
+	return &c
+}
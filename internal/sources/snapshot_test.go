@@ -0,0 +1,82 @@
+package sources
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot_RecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	rec := NewRecorder(&flakySource{}, "kk")
+
+	g, err := rec.GetGroupByName(t.Context(), "eng")
+	if err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if _, err := rec.GetGroupMembers(t.Context(), g.ID); err != nil {
+		t.Fatalf("GetGroupMembers: %v", err)
+	}
+	// Changes by the caller must not end up in the snapshot.
+	g.Name = "changed"
+
+	if err := rec.Snapshot().WriteFile(path); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("snapshot must be written with 0600: %v, %v", info, err)
+	}
+
+	snap, err := ReadSnapshot(path)
+	if err != nil {
+		t.Fatalf("ReadSnapshot: %v", err)
+	}
+	if snap.Source != "keycloak" || snap.CreatedAt.IsZero() {
+		t.Errorf("snapshot must name the source and time, got %q %v", snap.Source, snap.CreatedAt)
+	}
+
+	src, err := NewSource(SourceConfig{Name: "snapshot", Endpoint: path})
+	if err != nil {
+		t.Fatalf("NewSource: %v", err)
+	}
+	got, err := src.GetGroupByName(t.Context(), "eng")
+	if err != nil || got == nil || got.Name != "eng" {
+		t.Fatalf("replayed group: %+v, %v", got, err)
+	}
+	users, err := src.GetGroupMembers(t.Context(), got.ID)
+	if err != nil || len(users) != 1 || users[0].Username != "alice@" {
+		t.Fatalf("replayed members: %+v, %v", users, err)
+	}
+	if _, err := src.GetGroupByName(t.Context(), "ops"); err == nil {
+		t.Errorf("a group missing from the snapshot must be an error")
+	}
+}
+
+func TestSnapshot_ReplaysNotFound(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	rec := NewRecorder(&notFoundSource{}, "ldap")
+	if _, err := rec.GetGroupByName(t.Context(), "ghost"); err != nil {
+		t.Fatalf("GetGroupByName: %v", err)
+	}
+	if err := rec.Snapshot().WriteFile(path); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	src, err := NewSnapshotSource(path)
+	if err != nil {
+		t.Fatalf("NewSnapshotSource: %v", err)
+	}
+	if g, err := src.GetGroupByName(t.Context(), "ghost"); err != nil || g != nil {
+		t.Errorf("a group recorded as not found must replay as nil, got %+v, %v", g, err)
+	}
+}
+
+func TestReadSnapshot_RejectsUnknownVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	if err := os.WriteFile(path, []byte(`{"version": 99}`), 0o600); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := ReadSnapshot(path); err == nil {
+		t.Errorf("expected an error for an unknown version")
+	}
+}
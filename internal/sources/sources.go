@@ -1,42 +1,113 @@
 package sources
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/yousysadmin/headscale-pf/internal/models"
 )
 
-// Source interface
+// Source interface. Implementations must be safe for concurrent use, and stop
+// and return the context's error when ctx is cancelled or its deadline passes.
 type Source interface {
-	GetGroupByName(groupName string) (*models.Group, error)
-	GetGroupMembers(groupID string) ([]models.User, error)
+	GetGroupByName(ctx context.Context, groupName string) (*models.Group, error)
+	GetGroupMembers(ctx context.Context, groupID string) ([]models.User, error)
 }
 
 // SourceConfig config source
 type SourceConfig struct {
-	Name                   string // Name source name
-	Endpoint               string // Endpoint source endpoint
-	Token                  string // Token source auth token
-	InsecureSkipTLSVerify  bool   // Skip TLS certificate verification (Authentik HTTPS, LDAPS, LDAP+StartTLS)
-	LDAPBindPassword       string // LDAP bind password
-	LDAPBindDN             string // LDAP BindDN
-	LDAPBaseDN             string // LDAP BaseDN
-	LDAPDefaultEmailDomain string // Default email domain what used for synthesize an email when none is present (username@DefaultEmailDomain).
-	KeycloakRealm          string // Keycloak Realm
+	Name                     string            // Name source name
+	Endpoint                 string            // Endpoint source endpoint
+	Token                    string            // Token source auth token
+	InsecureSkipTLSVerify    bool              // Skip TLS certificate verification (Authentik/JumpCloud HTTPS, LDAPS, LDAP+StartTLS)
+	LDAPBindPassword         string            // LDAP bind password
+	LDAPBindDN               string            // LDAP BindDN
+	LDAPBaseDN               string            // LDAP BaseDN
+	LDAPDefaultEmailDomain   string            // Default email domain what used for synthesize an email when none is present (username@DefaultEmailDomain).
+	LDAPFilterGroups         map[string]string // LDAP virtual groups: group name -> LDAP filter selecting its members
+	JumpcloudRegion          string            // JumpCloud region, "us" (default) or "eu"; Endpoint overrides it
+	JumpcloudRPS             float64           // JumpCloud: maximum requests per second (0 = default)
+	JumpcloudNestedGroups    bool              // JumpCloud: include users of user groups nested in a group
+	AuthentikIncludeChildren bool              // Authentik: include members of all descendant (child) groups
+	AuthentikPagedMembers    bool              // Authentik: list members through the paged users endpoint (large groups)
+	KeycloakRealm            string            // Keycloak Realm
+	KeycloakClientID         string            // Keycloak confidential client used for client-credentials login (instead of Token)
+	KeycloakClientSecret     string            // Keycloak client secret
+	KeycloakAuthRealm        string            // Keycloak realm the client logs in to (defaults to KeycloakRealm)
+	KeycloakIncludeSubgroups bool              // Keycloak: include members of all descendant subgroups
+	KeycloakMode             string            // Keycloak: resolve template groups as "groups" (default) or "roles"
 }
 
-// NewSource init source
-func NewSource(config SourceConfig) (Source, error) {
-	switch config.Name {
+// NewSource init source. Options such as WithRetry, WithCircuitBreaker and
+// WithCache wrap the adapter.
+func NewSource(config SourceConfig, opts ...Option) (Source, error) {
+	var o sourceOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+	scope := cacheScope(config)
+
+	// Offline runs never talk to the source, so don't set up an adapter.
+	if o.cache != nil && o.cache.Offline {
+		if CanonicalSourceName(config.Name) == "" {
+			return nil, fmt.Errorf("unknown source name")
+		}
+		return cachedOrErr(newCachedSource(nil, *o.cache, scope))
+	}
+
+	var (
+		src Source
+		err error
+	)
+	switch CanonicalSourceName(config.Name) {
+	case "jumpcloud":
+		src, err = NewJCClient(config)
+	case "authentik":
+		src, err = NewAuthentikClient(config)
+	case "ldap":
+		src, err = NewLDAPClient(config)
+	case "keycloak":
+		src, err = NewKeycloakClient(config)
+	case "snapshot":
+		src, err = NewSnapshotSource(config.Endpoint)
+	default:
+		return nil, fmt.Errorf("unknown source name")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	src = wrapSource(src, opts...)
+	if o.cache != nil {
+		return cachedOrErr(newCachedSource(src, *o.cache, scope))
+	}
+	return src, nil
+}
+
+// cachedOrErr keeps a failed newCachedSource from turning into a non-nil
+// Source holding a nil pointer.
+func cachedOrErr(cs *cachedSource, err error) (Source, error) {
+	if err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+// CanonicalSourceName maps a source name or alias to the adapter name
+// ("jumpcloud", "authentik", "ldap", "keycloak", "snapshot"), or "" if it's
+// unknown.
+func CanonicalSourceName(name string) string {
+	switch name {
 	case "jc", "jumpcloud":
-		return NewJCClient(config)
+		return "jumpcloud"
 	case "ak", "authentik":
-		return NewAuthentikClient(config)
+		return "authentik"
 	case "ldap", "ldaps":
-		return NewLDAPClient(config)
+		return "ldap"
 	case "kk", "keycloak":
-		return NewKeycloakClient(config)
-	default:
-		return nil, fmt.Errorf("unknown source name")
+		return "keycloak"
+	case "snapshot":
+		return "snapshot"
 	}
+	return ""
 }
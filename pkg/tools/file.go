@@ -0,0 +1,96 @@
+package tools
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrNotAtomic reports that WriteFileAtomic couldn't replace the file by a
+// rename and overwrote it in place instead. The data was written, but a
+// reader may have seen a truncated file meanwhile; callers should warn.
+var ErrNotAtomic = errors.New("file overwritten in place, not atomically")
+
+// rename is os.Rename; tests replace it to simulate EBUSY and EXDEV.
+var rename = os.Rename
+
+// WriteFileAtomic writes data to a temporary file next to path, syncs it to
+// disk and renames it over path, so readers see either the old or the new
+// content but never a partial file, even after a crash.
+//
+// A symlink at path is followed and its target replaced, and the owner of an
+// existing file is kept where the process may set it. When path can't be
+// replaced by a rename, e.g. a single-file bind mount (EBUSY) or a target on
+// another file system (EXDEV), the file is overwritten in place instead,
+// which isn't atomic: a successful write then returns an error wrapping
+// ErrNotAtomic.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	if target, err := filepath.EvalSymlinks(path); err == nil {
+		path = target
+	}
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		// Best effort: only root may hand a file to another user.
+		if uid, gid, ok := fileOwner(fi); ok {
+			_ = tmp.Chown(uid, gid)
+		}
+	}
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if renameErr := rename(tmp.Name(), path); renameErr != nil {
+		if !errors.Is(renameErr, syscall.EBUSY) && !errors.Is(renameErr, syscall.EXDEV) {
+			return renameErr
+		}
+		if err := writeInPlace(path, data); err != nil {
+			return err
+		}
+		return fmt.Errorf("%s: %w: %v", path, ErrNotAtomic, errors.Unwrap(renameErr))
+	}
+
+	// Persist the rename itself. Not every platform can sync a directory,
+	// and the file is in place either way, so errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		_ = d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// writeInPlace truncates and rewrites the existing file at path, keeping its
+// inode, owner and mode.
+func writeInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
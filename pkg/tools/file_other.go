@@ -0,0 +1,10 @@
+//go:build !unix
+
+package tools
+
+import "io/fs"
+
+// fileOwner reports no owner: there is none to keep on this platform.
+func fileOwner(fs.FileInfo) (uid, gid int, ok bool) {
+	return 0, 0, false
+}
@@ -0,0 +1,69 @@
+package tools
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestWriteFileAtomic_FollowsSymlink(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "policy.hjson")
+	link := filepath.Join(dir, "current.hjson")
+	if err := os.WriteFile(target, []byte("old"), 0o640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("symlinks not supported: %v", err)
+	}
+
+	if err := WriteFileAtomic(link, []byte("new"), 0o640); err != nil {
+		t.Fatalf("WriteFileAtomic: %v", err)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("the symlink must stay a symlink: %v, %v", fi, err)
+	}
+	if raw, _ := os.ReadFile(target); string(raw) != "new" {
+		t.Errorf("target holds %q, want the new content", raw)
+	}
+}
+
+func TestWriteInPlace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.hjson")
+	if err := os.WriteFile(path, []byte("a longer old content"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := os.Stat(path)
+	if err := writeInPlace(path, []byte("new")); err != nil {
+		t.Fatalf("writeInPlace: %v", err)
+	}
+	after, _ := os.Stat(path)
+	if raw, _ := os.ReadFile(path); string(raw) != "new" {
+		t.Errorf("file holds %q, want new", raw)
+	}
+	if !os.SameFile(before, after) {
+		t.Error("an in-place write must keep the file")
+	}
+}
+
+func TestWriteFileAtomic_ReportsInPlaceWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.hjson")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	// A bind-mounted file can't be replaced by a rename.
+	rename = func(oldpath, newpath string) error {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: syscall.EBUSY}
+	}
+	t.Cleanup(func() { rename = os.Rename })
+
+	err := WriteFileAtomic(path, []byte("new"), 0o600)
+	if !errors.Is(err, ErrNotAtomic) {
+		t.Fatalf("err = %v, want ErrNotAtomic", err)
+	}
+	if raw, _ := os.ReadFile(path); string(raw) != "new" {
+		t.Errorf("file holds %q, want the new content", raw)
+	}
+}